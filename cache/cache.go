@@ -2,7 +2,9 @@ package cache
 
 import (
 	"log"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/homebot/dnswall"
@@ -14,6 +16,14 @@ import (
 type RR struct {
 	Time time.Time
 
+	// Secure is true if the record has been part of a response that
+	// has been validated using DNSSEC
+	Secure bool
+
+	// Subnet is the client network the record is valid for if it has been
+	// resolved using EDNS Client Subnet. Nil if valid for all clients
+	Subnet *net.IPNet
+
 	dns.RR
 }
 
@@ -23,6 +33,28 @@ func (r RR) Valid() bool {
 	return r.Time.Add(time.Duration(r.RR.Header().Ttl) * time.Second).After(time.Now())
 }
 
+// Expires returns the time the cached RR expires
+func (r RR) Expires() time.Time {
+	return r.Time.Add(time.Duration(r.RR.Header().Ttl) * time.Second)
+}
+
+// Matches returns true if the cached RR may be used to answer a request from
+// ip. If the request carried a client subnet option, prefix is its source
+// prefix length and -1 otherwise
+func (r RR) Matches(ip net.IP, prefix int) bool {
+	if r.Subnet == nil {
+		return true
+	}
+
+	// the client did not reveal enough of its address to use an answer
+	// with a longer scope (RFC 7871 section 7.3.1)
+	if ones, _ := r.Subnet.Mask.Size(); prefix >= 0 && prefix < ones {
+		return false
+	}
+
+	return ip != nil && r.Subnet.Contains(ip)
+}
+
 // NewCachedRR creates a new cached RR
 func NewCachedRR(rr dns.RR) RR {
 	return RR{
@@ -31,10 +63,43 @@ func NewCachedRR(rr dns.RR) RR {
 	}
 }
 
+// staleTTL is the TTL used for stale records served to clients (RFC 8767)
+const staleTTL = 30
+
+// Stats holds statistics about the cache
+type Stats struct {
+	// Hits is the number of requests answered from the cache
+	Hits uint64 `json:"hits"`
+
+	// Misses is the number of requests passed down the middleware stack
+	Misses uint64 `json:"misses"`
+
+	// Evictions is the number of expired resource records removed from
+	// the cache
+	Evictions uint64 `json:"evictions"`
+
+	// StaleServed is the number of failed requests that have been answered
+	// using expired resource records
+	StaleServed uint64 `json:"staleServed"`
+
+	// Records is the number of resource records currently held by the cache
+	Records int `json:"records"`
+}
+
 // Cache is a DNS response caching middleware
 type Cache struct {
+	// ServeStale configures how long expired resource records are kept
+	// and used to answer requests that failed to resolve. Set to zero
+	// to disable serving stale records
+	ServeStale time.Duration
+
 	rw      sync.RWMutex
 	records map[string][]RR
+
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	staleServed uint64
 }
 
 // New returns a new caching middleware
@@ -57,18 +122,64 @@ func (c *Cache) Serve(session *dnswall.Session, req *request.Request) error {
 
 	rrs, ok := c.records[req.Name().String()]
 	if ok {
-		var result []dns.RR
+		var result, sigs []dns.RR
+		secure := true
+		scope := 0
+		ip, prefix := clientAddr(req)
+
 		for _, rr := range rrs {
-			if rr.Valid() && rr.Header().Rrtype == uint16(req.Type()) && rr.Header().Class == uint16(req.Class()) {
+			if !rr.Valid() || rr.Header().Class != uint16(req.Class()) || !rr.Matches(ip, prefix) {
+				continue
+			}
+
+			if rr.Header().Rrtype == uint16(req.Type()) {
 				result = append(result, rr.RR)
+				secure = secure && rr.Secure
+
+				if rr.Subnet != nil {
+					if ones, _ := rr.Subnet.Mask.Size(); ones > scope {
+						scope = ones
+					}
+				}
+			}
+
+			if sig, ok := rr.RR.(*dns.RRSIG); ok && sig.TypeCovered == uint16(req.Type()) {
+				sigs = append(sigs, sig)
 			}
 		}
 
 		if len(result) > 0 {
-			return session.Resolve(dns.RcodeSuccess, result, nil)
+			atomic.AddUint64(&c.hits, 1)
+
+			m := session.Prepare()
+			m.Answer = result
+			m.AuthenticatedData = secure
+
+			// include signatures for clients that requested DNSSEC records
+			if opt := req.Req.IsEdns0(); opt != nil && opt.Do() {
+				m.Answer = append(m.Answer, sigs...)
+			}
+
+			// clients that sent a client subnet option expect it to be
+			// returned together with the scope of the answer
+			if cs := requestSubnet(req); cs != nil {
+				opt := req.Req.IsEdns0()
+				m.SetEdns0(opt.UDPSize(), opt.Do())
+				m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+					Code:          cs.Code,
+					Family:        cs.Family,
+					SourceNetmask: cs.SourceNetmask,
+					SourceScope:   uint8(scope),
+					Address:       cs.Address,
+				})
+			}
+
+			return session.ResolveWith(m)
 		}
 	}
 
+	atomic.AddUint64(&c.misses, 1)
+
 	// register on Complete handler to cache new RRs
 	session.OnComplete(c.onComplete)
 
@@ -79,13 +190,50 @@ func (c *Cache) onComplete(session *dnswall.Session, request *request.Request, r
 	c.rw.Lock()
 	defer c.rw.Unlock()
 
-	if response != nil {
-		c.cacheRRs(response.Answer)
-		c.cacheRRs(response.Extra)
+	if response == nil {
+		return
+	}
+
+	if response.Rcode == dns.RcodeServerFailure && c.ServeStale > 0 {
+		c.serveStale(request, response)
+		return
 	}
+
+	// only the answer section is covered by DNSSEC validation. The AD bit
+	// is cleared by resolvers and set by the validator only, so it carries
+	// the verdict of the validator
+	c.cacheRRs(response.Answer, response.AuthenticatedData, request.ClientSubnet)
+	c.cacheRRs(response.Extra, false, request.ClientSubnet)
 }
 
-func (c *Cache) cacheRRs(rrs []dns.RR) {
+// serveStale rewrites a failed response using expired resource records
+// that are still within the ServeStale window
+func (c *Cache) serveStale(req *request.Request, response *dns.Msg) {
+	var stale []dns.RR
+	ip, prefix := clientAddr(req)
+
+	for _, rr := range c.records[req.Name().String()] {
+		if rr.Header().Rrtype != uint16(req.Type()) || rr.Header().Class != uint16(req.Class()) || !rr.Matches(ip, prefix) {
+			continue
+		}
+
+		cpy := dns.Copy(rr.RR)
+		cpy.Header().Ttl = staleTTL
+		stale = append(stale, cpy)
+	}
+
+	if len(stale) == 0 {
+		return
+	}
+
+	log.Printf("[cache] serving %d stale resource records for %q\n", len(stale), req.Name())
+	atomic.AddUint64(&c.staleServed, 1)
+
+	response.Rcode = dns.RcodeSuccess
+	response.Answer = stale
+}
+
+func (c *Cache) cacheRRs(rrs []dns.RR, secure bool, subnet *net.IPNet) {
 L:
 	// TODO: there are devils inside
 	for _, answer := range rrs {
@@ -93,12 +241,16 @@ L:
 		name := dns.Name(answer.Header().Name).String()
 
 		for _, rr := range c.records[name] {
-			if rr.Header().Rrtype == answer.Header().Rrtype && rr.Header().Class == answer.Header().Class && answer.Header().Ttl > 0 {
+			if rr.Valid() && sameType(rr.RR, answer) && sameSubnet(rr.Subnet, subnet) && rr.Header().Class == answer.Header().Class && answer.Header().Ttl > 0 {
 				continue L
 			}
 		}
 
-		if newRR := NewCachedRR(answer); newRR.Valid() {
+		newRR := NewCachedRR(answer)
+		newRR.Secure = secure
+		newRR.Subnet = subnet
+
+		if newRR.Valid() {
 			log.Printf("[cache] caching resource record: %s\n", answer.String())
 			newRRs = append(newRRs, newRR)
 		}
@@ -107,6 +259,54 @@ L:
 	}
 }
 
+// sameType returns true if a and b have the same type. Signatures are
+// compared by the type they cover
+func sameType(a, b dns.RR) bool {
+	if a.Header().Rrtype != b.Header().Rrtype {
+		return false
+	}
+
+	sa, ok := a.(*dns.RRSIG)
+	if !ok {
+		return true
+	}
+
+	return sa.TypeCovered == b.(*dns.RRSIG).TypeCovered
+}
+
+// sameSubnet returns true if a and b are the same network
+func sameSubnet(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.String() == b.String()
+}
+
+// clientAddr returns the address used to select scoped records for req. It
+// is the address of the client subnet option if req carries one and the
+// address of the client otherwise
+func clientAddr(req *request.Request) (net.IP, int) {
+	if subnet := requestSubnet(req); subnet != nil {
+		return subnet.Address, int(subnet.SourceNetmask)
+	}
+
+	return net.ParseIP(req.ClientIP()), -1
+}
+
+// requestSubnet returns the client subnet option of req
+func requestSubnet(req *request.Request) *dns.EDNS0_SUBNET {
+	if opt := req.Req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				return subnet
+			}
+		}
+	}
+
+	return nil
+}
+
 func (c *Cache) cleanUp() {
 	for {
 		select {
@@ -115,13 +315,16 @@ func (c *Cache) cleanUp() {
 
 		c.rw.Lock()
 
+		now := time.Now()
+
 		for domain, rrs := range c.records {
 			var valid []RR
 			for _, rr := range rrs {
-				if rr.Valid() {
+				if rr.Expires().Add(c.ServeStale).After(now) {
 					valid = append(valid, rr)
 				} else {
 					log.Printf("[cache] Evicted cached RR: %s", rr.String())
+					atomic.AddUint64(&c.evictions, 1)
 				}
 
 				c.records[domain] = valid
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Stats returns statistics about the cache
+func (c *Cache) Stats() Stats {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+
+	records := 0
+	for _, rrs := range c.records {
+		records += len(rrs)
+	}
+
+	return Stats{
+		Hits:        atomic.LoadUint64(&c.hits),
+		Misses:      atomic.LoadUint64(&c.misses),
+		Evictions:   atomic.LoadUint64(&c.evictions),
+		StaleServed: atomic.LoadUint64(&c.staleServed),
+		Records:     records,
+	}
+}
+
+// Entries returns all resource records cached for name. Expired records that
+// are kept for serving stale answers are included
+func (c *Cache) Entries(name string) []RR {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+
+	rrs := c.records[dns.Name(dns.Fqdn(name)).String()]
+
+	result := make([]RR, len(rrs))
+	copy(result, rrs)
+
+	return result
+}
+
+// Flush removes all resource records cached for name and returns
+// the number of records removed
+func (c *Cache) Flush(name string) int {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+
+	name = dns.Name(dns.Fqdn(name)).String()
+
+	count := len(c.records[name])
+	delete(c.records, name)
+
+	log.Printf("[cache] flushed %d resource records for %q\n", count, name)
+
+	return count
+}
+
+// FlushSuffix removes all resource records cached for suffix and any of its
+// sub-domains and returns the number of records removed
+func (c *Cache) FlushSuffix(suffix string) int {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+
+	suffix = dns.Fqdn(suffix)
+	count := 0
+
+	for name, rrs := range c.records {
+		if dns.IsSubDomain(suffix, name) {
+			count += len(rrs)
+			delete(c.records, name)
+		}
+	}
+
+	log.Printf("[cache] flushed %d resource records below %q\n", count, suffix)
+
+	return count
+}
+
+// FlushAll removes all resource records from the cache and returns the number
+// of records removed
+func (c *Cache) FlushAll() int {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+
+	count := 0
+	for _, rrs := range c.records {
+		count += len(rrs)
+	}
+
+	c.records = make(map[string][]RR)
+
+	log.Printf("[cache] flushed %d resource records\n", count)
+
+	return count
+}
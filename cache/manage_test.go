@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newTestCache returns a cache holding the given records
+func newTestCache(t *testing.T, records ...string) *Cache {
+	var rrs []dns.RR
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	c := New()
+
+	c.rw.Lock()
+	c.cacheRRs(rrs, false, nil)
+	c.rw.Unlock()
+
+	return c
+}
+
+var testRecords = []string{
+	"example.com. 300 IN A 192.0.2.1",
+	"example.com. 300 IN AAAA 2001:db8::1",
+	"www.example.com. 300 IN A 192.0.2.2",
+	"mail.example.com. 300 IN A 192.0.2.3",
+	"example.org. 300 IN A 198.51.100.1",
+}
+
+func TestEntries(t *testing.T) {
+	c := newTestCache(t, testRecords...)
+
+	cases := []struct {
+		name  string
+		count int
+	}{
+		{"example.com.", 2},
+		{"example.com", 2},
+		{"www.example.com.", 1},
+		{"other.example.com.", 0},
+	}
+
+	for _, tc := range cases {
+		entries := c.Entries(tc.name)
+		if len(entries) != tc.count {
+			t.Errorf("Entries(%q): expected %d records, got %d", tc.name, tc.count, len(entries))
+		}
+
+		for _, rr := range entries {
+			if !equalNames(rr.Header().Name, tc.name) {
+				t.Errorf("Entries(%q): unexpected record %s", tc.name, rr)
+			}
+		}
+	}
+
+	if stats := c.Stats(); stats.Records != len(testRecords) {
+		t.Errorf("expected %d records, got %d", len(testRecords), stats.Records)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	cases := []struct {
+		desc    string
+		flush   func(c *Cache) int
+		flushed int
+		left    []string
+	}{
+		{"name", func(c *Cache) int { return c.Flush("example.com") }, 2, []string{"www.example.com.", "mail.example.com.", "example.org."}},
+		{"unknown name", func(c *Cache) int { return c.Flush("other.example.com.") }, 0, []string{"example.com.", "www.example.com.", "mail.example.com.", "example.org."}},
+		{"suffix", func(c *Cache) int { return c.FlushSuffix("example.com") }, 4, []string{"example.org."}},
+		{"sub-domain suffix", func(c *Cache) int { return c.FlushSuffix("www.example.com.") }, 1, []string{"example.com.", "mail.example.com.", "example.org."}},
+		{"all", func(c *Cache) int { return c.FlushAll() }, 5, nil},
+	}
+
+	for _, tc := range cases {
+		c := newTestCache(t, testRecords...)
+
+		if n := tc.flush(c); n != tc.flushed {
+			t.Errorf("%s: expected %d records to be flushed, got %d", tc.desc, tc.flushed, n)
+		}
+
+		left := 0
+		for _, name := range tc.left {
+			if len(c.Entries(name)) == 0 {
+				t.Errorf("%s: records for %s have been flushed", tc.desc, name)
+			}
+
+			left += len(c.Entries(name))
+		}
+
+		if stats := c.Stats(); stats.Records != left {
+			t.Errorf("%s: expected %d records left, got %d", tc.desc, left, stats.Records)
+		}
+	}
+}
+
+// equalNames returns true if a and b are the same domain name
+func equalNames(a, b string) bool {
+	return strings.EqualFold(dns.Fqdn(a), dns.Fqdn(b))
+}
@@ -0,0 +1,241 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// snapshotHeader is the first line of each snapshot file and is followed by
+// the unix timestamp the snapshot has been taken at and the number of
+// records it holds
+const snapshotHeader = "; dnswall cache snapshot"
+
+// Record flags are written as comments after each record
+const (
+	// secureFlag marks records that have been validated using DNSSEC
+	secureFlag = "secure"
+
+	// subnetFlag holds the client subnet a record is scoped to
+	subnetFlag = "subnet="
+)
+
+// WriteSnapshot writes all valid resource records of the cache to w. Records
+// are written in zone file format with their TTL set to the time remaining
+// until they expire. The DNSSEC validation state and the client subnet of
+// each record are written as a comment
+func (c *Cache) WriteSnapshot(w io.Writer) error {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+
+	now := time.Now()
+
+	// the records are counted first so truncated snapshots are detected
+	// when reading them
+	var lines []string
+
+	for _, rrs := range c.records {
+		for _, rr := range rrs {
+			remaining := rr.Time.Add(time.Duration(rr.Header().Ttl)*time.Second).Sub(now) / time.Second
+			if remaining <= 0 {
+				continue
+			}
+
+			cpy := dns.Copy(rr.RR)
+			cpy.Header().Ttl = uint32(remaining)
+
+			var flags []string
+			if rr.Secure {
+				flags = append(flags, secureFlag)
+			}
+
+			if rr.Subnet != nil {
+				flags = append(flags, subnetFlag+rr.Subnet.String())
+			}
+
+			line := cpy.String()
+			if len(flags) > 0 {
+				line += " ; " + strings.Join(flags, " ")
+			}
+
+			lines = append(lines, line)
+		}
+	}
+
+	buf := bufio.NewWriter(w)
+	if _, err := fmt.Fprintf(buf, "%s %d %d\n", snapshotHeader, now.Unix(), len(lines)); err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(buf, line); err != nil {
+			return err
+		}
+	}
+
+	return buf.Flush()
+}
+
+// ReadSnapshot restores resource records from a snapshot written by WriteSnapshot.
+// The TTL of each record is reduced by the time elapsed since the snapshot has
+// been taken and records that expired in the meantime are skipped. Nothing is
+// restored from corrupt or truncated snapshots
+func (c *Cache) ReadSnapshot(r io.Reader) error {
+	buf := bufio.NewReader(r)
+
+	header, err := buf.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	if !strings.HasPrefix(header, snapshotHeader) {
+		return errors.New("invalid cache snapshot header")
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(header, snapshotHeader))
+	if len(fields) == 0 || len(fields) > 2 {
+		return errors.New("invalid cache snapshot header")
+	}
+
+	ts, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid cache snapshot timestamp: %s", err)
+	}
+
+	// snapshots of older versions do not hold the number of records
+	count := -1
+	if len(fields) == 2 {
+		count, err = strconv.Atoi(fields[1])
+		if err != nil || count < 0 {
+			return fmt.Errorf("invalid cache snapshot record count %q", fields[1])
+		}
+	}
+
+	elapsed := time.Since(time.Unix(ts, 0)) / time.Second
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	var restored []RR
+	read := 0
+
+	tokens := dns.ParseZone(buf, ".", "")
+
+	// the parser blocks until all tokens have been read, drain them if we
+	// return early
+	defer func() {
+		for range tokens {
+		}
+	}()
+
+	for token := range tokens {
+		if token.Error != nil {
+			return token.Error
+		}
+
+		read++
+
+		if int64(token.RR.Header().Ttl) <= int64(elapsed) {
+			continue
+		}
+
+		token.RR.Header().Ttl -= uint32(elapsed)
+
+		rr := NewCachedRR(token.RR)
+
+		for _, flag := range strings.Fields(strings.TrimPrefix(token.Comment, ";")) {
+			switch {
+			case flag == secureFlag:
+				rr.Secure = true
+			case strings.HasPrefix(flag, subnetFlag):
+				_, subnet, err := net.ParseCIDR(strings.TrimPrefix(flag, subnetFlag))
+				if err != nil {
+					return fmt.Errorf("invalid client subnet: %s", err)
+				}
+
+				rr.Subnet = subnet
+			}
+		}
+
+		restored = append(restored, rr)
+	}
+
+	if count >= 0 && read != count {
+		return fmt.Errorf("truncated cache snapshot: expected %d records, got %d", count, read)
+	}
+
+	c.rw.Lock()
+	defer c.rw.Unlock()
+
+	for _, rr := range restored {
+		name := dns.Name(rr.Header().Name).String()
+		c.records[name] = append(c.records[name], rr)
+	}
+
+	log.Printf("[cache] restored %d resource records from snapshot\n", len(restored))
+
+	return nil
+}
+
+// SaveSnapshot writes a snapshot of the cache to file. The snapshot is written
+// to a temporary file first and renamed afterwards so an existing snapshot
+// is never left half-written
+func (c *Cache) SaveSnapshot(file string) error {
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if err := c.WriteSnapshot(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), file)
+}
+
+// LoadSnapshot restores the cache from the given snapshot file. A missing
+// snapshot file is not treated as an error
+func (c *Cache) LoadSnapshot(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	return c.ReadSnapshot(f)
+}
+
+// SnapshotEvery periodically saves a snapshot of the cache to file
+func (c *Cache) SnapshotEvery(file string, interval time.Duration) {
+	go func() {
+		for {
+			select {
+			case <-time.After(interval):
+			}
+
+			if err := c.SaveSnapshot(file); err != nil {
+				log.Printf("[cache] failed to save snapshot: %s\n", err)
+			}
+		}
+	}()
+}
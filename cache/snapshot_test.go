@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnswall-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, subnet, _ := net.ParseCIDR("192.0.2.0/24")
+
+	c := newTestCache(t, "www.example.com. 300 IN A 192.0.2.1")
+
+	secure, _ := dns.NewRR("example.com. 300 IN AAAA 2001:db8::1")
+	scoped, _ := dns.NewRR("cdn.example.com. 300 IN A 198.51.100.1")
+	expired, _ := dns.NewRR("old.example.com. 60 IN A 192.0.2.99")
+
+	c.rw.Lock()
+	c.cacheRRs([]dns.RR{secure}, true, nil)
+	c.cacheRRs([]dns.RR{scoped}, false, subnet)
+	c.records["old.example.com."] = []RR{{Time: time.Now().Add(-time.Hour), RR: expired}}
+	c.rw.Unlock()
+
+	file := filepath.Join(dir, "cache.snapshot")
+	if err := c.SaveSnapshot(file); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := New()
+	if err := loaded.LoadSnapshot(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if records := loaded.Stats().Records; records != 3 {
+		t.Errorf("expected 3 records, got %d", records)
+	}
+
+	if entries := loaded.Entries("old.example.com."); len(entries) != 0 {
+		t.Errorf("expired record has been restored: %v", entries)
+	}
+
+	cases := []struct {
+		name   string
+		secure bool
+		subnet string
+	}{
+		{"www.example.com.", false, ""},
+		{"example.com.", true, ""},
+		{"cdn.example.com.", false, "192.0.2.0/24"},
+	}
+
+	for _, tc := range cases {
+		entries := loaded.Entries(tc.name)
+		if len(entries) != 1 {
+			t.Errorf("%s: expected one record, got %v", tc.name, entries)
+			continue
+		}
+
+		rr := entries[0]
+		if rr.Secure != tc.secure {
+			t.Errorf("%s: expected secure=%v, got %v", tc.name, tc.secure, rr.Secure)
+		}
+
+		if s := subnetString(rr.Subnet); s != tc.subnet {
+			t.Errorf("%s: expected subnet %q, got %q", tc.name, tc.subnet, s)
+		}
+
+		if ttl := rr.Header().Ttl; ttl == 0 || ttl > 300 {
+			t.Errorf("%s: unexpected TTL %d", tc.name, ttl)
+		}
+	}
+
+	// a missing snapshot is not an error
+	if err := New().LoadSnapshot(filepath.Join(dir, "missing")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSnapshotDropsExpiredRecords(t *testing.T) {
+	snapshot := fmt.Sprintf("%s %d 2\nshort.example.com. 60 IN A 192.0.2.1\nlong.example.com. 300 IN A 192.0.2.2\n", snapshotHeader, time.Now().Add(-2*time.Minute).Unix())
+
+	c := New()
+	if err := c.ReadSnapshot(strings.NewReader(snapshot)); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries := c.Entries("short.example.com."); len(entries) != 0 {
+		t.Errorf("expired record has been restored: %v", entries)
+	}
+
+	entries := c.Entries("long.example.com.")
+	if len(entries) != 1 {
+		t.Fatalf("expected one record, got %v", entries)
+	}
+
+	// the TTL is reduced by the age of the snapshot
+	if ttl := entries[0].Header().Ttl; ttl < 170 || ttl > 180 {
+		t.Errorf("expected TTL of about 180, got %d", ttl)
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	c := newTestCache(t, testRecords...)
+
+	var buf bytes.Buffer
+	if err := c.WriteSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot := buf.String()
+	lastLine := strings.LastIndex(strings.TrimSuffix(snapshot, "\n"), "\n") + 1
+
+	cases := []struct {
+		desc string
+		data string
+	}{
+		{"empty", ""},
+		{"missing header", "www.example.com. 300 IN A 192.0.2.1\n"},
+		{"invalid timestamp", snapshotHeader + " yesterday 1\nwww.example.com. 300 IN A 192.0.2.1\n"},
+		{"invalid record", strings.Replace(snapshot, "192.0.2.2", "192.0.2", 1)},
+		{"invalid subnet", fmt.Sprintf("%s %d 1\nwww.example.com. 300 IN A 192.0.2.1 ; subnet=192.0.2.0/99\n", snapshotHeader, time.Now().Unix())},
+		{"truncated record", snapshot[:len(snapshot)-4]},
+		{"truncated at a line", snapshot[:lastLine]},
+	}
+
+	for _, tc := range cases {
+		restored := New()
+		if err := restored.ReadSnapshot(strings.NewReader(tc.data)); err == nil {
+			t.Errorf("%s: expected error", tc.desc)
+		}
+
+		if records := restored.Stats().Records; records != 0 {
+			t.Errorf("%s: expected nothing to be restored, got %d records", tc.desc, records)
+		}
+	}
+}
+
+// subnetString returns the string representation of subnet or an empty
+// string if nil
+func subnetString(subnet *net.IPNet) string {
+	if subnet == nil {
+		return ""
+	}
+
+	return subnet.String()
+}
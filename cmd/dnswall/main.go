@@ -3,48 +3,172 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kingpin"
 
 	"github.com/homebot/dnswall"
 	"github.com/homebot/dnswall/cache"
+	"github.com/homebot/dnswall/dnssec"
 	"github.com/homebot/dnswall/forwarder"
+	"github.com/homebot/dnswall/management"
+	"github.com/homebot/dnswall/recursor"
 	"github.com/homebot/dnswall/rules"
 	"github.com/homebot/dnswall/server"
 	"github.com/homebot/dnswall/zone"
+	"github.com/miekg/dns"
 )
 
 var (
 	inputRules  string
 	outputRules string
-	zoneFile    string
+	zoneFiles   []string
 	zoneName    string
 	forwarders  []string
 	forwardIf   []string
 	listen      []string
 	listenAll   bool
+
+	zonesDir               string
+	zoneResolveDelegations bool
+	zoneReloadInterval     time.Duration
+	zoneSerialCheck        bool
+	zoneTransferAllow      []string
+	zoneTransferKeys       []string
+	zoneUpdatePolicies     []string
+	zoneNotify             = zone.DefaultNotifyConfig
+	zoneNotifyKey          string
+
+	secondaries  []string
+	secondaryDir string
+	secondaryKey string
+
+	tsigKeys []string
+
+	cacheFile             string
+	cacheSnapshotInterval time.Duration
+	cacheServeStale       time.Duration
+
+	managementListen string
+
+	healthCheckInterval time.Duration
+	healthCheckMaxFails int
+
+	forwardStrategy string
+	raceCount       int
+
+	forwardFallback    bool
+	forwardFallthrough bool
+	forwardRetryRcodes []string
+	forwardEDE         bool
+	forwardUDPSize     uint
+	forwardTimeouts    = forwarder.DefaultTimeouts
+	queryTimeout       time.Duration
+
+	forwardZones      []string
+	forwardResolvConf []string
+
+	forwardECS            bool
+	forwardECSIPv4Prefix  uint
+	forwardECSIPv6Prefix  uint
+	forwardECSPassthrough bool
+
+	recurse   bool
+	rootHints string
+
+	validate    bool
+	trustAnchor string
 )
 
 func init() {
 	kingpin.Flag("input-rules", "File containing input rules").Short('i').StringVar(&inputRules)
 	kingpin.Flag("output-rules", "File containing output rules").Short('o').StringVar(&outputRules)
-	kingpin.Flag("zone", "File contain the DNS zone to serve (bind format)").Short('z').StringVar(&zoneFile)
-	kingpin.Flag("origin", "Zone origin").Short('n').StringVar(&zoneName)
-	kingpin.Flag("forwarder", "Forwarder DNS servers to use").Short('f').StringsVar(&forwarders)
-	kingpin.Flag("forward-if", "Conditional forwarders in format host:port=condtion").Short('F').StringsVar(&forwardIf)
+	kingpin.Flag("zone", "Zone file to serve (bind format) as file=origin. May be repeated").Short('z').StringsVar(&zoneFiles)
+	kingpin.Flag("origin", "Zone origin used for --zone files without one").Short('n').StringVar(&zoneName)
+	kingpin.Flag("zone-reload-interval", "Interval for checking zone files for modifications and reloading them. Disabled if zero").DurationVar(&zoneReloadInterval)
+	kingpin.Flag("zone-serial-check", "Refuse to reload zones whose SOA serial has not been increased").Default("true").BoolVar(&zoneSerialCheck)
+	kingpin.Flag("zones-dir", "Directory of zone files to serve. The origin is taken from $ORIGIN or the file name").StringVar(&zonesDir)
+	kingpin.Flag("zone-transfer-allow", "Network (CIDR) allowed to transfer zones using AXFR and IXFR. May be repeated").StringsVar(&zoneTransferAllow)
+	kingpin.Flag("zone-transfer-key", "Name of a TSIG key zone transfer requests must be signed with. May be repeated").StringsVar(&zoneTransferKeys)
+	kingpin.Flag("zone-update-policy", "Allow dynamic updates signed with a TSIG key as key[:name[,name...][:type[,type...]]]. Names may start with *. May be repeated").StringsVar(&zoneUpdatePolicies)
+	kingpin.Flag("zone-notify", "Secondary server (host[:port]) to send NOTIFY messages to when a zone changes. May be repeated").StringsVar(&zoneNotify.Secondaries)
+	kingpin.Flag("zone-notify-ns", "Also send NOTIFY messages to the name servers of the NS records of changed zones").BoolVar(&zoneNotify.NotifyNS)
+	kingpin.Flag("zone-notify-retries", "Number of retransmissions of unacknowledged NOTIFY messages").Default("5").IntVar(&zoneNotify.Retries)
+	kingpin.Flag("zone-notify-interval", "Time to wait for a NOTIFY acknowledgement before retransmitting").Default("1m").DurationVar(&zoneNotify.Interval)
+	kingpin.Flag("zone-notify-key", "Name of the TSIG key used to sign NOTIFY messages").StringVar(&zoneNotifyKey)
+	kingpin.Flag("secondary", "Secondary zone to transfer from primary servers as origin=primary[,primary...]. May be repeated").StringsVar(&secondaries)
+	kingpin.Flag("secondary-dir", "Directory to save transferred secondary zones to so they are available on start-up").StringVar(&secondaryDir)
+	kingpin.Flag("secondary-key", "Name of the TSIG key used to sign requests to primary servers").StringVar(&secondaryKey)
+	kingpin.Flag("tsig-key", "TSIG key used to validate and sign messages in format [algorithm:]name:base64-secret. The algorithm defaults to hmac-sha256. May be repeated").StringsVar(&tsigKeys)
+	kingpin.Flag("zone-resolve-delegations", "Resolve names below zone cuts using the delegated servers instead of answering with a referral").BoolVar(&zoneResolveDelegations)
+	kingpin.Flag("forwarder", "Forwarder DNS servers to use (host:port, udp://, tcp://, tls:// or https:// URLs)").Short('f').StringsVar(&forwarders)
+	kingpin.Flag("forward-if", "Conditional forwarders in format host:port[,host:port...]=condition. Evaluated in order, the first match wins").Short('F').StringsVar(&forwardIf)
+	kingpin.Flag("forward-zones", "File with forward and stub zones (domain followed by servers per line). Longest matching domain wins").StringsVar(&forwardZones)
+	kingpin.Flag("forward-resolv-conf", "resolv.conf style file whose name servers are used for its domain and search domains").StringsVar(&forwardResolvConf)
 	kingpin.Flag("listen", "Addresses to listen on").Short('l').StringsVar(&listen)
 	kingpin.Flag("listen-all", "Listen on 0.0.0.0:53 for UDP and TCP").Short('L').BoolVar(&listenAll)
+	kingpin.Flag("cache-file", "File to persist the DNS cache to across restarts").StringVar(&cacheFile)
+	kingpin.Flag("cache-snapshot-interval", "Interval for saving cache snapshots (requires --cache-file)").Default("5m").DurationVar(&cacheSnapshotInterval)
+	kingpin.Flag("cache-serve-stale", "Serve expired cache records up to this duration if a request fails to resolve").DurationVar(&cacheServeStale)
+	kingpin.Flag("forward-strategy", "Strategy for selecting forwarders: sequential, round-robin, random, lowest-latency or race").Default("sequential").StringVar(&forwardStrategy)
+	kingpin.Flag("race-count", "Number of forwarders queried in parallel by the race strategy").Default("2").IntVar(&raceCount)
+	kingpin.Flag("forward-fallback", "Fall back to the static forwarders if a conditional forwarder fails").BoolVar(&forwardFallback)
+	kingpin.Flag("forward-fallthrough", "Pass requests to the next middleware if all forwarders failed instead of answering with SERVFAIL").BoolVar(&forwardFallthrough)
+	kingpin.Flag("forward-retry-rcode", "Forwarder response codes that cause the next forwarder to be queried").Default("SERVFAIL", "REFUSED").StringsVar(&forwardRetryRcodes)
+	kingpin.Flag("forward-ede", "Attach Extended DNS Errors (RFC 8914) to SERVFAIL responses").Default("true").BoolVar(&forwardEDE)
+	kingpin.Flag("forward-udp-size", "EDNS0 UDP payload size advertised to forwarders").Default("1232").UintVar(&forwardUDPSize)
+	kingpin.Flag("forward-dial-timeout", "Timeout for connecting to forwarders").Default("2s").DurationVar(&forwardTimeouts.Dial)
+	kingpin.Flag("forward-read-timeout", "Timeout for receiving a response from forwarders").Default("2s").DurationVar(&forwardTimeouts.Read)
+	kingpin.Flag("forward-write-timeout", "Timeout for sending a query to forwarders").Default("2s").DurationVar(&forwardTimeouts.Write)
+	kingpin.Flag("forward-pool-size", "Number of TCP/TLS connections kept open to each forwarder").Default("2").IntVar(&forwardTimeouts.PoolSize)
+	kingpin.Flag("forward-ecs", "Add an EDNS Client Subnet option derived from the client address to forwarded requests").BoolVar(&forwardECS)
+	kingpin.Flag("forward-ecs-ipv4-prefix", "Source prefix length of client subnets added for IPv4 clients").Default("24").UintVar(&forwardECSIPv4Prefix)
+	kingpin.Flag("forward-ecs-ipv6-prefix", "Source prefix length of client subnets added for IPv6 clients").Default("56").UintVar(&forwardECSIPv6Prefix)
+	kingpin.Flag("forward-ecs-passthrough", "Forward EDNS Client Subnet options sent by clients. Stripped if disabled").Default("true").BoolVar(&forwardECSPassthrough)
+	kingpin.Flag("query-timeout", "Maximum time spent on resolving a single request").Default("10s").DurationVar(&queryTimeout)
+	kingpin.Flag("recurse", "Resolve requests not answered by other middlewares iteratively starting at the root servers").BoolVar(&recurse)
+	kingpin.Flag("root-hints", "Root hints file (named.root format) used for recursion").StringVar(&rootHints)
+	kingpin.Flag("dnssec", "Validate forwarded and recursed responses using DNSSEC").BoolVar(&validate)
+	kingpin.Flag("trust-anchor", "File containing DS or DNSKEY records used as DNSSEC trust anchors instead of the root key").StringVar(&trustAnchor)
+	kingpin.Flag("health-check-interval", "Interval for actively probing forwarders. Disabled if zero").DurationVar(&healthCheckInterval)
+	kingpin.Flag("health-check-max-fails", "Number of consecutive failures before a forwarder is marked as down").Default("3").IntVar(&healthCheckMaxFails)
+	kingpin.Flag("management-listen", "Address to serve the HTTP management API on").StringVar(&managementListen)
 }
 
 func main() {
 	kingpin.Parse()
 
+	// the DNSSEC validator needs a resolver for DNSKEY and DS records
+	if validate && len(forwarders) == 0 && !recurse {
+		log.Fatal(fmt.Errorf("dnssec: requires --forwarder or --recurse to look up DNSKEY and DS records"))
+	}
+
 	srv := server.New()
 
 	listeners := 0
 
+	var tsigSecrets map[string]string
+	keys := make(map[string]zone.TsigKey)
+	for _, k := range tsigKeys {
+		key, err := zone.ParseTsigKey(k)
+		if err != nil {
+			log.Fatal(fmt.Errorf("tsig-key: %s", err))
+		}
+
+		if tsigSecrets == nil {
+			tsigSecrets = make(map[string]string)
+		}
+		tsigSecrets[key.Name] = key.Secret
+		keys[key.Name] = key
+	}
+
 	if listenAll {
 		listen = []string{"udp://:53", "tcp://:53"}
 	}
@@ -58,14 +182,16 @@ func main() {
 		switch u.Scheme {
 		case "tcp":
 			opt := server.Options{
-				Addr: u.Host,
+				Addr:        u.Host,
+				TsigSecrets: tsigSecrets,
 			}
 
 			srv.WithTCP(&opt)
 			listeners++
 		case "udp":
 			opt := server.Options{
-				Addr: u.Host,
+				Addr:        u.Host,
+				TsigSecrets: tsigSecrets,
 			}
 
 			srv.WithUDP(&opt)
@@ -78,7 +204,8 @@ func main() {
 	if listeners == 0 {
 		log.Println("No listener specified. Using --listen udp://127.0.0.1:5353")
 		srv.WithUDP(&server.Options{
-			Addr: "127.0.0.1:5353",
+			Addr:        "127.0.0.1:5353",
+			TsigSecrets: tsigSecrets,
 		})
 	}
 
@@ -106,19 +233,180 @@ func main() {
 	stack = append(stack, engine)
 
 	// Zone middleware
-	if zoneName != "" && zoneFile != "" {
-		z, err := zone.LoadZoneFile(zoneFile, zoneName)
+	var sources []zone.Source
+	var zoneErrs zone.Errors
+
+	for _, z := range zoneFiles {
+		src, err := zone.ParseSource(z, zoneName)
+		if err != nil {
+			zoneErrs = append(zoneErrs, err)
+			continue
+		}
+
+		sources = append(sources, src)
+	}
+
+	if zonesDir != "" {
+		dirSources, err := zone.DirSources(zonesDir)
+		if errs, ok := err.(zone.Errors); ok {
+			zoneErrs = append(zoneErrs, errs...)
+		} else if err != nil {
+			zoneErrs = append(zoneErrs, err)
+		}
+
+		sources = append(sources, dirSources...)
+	}
+
+	served, err := zone.LoadZones(sources...)
+	if errs, ok := err.(zone.Errors); ok {
+		zoneErrs = append(zoneErrs, errs...)
+	}
+
+	if len(zoneErrs) > 0 {
+		log.Fatal(fmt.Errorf("error loading zones:\n%s", zoneErrs))
+	}
+
+	var secondaryZones []zone.Secondary
+	for _, sec := range secondaries {
+		s, err := zone.ParseSecondary(sec)
 		if err != nil {
-			log.Fatal(fmt.Errorf("error paring zone file: %s", err))
+			log.Fatal(fmt.Errorf("secondary: %s", err))
+		}
+
+		if secondaryDir != "" {
+			s.File = filepath.Join(secondaryDir, strings.TrimSuffix(dns.Fqdn(s.Origin), ".")+".zone")
+		}
+
+		if secondaryKey != "" {
+			key, ok := keys[dns.Fqdn(secondaryKey)]
+			if !ok {
+				log.Fatal(fmt.Errorf("secondary-key: unknown TSIG key %q, add it using --tsig-key", secondaryKey))
+			}
+
+			s.Key = &key
+		}
+
+		secondaryZones = append(secondaryZones, s)
+	}
+
+	var provider *zone.Provider
+	if len(served) > 0 || len(secondaryZones) > 0 {
+		provider = zone.NewProvider(served...).WithSerialCheck(zoneSerialCheck)
+		stack = append(stack, provider)
+
+		if len(zoneTransferAllow) > 0 || len(zoneTransferKeys) > 0 {
+			var acl zone.TransferACL
+
+			for _, cidr := range zoneTransferAllow {
+				_, n, err := net.ParseCIDR(cidr)
+				if err != nil {
+					log.Fatal(fmt.Errorf("zone-transfer-allow: %s", err))
+				}
+
+				acl.Networks = append(acl.Networks, n)
+			}
+
+			for _, name := range zoneTransferKeys {
+				key, ok := keys[dns.Fqdn(name)]
+				if !ok {
+					log.Fatal(fmt.Errorf("zone-transfer-key: unknown TSIG key %q, add it using --tsig-key", name))
+				}
+
+				acl.Keys = append(acl.Keys, key)
+			}
+
+			provider.WithTransfers(acl)
+		}
+
+		for _, p := range zoneUpdatePolicies {
+			policy, err := zone.ParseUpdatePolicy(p)
+			if err != nil {
+				log.Fatal(fmt.Errorf("zone-update-policy: %s", err))
+			}
+
+			key, ok := keys[policy.Key]
+			if !ok {
+				log.Fatal(fmt.Errorf("zone-update-policy: unknown TSIG key %q, add it using --tsig-key", policy.Key))
+			}
+			policy.Algorithm = key.Algorithm
+
+			provider.WithUpdatePolicies(policy)
+		}
+
+		if len(zoneNotify.Secondaries) > 0 || zoneNotify.NotifyNS {
+			for i, addr := range zoneNotify.Secondaries {
+				if _, _, err := net.SplitHostPort(addr); err != nil {
+					zoneNotify.Secondaries[i] = net.JoinHostPort(addr, "53")
+				}
+			}
+
+			if zoneNotifyKey != "" {
+				key, ok := keys[dns.Fqdn(zoneNotifyKey)]
+				if !ok {
+					log.Fatal(fmt.Errorf("zone-notify-key: unknown TSIG key %q, add it using --tsig-key", zoneNotifyKey))
+				}
+
+				zoneNotify.Key = &key
+			}
+
+			provider.WithNotify(zoneNotify)
+		}
+
+		for _, s := range secondaryZones {
+			if err := provider.AddSecondary(s); err != nil {
+				log.Fatal(err)
+			}
 		}
 
-		stack = append(stack, zone.NewProvider(z))
+		if zoneReloadInterval > 0 {
+			provider.WatchEvery(zoneReloadInterval)
+		}
+
+		// reload all zones on SIGHUP
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+
+		go func() {
+			for range hup {
+				if err := provider.ReloadAll(); err != nil {
+					log.Printf("zone: failed to reload zones:\n%s\n", err)
+				}
+			}
+		}()
 	}
 
 	cacheMw := cache.New()
+	cacheMw.ServeStale = cacheServeStale
 	stack = append(stack, cacheMw)
 
-	conditionalForwarders := make(map[string]string)
+	// the DNSSEC validator is inserted here once the resolvers are set up
+	// so responses are validated before being cached
+	validatorIdx := len(stack)
+
+	if cacheFile != "" {
+		if err := cacheMw.LoadSnapshot(cacheFile); err != nil {
+			log.Printf("cache: failed to restore snapshot from %s: %s\n", cacheFile, err)
+		}
+
+		if cacheSnapshotInterval > 0 {
+			cacheMw.SnapshotEvery(cacheFile, cacheSnapshotInterval)
+		}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+		go func() {
+			<-signals
+
+			if err := cacheMw.SaveSnapshot(cacheFile); err != nil {
+				log.Printf("cache: failed to save snapshot to %s: %s\n", cacheFile, err)
+			}
+
+			os.Exit(0)
+		}()
+	}
+
+	var conditionalForwarders []forwarder.Conditional
 
 	for _, fi := range forwardIf {
 		parts := strings.Split(fi, "=")
@@ -126,22 +414,154 @@ func main() {
 			log.Fatal(fmt.Errorf("forward-if: %q has invalid format", fi))
 		}
 
-		host := parts[0]
+		hosts := strings.Split(parts[0], ",")
 		condition := strings.Join(parts[1:], "=")
 
-		conditionalForwarders[host] = condition
+		cond, err := forwarder.NewConditional(condition, hosts...)
+		if err != nil {
+			log.Fatal(fmt.Errorf("forward-if: %q: %s", fi, err))
+		}
+
+		conditionalForwarders = append(conditionalForwarders, cond)
+	}
+
+	zones := forwarder.NewZoneTable()
+
+	for _, file := range forwardZones {
+		if err := zones.ReadZoneTable(file, false); err != nil {
+			log.Fatal(fmt.Errorf("forward-zones: %s", err))
+		}
+	}
+
+	for _, file := range forwardResolvConf {
+		if err := zones.ReadZoneTable(file, true); err != nil {
+			log.Fatal(fmt.Errorf("forward-resolv-conf: %s", err))
+		}
 	}
 
 	// Forwarder middleware
-	if len(forwarders) > 0 || len(conditionalForwarders) > 0 {
-		resolver, err := forwarder.New(forwarders, conditionalForwarders)
+	var resolver *forwarder.Forwarder
+	delegations := provider != nil && zoneResolveDelegations
+	if len(forwarders) > 0 || len(conditionalForwarders) > 0 || zones.Len() > 0 || delegations {
+		resolver, err = forwarder.New(forwarders, conditionalForwarders)
 		if err != nil {
 			log.Fatal(fmt.Errorf("forwarder: invalid configuration: %s", err))
 		}
+
+		hc := forwarder.DefaultHealthCheck
+		hc.Interval = healthCheckInterval
+		hc.MaxFails = healthCheckMaxFails
+		resolver.WithHealthCheck(hc)
+
+		strategy, err := forwarder.ParseStrategy(forwardStrategy)
+		if err != nil {
+			log.Fatal(fmt.Errorf("forwarder: %s", err))
+		}
+		resolver.WithStrategy(strategy).WithRaceCount(raceCount)
+
+		policy := forwarder.FailurePolicy{
+			Fallback:       forwardFallback,
+			Next:           forwardFallthrough,
+			ExtendedErrors: forwardEDE,
+		}
+
+		for _, r := range forwardRetryRcodes {
+			rcode, ok := dns.StringToRcode[strings.ToUpper(r)]
+			if !ok {
+				log.Fatal(fmt.Errorf("forward-retry-rcode: unknown response code %q", r))
+			}
+
+			policy.RetryRcodes = append(policy.RetryRcodes, rcode)
+		}
+		resolver.WithFailurePolicy(policy)
+
+		if forwardUDPSize < dns.MinMsgSize || forwardUDPSize > dns.MaxMsgSize {
+			log.Fatal(fmt.Errorf("forward-udp-size: must be between %d and %d", dns.MinMsgSize, dns.MaxMsgSize))
+		}
+		resolver.WithUDPSize(uint16(forwardUDPSize))
+
+		if forwardECSIPv4Prefix > 32 || forwardECSIPv6Prefix > 128 {
+			log.Fatal(fmt.Errorf("forward-ecs: invalid source prefix length"))
+		}
+		resolver.WithClientSubnet(forwarder.ClientSubnet{
+			Insert:      forwardECS,
+			IPv4Prefix:  uint8(forwardECSIPv4Prefix),
+			IPv6Prefix:  uint8(forwardECSIPv6Prefix),
+			Passthrough: forwardECSPassthrough,
+		})
+
+		if _, err := resolver.WithTimeouts(forwardTimeouts); err != nil {
+			log.Fatal(fmt.Errorf("forwarder: invalid configuration: %s", err))
+		}
+
+		if _, err := resolver.WithZones(zones); err != nil {
+			log.Fatal(fmt.Errorf("forwarder: invalid configuration: %s", err))
+		}
+
 		stack = append(stack, resolver)
+
+		if delegations {
+			provider.WithDelegations(resolver)
+		}
+	}
+
+	// Recursor middleware
+	var rec *recursor.Recursor
+	if recurse {
+		var hints []string
+		if rootHints != "" {
+			hints, err = recursor.ReadRootHints(rootHints, "53")
+			if err != nil {
+				log.Fatal(fmt.Errorf("root-hints: %s", err))
+			}
+		}
+
+		rec = recursor.New(hints...).WithDNSSEC(validate)
+		stack = append(stack, rec)
+	}
+
+	// DNSSEC validator middleware
+	if validate {
+		var anchors []dns.RR
+		if trustAnchor != "" {
+			anchors, err = dnssec.ReadTrustAnchors(trustAnchor)
+			if err != nil {
+				log.Fatal(fmt.Errorf("trust-anchor: %s", err))
+			}
+		}
+
+		// DNSKEY and DS records are looked up using the static forwarders
+		// or iteratively in recursor-only mode. Conditional forwarders
+		// cannot resolve the chain of trust up to the root
+		var validator *dnssec.Validator
+		if len(forwarders) > 0 {
+			validator = dnssec.New(resolver, anchors...)
+		} else {
+			validator = dnssec.New(rec, anchors...)
+		}
+
+		stack = append(stack[:validatorIdx], append([]dnswall.Middleware{validator}, stack[validatorIdx:]...)...)
 	}
 
 	srv.Use(stack...)
+	srv.WithQueryTimeout(queryTimeout)
+
+	if managementListen != "" {
+		api := management.New(managementListen).
+			Handle("/cache/", management.CacheHandler(cacheMw))
+
+		if resolver != nil {
+			api.Handle("/forwarder/", management.ForwarderHandler(resolver))
+		}
+
+		if provider != nil {
+			api.Handle("/zones/", management.ZoneHandler(provider))
+		}
+
+		go func() {
+			log.Fatal(fmt.Errorf("management: %s", api.ListenAndServe()))
+		}()
+	}
 
 	if err := srv.ListenAndServe(); err != nil {
 		log.Fatal(err)
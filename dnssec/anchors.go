@@ -0,0 +1,63 @@
+package dnssec
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultTrustAnchors holds the DS record of the root zone key signing key
+// KSK-2017 (key tag 20326) published by IANA
+var DefaultTrustAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+}
+
+// ParseTrustAnchors parses DS and DNSKEY records in zone file format from r.
+// Other record types are rejected
+func ParseTrustAnchors(r io.Reader) ([]dns.RR, error) {
+	var anchors []dns.RR
+
+	for token := range dns.ParseZone(r, ".", "") {
+		if token.Error != nil {
+			return nil, token.Error
+		}
+
+		switch token.RR.(type) {
+		case *dns.DS, *dns.DNSKEY:
+			anchors = append(anchors, token.RR)
+		default:
+			return nil, fmt.Errorf("unsupported trust anchor type %s", dns.TypeToString[token.RR.Header().Rrtype])
+		}
+	}
+
+	return anchors, nil
+}
+
+// ReadTrustAnchors reads DS and DNSKEY records from the file f
+func ReadTrustAnchors(f string) ([]dns.RR, error) {
+	file, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ParseTrustAnchors(file)
+}
+
+// defaultAnchors returns the parsed DefaultTrustAnchors
+func defaultAnchors() []dns.RR {
+	var anchors []dns.RR
+
+	for _, s := range DefaultTrustAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			panic(fmt.Sprintf("invalid default trust anchor %q: %s", s, err))
+		}
+
+		anchors = append(anchors, rr)
+	}
+
+	return anchors
+}
@@ -0,0 +1,304 @@
+package dnssec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxChainTTL limits how long links of the chain of trust are cached
+const maxChainTTL = time.Hour
+
+// ErrNoSignature is returned if an RRset of a signed zone is not signed by
+// a trusted key
+var ErrNoSignature = errors.New("no valid signature")
+
+// link is the result of walking the chain of trust down to a name
+type link struct {
+	// zone is the closest enclosing zone of the name that is either signed
+	// or an insecure delegation
+	zone string
+
+	// keys holds the validated zone signing keys of zone if state is Secure
+	keys []*dns.DNSKEY
+
+	state   State
+	expires time.Time
+}
+
+// chain walks the chain of trust from the closest trust anchor down to name
+// and returns the closest enclosing zone of name. Names that are not below
+// a trust anchor are insecure
+func (v *Validator) chain(ctx context.Context, name string) (link, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	anchor, ok := v.anchorFor(name)
+	if !ok {
+		return link{zone: ".", state: Insecure}, nil
+	}
+
+	cur, ok := v.lookup(anchor)
+	if !ok {
+		keys, ttl, err := v.verifyKeys(ctx, anchor, v.anchors[anchor])
+		if err != nil {
+			return link{state: Bogus}, fmt.Errorf("trust anchor %q: %s", anchor, err)
+		}
+
+		cur = v.store(anchor, link{zone: anchor, keys: keys, state: Secure}, ttl)
+	}
+
+	for i := dns.CountLabel(anchor) + 1; i <= dns.CountLabel(name); i++ {
+		child := ancestor(name, i)
+
+		next, ok := v.lookup(child)
+		if !ok {
+			var ttl uint32
+			var err error
+
+			next, ttl, err = v.descend(ctx, cur, child)
+			if err != nil {
+				return link{state: Bogus}, err
+			}
+
+			next = v.store(child, next, ttl)
+		}
+
+		cur = next
+
+		if cur.state == Insecure {
+			break
+		}
+	}
+
+	return cur, nil
+}
+
+// descend determines whether child is a signed zone, an insecure delegation
+// or part of the zone of cur by looking up its DS records
+func (v *Validator) descend(ctx context.Context, cur link, child string) (link, uint32, error) {
+	resp, err := v.resolver.Resolve(ctx, child, dns.TypeDS)
+	if err != nil {
+		return link{}, 0, fmt.Errorf("failed to look up DS records for %q: %s", child, err)
+	}
+
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return link{}, 0, fmt.Errorf("failed to look up DS records for %q: %s", child, dns.RcodeToString[resp.Rcode])
+	}
+
+	if ds, sigs := rrset(resp.Answer, child, dns.TypeDS); len(ds) > 0 {
+		if err := verify(ds, sigs, cur.keys); err != nil {
+			return link{}, 0, fmt.Errorf("DS records of %q: %s", child, err)
+		}
+
+		keys, ttl, err := v.verifyKeys(ctx, child, ds)
+		if err != nil {
+			return link{}, 0, fmt.Errorf("%q: %s", child, err)
+		}
+
+		return link{zone: child, keys: keys, state: Secure}, minTTL(ttl, ds), nil
+	}
+
+	if cname, sigs := rrset(resp.Answer, child, dns.TypeCNAME); len(cname) > 0 {
+		// aliases cannot be zone cuts
+		if err := verify(cname, sigs, cur.keys); err != nil {
+			return link{}, 0, fmt.Errorf("CNAME of %q: %s", child, err)
+		}
+
+		return cur, minTTL(0, cname), nil
+	}
+
+	d, records := denialFor(resp.Ns, cur)
+
+	if resp.Rcode == dns.RcodeNameError {
+		proven, optOut := d.nxDomain(child)
+		if !proven {
+			return link{}, 0, fmt.Errorf("non-existence of %q not proven", child)
+		}
+
+		// child may be an unsigned delegation skipped by the opt-out span
+		if optOut {
+			return link{zone: child, state: Insecure}, minTTL(0, records), nil
+		}
+
+		return cur, minTTL(0, records), nil
+	}
+
+	insecure, notCut := d.insecureDelegation(child)
+	switch {
+	case insecure:
+		return link{zone: child, state: Insecure}, minTTL(0, records), nil
+	case notCut:
+		return cur, minTTL(0, records), nil
+	}
+
+	return link{}, 0, fmt.Errorf("missing DS records of %q not proven", child)
+}
+
+// verifyKeys fetches the DNSKEY records of zone and verifies that the key set
+// is signed by a key matching one of the trusted DS or DNSKEY records. The
+// zone keys and the TTL of the key set are returned
+func (v *Validator) verifyKeys(ctx context.Context, zone string, trusted []dns.RR) ([]*dns.DNSKEY, uint32, error) {
+	resp, err := v.resolver.Resolve(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to look up DNSKEY records: %s", err)
+	}
+
+	set, sigs := rrset(resp.Answer, zone, dns.TypeDNSKEY)
+	if len(set) == 0 {
+		return nil, 0, errors.New("no DNSKEY records found")
+	}
+
+	var keys, entry []*dns.DNSKEY
+	for _, rr := range set {
+		key := rr.(*dns.DNSKEY)
+
+		if key.Flags&dns.ZONE != 0 {
+			keys = append(keys, key)
+		}
+
+		if isTrusted(key, trusted) {
+			entry = append(entry, key)
+		}
+	}
+
+	if len(entry) == 0 {
+		return nil, 0, errors.New("no DNSKEY matches the trusted keys")
+	}
+
+	if err := verify(set, sigs, entry); err != nil {
+		return nil, 0, fmt.Errorf("DNSKEY records: %s", err)
+	}
+
+	return keys, minTTL(0, set), nil
+}
+
+// anchorFor returns the closest trust anchor of name
+func (v *Validator) anchorFor(name string) (string, bool) {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if _, ok := v.anchors[name[off:]]; ok {
+			return name[off:], true
+		}
+	}
+
+	if _, ok := v.anchors["."]; ok {
+		return ".", true
+	}
+
+	return "", false
+}
+
+// lookup returns the cached link of name
+func (v *Validator) lookup(name string) (link, bool) {
+	v.rw.RLock()
+	defer v.rw.RUnlock()
+
+	l, ok := v.links[name]
+	if !ok || time.Now().After(l.expires) {
+		return link{}, false
+	}
+
+	return l, true
+}
+
+// store caches the link of name for ttl seconds
+func (v *Validator) store(name string, l link, ttl uint32) link {
+	d := time.Duration(ttl) * time.Second
+	if d > maxChainTTL {
+		d = maxChainTTL
+	}
+
+	l.expires = time.Now().Add(d)
+
+	v.rw.Lock()
+	v.links[name] = l
+	v.rw.Unlock()
+
+	return l
+}
+
+// isTrusted returns true if key matches one of the trusted DS or DNSKEY
+// records
+func isTrusted(key *dns.DNSKEY, trusted []dns.RR) bool {
+	for _, rr := range trusted {
+		switch t := rr.(type) {
+		case *dns.DS:
+			ds := key.ToDS(t.DigestType)
+			if ds != nil && ds.KeyTag == t.KeyTag && ds.Algorithm == t.Algorithm && strings.EqualFold(ds.Digest, t.Digest) {
+				return true
+			}
+
+		case *dns.DNSKEY:
+			if key.Flags == t.Flags && key.Algorithm == t.Algorithm && key.PublicKey == t.PublicKey {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// verify checks that rrs is signed by one of keys using one of sigs
+func verify(rrs []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) error {
+	if len(sigs) == 0 {
+		return ErrNoSignature
+	}
+
+	now := time.Now()
+
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+
+			if err := sig.Verify(key, rrs); err == nil {
+				return nil
+			}
+		}
+	}
+
+	return ErrNoSignature
+}
+
+// denialFor returns the NSEC and NSEC3 records of rrs that are signed by the
+// keys of l together with all records used
+func denialFor(rrs []dns.RR, l link) (denial, []dns.RR) {
+	var d denial
+	var used []dns.RR
+
+	for _, set := range rrsets(rrs) {
+		t := set.rrs[0].Header().Rrtype
+		if t != dns.TypeNSEC && t != dns.TypeNSEC3 {
+			continue
+		}
+
+		if verify(set.rrs, set.sigs, l.keys) != nil {
+			continue
+		}
+
+		used = append(used, set.rrs...)
+		d.add(set.rrs)
+	}
+
+	return d, used
+}
+
+// minTTL returns the smallest TTL of rrs. If ttl is not zero, it is
+// considered as well
+func minTTL(ttl uint32, rrs []dns.RR) uint32 {
+	for _, rr := range rrs {
+		if ttl == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+
+	return ttl
+}
@@ -0,0 +1,305 @@
+package dnssec
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// denial holds the validated NSEC and NSEC3 records of a response
+type denial struct {
+	nsec  []*dns.NSEC
+	nsec3 []*dns.NSEC3
+}
+
+// add adds the NSEC and NSEC3 records of rrs
+func (d *denial) add(rrs []dns.RR) {
+	for _, rr := range rrs {
+		switch n := rr.(type) {
+		case *dns.NSEC:
+			d.nsec = append(d.nsec, n)
+		case *dns.NSEC3:
+			d.nsec3 = append(d.nsec3, n)
+		}
+	}
+}
+
+// noData returns true if the records prove that name exists but has no
+// records of type qtype
+func (d denial) noData(name string, qtype uint16) bool {
+	for _, n := range d.nsec {
+		if equal(n.Hdr.Name, name) {
+			return lacks(n.TypeBitMap, qtype)
+		}
+	}
+
+	for _, n := range d.nsec3 {
+		if n.Match(name) {
+			return lacks(n.TypeBitMap, qtype)
+		}
+	}
+
+	// NODATA responses for names synthesized from a wildcard (RFC 4035
+	// section 3.1.3.4)
+	if ce, ok := d.closestEncloser(name); ok {
+		wildcard := wildcardOf(ce)
+
+		for _, n := range d.nsec {
+			if equal(n.Hdr.Name, wildcard) && lacks(n.TypeBitMap, qtype) {
+				return true
+			}
+		}
+
+		for _, n := range d.nsec3 {
+			if n.Match(wildcard) && lacks(n.TypeBitMap, qtype) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// nxDomain returns true if the records prove that neither name nor a wildcard
+// that could have been expanded to name exists. The second return value is
+// true if the proof relies on an NSEC3 opt-out span, which only proves that
+// no signed name exists (RFC 5155 section 9.2)
+func (d denial) nxDomain(name string) (bool, bool) {
+	ce, ok := d.closestEncloser(name)
+	if !ok {
+		return false, false
+	}
+
+	if d.optOut(name, ce) {
+		return true, true
+	}
+
+	return d.covers(wildcardOf(ce)), false
+}
+
+// wildcard returns true if the records prove that the answer for name has
+// been legitimately expanded from the wildcard below the closest encloser ce
+// by proving that no closer match for name exists (RFC 4035 section 5.3.4).
+// With NSEC3, only the next closer name is covered (RFC 5155 section 8.8)
+func (d denial) wildcard(name, ce string) bool {
+	for _, n := range d.nsec {
+		if !covers(n, name) {
+			continue
+		}
+
+		// the covering record must not prove a closer encloser
+		closest := commonAncestor(name, n.Hdr.Name)
+		if next := commonAncestor(name, n.NextDomain); dns.CountLabel(next) > dns.CountLabel(closest) {
+			closest = next
+		}
+
+		if equal(closest, ce) {
+			return true
+		}
+	}
+
+	return d.nsec3Covers(ancestor(name, dns.CountLabel(ce)+1))
+}
+
+// closestEncloser returns the closest existing ancestor of name if the
+// records prove that name itself does not exist
+func (d denial) closestEncloser(name string) (string, bool) {
+	for _, n := range d.nsec {
+		if !covers(n, name) {
+			continue
+		}
+
+		// the closest encloser is the longest common ancestor of name and
+		// the owner or next name of the covering NSEC record
+		ce := commonAncestor(name, n.Hdr.Name)
+		if next := commonAncestor(name, n.NextDomain); dns.CountLabel(next) > dns.CountLabel(ce) {
+			ce = next
+		}
+
+		return ce, true
+	}
+
+	if len(d.nsec3) == 0 {
+		return "", false
+	}
+
+	// closest encloser proof (RFC 5155 section 8.3)
+	labels := dns.CountLabel(name)
+
+	for i := labels - 1; i >= 0; i-- {
+		ce := ancestor(name, i)
+
+		if !d.nsec3Matches(ce) {
+			continue
+		}
+
+		if d.nsec3Covers(ancestor(name, i+1)) {
+			return ce, true
+		}
+
+		return "", false
+	}
+
+	return "", false
+}
+
+// optOut returns true if the NSEC3 record covering the next closer name of
+// name has the opt-out flag set
+func (d denial) optOut(name, ce string) bool {
+	next := ancestor(name, dns.CountLabel(ce)+1)
+
+	for _, n := range d.nsec3 {
+		if n.Flags&1 == 1 && n.Cover(next) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// insecureDelegation returns true if the records prove that name is a
+// delegation without DS records. The second return value is true if name
+// is not a delegation at all
+func (d denial) insecureDelegation(name string) (bool, bool) {
+	for _, n := range d.nsec {
+		if equal(n.Hdr.Name, name) {
+			cut := hasType(n.TypeBitMap, dns.TypeNS) && !hasType(n.TypeBitMap, dns.TypeSOA)
+			return cut && !hasType(n.TypeBitMap, dns.TypeDS), !cut && !hasType(n.TypeBitMap, dns.TypeDS)
+		}
+
+		// empty non-terminals do not have NSEC records but sort before
+		// their descendants
+		if covers(n, name) && dns.IsSubDomain(name, n.NextDomain) {
+			return false, true
+		}
+	}
+
+	for _, n := range d.nsec3 {
+		if n.Match(name) {
+			cut := hasType(n.TypeBitMap, dns.TypeNS) && !hasType(n.TypeBitMap, dns.TypeSOA)
+			return cut && !hasType(n.TypeBitMap, dns.TypeDS), !cut && !hasType(n.TypeBitMap, dns.TypeDS)
+		}
+	}
+
+	// unsigned delegations may be skipped by NSEC3 opt-out (RFC 5155
+	// section 6)
+	if ce, ok := d.closestEncloser(name); ok && d.optOut(name, ce) {
+		return true, false
+	}
+
+	return false, false
+}
+
+// covers returns true if name is covered by one of the records
+func (d denial) covers(name string) bool {
+	for _, n := range d.nsec {
+		if covers(n, name) {
+			return true
+		}
+	}
+
+	return d.nsec3Covers(name)
+}
+
+func (d denial) nsec3Matches(name string) bool {
+	for _, n := range d.nsec3 {
+		if n.Match(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (d denial) nsec3Covers(name string) bool {
+	for _, n := range d.nsec3 {
+		if n.Cover(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// covers returns true if name sorts between the owner and the next name of
+// the NSEC record n
+func covers(n *dns.NSEC, name string) bool {
+	owner, next := n.Hdr.Name, n.NextDomain
+
+	if compare(owner, next) < 0 {
+		return compare(owner, name) < 0 && compare(name, next) < 0
+	}
+
+	// the last NSEC record of the zone points back to the apex
+	return compare(owner, name) < 0 && dns.IsSubDomain(next, name)
+}
+
+// compare compares a and b using the canonical DNS name order (RFC 4034
+// section 6.1)
+func compare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+
+	return len(la) - len(lb)
+}
+
+// commonAncestor returns the longest common ancestor of a and b
+func commonAncestor(a, b string) string {
+	return ancestor(a, dns.CompareDomainName(a, b))
+}
+
+// ancestor returns the last n labels of name
+func ancestor(name string, n int) string {
+	idx := dns.Split(name)
+	if n <= 0 || len(idx) == 0 {
+		return "."
+	}
+
+	if n >= len(idx) {
+		return dns.Fqdn(name)
+	}
+
+	return dns.Fqdn(name[idx[len(idx)-n]:])
+}
+
+// lacks returns true if the type bitmap of an NSEC or NSEC3 record proves
+// that there are no records of type qtype. The parent side of a delegation
+// only proves the absence of DS records
+func lacks(bitmap []uint16, qtype uint16) bool {
+	if hasType(bitmap, qtype) || hasType(bitmap, dns.TypeCNAME) {
+		return false
+	}
+
+	delegation := hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA)
+
+	return !delegation || qtype == dns.TypeDS
+}
+
+// wildcardOf returns the wildcard name below ce
+func wildcardOf(ce string) string {
+	if ce == "." {
+		return "*."
+	}
+
+	return "*." + ce
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+func equal(a, b string) bool {
+	return strings.EqualFold(dns.Fqdn(a), dns.Fqdn(b))
+}
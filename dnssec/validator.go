@@ -0,0 +1,439 @@
+package dnssec
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/homebot/dnswall"
+	"github.com/homebot/dnswall/request"
+	"github.com/miekg/dns"
+)
+
+// EDEBogus is the Extended DNS Error (RFC 8914) info-code used for
+// responses that failed validation
+const EDEBogus = 6
+
+// State is the DNSSEC validation state of a response (RFC 4035 section 4.3)
+type State int
+
+// Validation states
+const (
+	// Indeterminate is used for responses that have not been validated,
+	// e.g. because of an error response code
+	Indeterminate State = iota
+
+	// Insecure responses belong to zones without a chain of trust
+	Insecure
+
+	// Secure responses have been validated from a trust anchor
+	Secure
+
+	// Bogus responses should be signed but validation failed
+	Bogus
+)
+
+// String returns the name of the validation state
+func (s State) String() string {
+	switch s {
+	case Insecure:
+		return "insecure"
+	case Secure:
+		return "secure"
+	case Bogus:
+		return "bogus"
+	}
+
+	return "indeterminate"
+}
+
+// Resolver resolves the DNSKEY and DS records required to build the chain
+// of trust. Responses must include RRSIG and NSEC/NSEC3 records
+type Resolver interface {
+	Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+}
+
+// Validator is a DNS server middleware that validates responses of the
+// following middlewares using DNSSEC. Secure responses get the AD bit set
+// while bogus responses are answered with SERVFAIL
+type Validator struct {
+	resolver Resolver
+	anchors  map[string][]dns.RR
+
+	rw    sync.RWMutex
+	links map[string]link
+}
+
+// New returns a new validating middleware that uses resolver to build the
+// chain of trust from the given trust anchors (DS or DNSKEY records). If no
+// trust anchors are given, DefaultTrustAnchors is used
+func New(resolver Resolver, anchors ...dns.RR) *Validator {
+	if len(anchors) == 0 {
+		anchors = defaultAnchors()
+	}
+
+	v := &Validator{
+		resolver: resolver,
+		anchors:  make(map[string][]dns.RR),
+		links:    make(map[string]link),
+	}
+
+	for _, rr := range anchors {
+		zone := strings.ToLower(dns.Fqdn(rr.Header().Name))
+		v.anchors[zone] = append(v.anchors[zone], rr)
+	}
+
+	return v
+}
+
+// Name returns "dnssec" and implements dnswall.Middleware
+func (v *Validator) Name() string {
+	return "dnssec"
+}
+
+// Serve requests DNSSEC records from the following middlewares and validates
+// their response. It implements dnswall.Middleware
+func (v *Validator) Serve(session *dnswall.Session, req *request.Request) error {
+	opt := req.Req.IsEdns0()
+	do := opt != nil && opt.Do()
+
+	// the payload size the client can handle over UDP
+	size := dns.MinMsgSize
+	if opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+
+	// ask the following middlewares for DNSSEC records and restore the
+	// request of the client afterwards. Responses must not be truncated
+	// to the size of the client before the DNSSEC records are stripped,
+	// so the largest payload size is requested
+	if opt == nil {
+		req.Req.SetEdns0(dns.MaxMsgSize, true)
+	} else {
+		opt.SetDo()
+		opt.SetUDPSize(dns.MaxMsgSize)
+	}
+
+	err := session.Next()
+
+	if opt == nil {
+		req.Req.Extra = withoutOPT(req.Req.Extra)
+	} else {
+		opt.SetDo(do)
+		opt.SetUDPSize(uint16(size))
+	}
+
+	res := session.Response()
+	if res == nil {
+		return err
+	}
+
+	state, verr := v.Validate(session.Ctx, res)
+
+	res.AuthenticatedData = state == Secure
+
+	if state == Bogus {
+		log.Printf("[dnssec] response for %q (%s) is bogus: %s\n", req.Name(), req.Type(), verr)
+
+		// clients that disabled checking handle bogus data themselves
+		if !req.Req.CheckingDisabled {
+			res.Rcode = dns.RcodeServerFailure
+			res.Answer = nil
+			res.Ns = nil
+			res.Extra = nil
+
+			if opt != nil {
+				res.SetEdns0(opt.UDPSize(), do)
+				res.IsEdns0().Option = append(res.IsEdns0().Option, request.ExtendedError(EDEBogus, verr.Error()))
+			}
+		}
+	} else if verr != nil {
+		log.Printf("[dnssec] failed to validate response for %q (%s): %s\n", req.Name(), req.Type(), verr)
+	}
+
+	if opt == nil {
+		res.Extra = withoutOPT(res.Extra)
+	} else if o := res.IsEdns0(); o != nil {
+		o.SetDo(do)
+	}
+
+	if !do {
+		stripDNSSEC(res, uint16(req.Type()))
+	}
+
+	if _, ok := session.RemoteAddr().(*net.UDPAddr); ok {
+		request.Truncate(res, size)
+	}
+
+	return err
+}
+
+// Validate validates msg and returns its validation state. For Bogus
+// responses, the returned error describes why validation failed
+func (v *Validator) Validate(ctx context.Context, msg *dns.Msg) (State, error) {
+	if len(msg.Question) == 0 || msg.Truncated {
+		return Indeterminate, nil
+	}
+
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return Indeterminate, nil
+	}
+
+	q := msg.Question[0]
+
+	state, wildcards, err := v.verifySection(ctx, msg.Answer)
+	if state == Bogus {
+		return state, err
+	}
+
+	var authority []dns.RR
+	for _, rr := range msg.Ns {
+		switch rr.Header().Rrtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeRRSIG:
+			authority = append(authority, rr)
+		}
+	}
+
+	authState, _, err := v.verifySection(ctx, authority)
+	if authState == Bogus {
+		return authState, err
+	}
+
+	var d denial
+	for _, rr := range authority {
+		d.add([]dns.RR{rr})
+	}
+
+	for _, w := range wildcards {
+		if state == Secure && (authState != Secure || !d.wildcard(w.name, w.encloser)) {
+			return Bogus, fmt.Errorf("wildcard expansion for %q not proven", w.name)
+		}
+	}
+
+	target := follow(msg.Answer, q.Name)
+
+	if q.Qtype == dns.TypeCNAME || q.Qtype == dns.TypeANY || hasRRset(msg.Answer, target, q.Qtype) {
+		return state, nil
+	}
+
+	// negative answer for the last name of the CNAME chain
+	if authState == Secure && state != Insecure {
+		if msg.Rcode == dns.RcodeNameError {
+			if proven, optOut := d.nxDomain(target); proven {
+				// an opt-out span only proves that no signed name exists
+				if optOut {
+					return Insecure, nil
+				}
+
+				return Secure, nil
+			}
+		}
+
+		if msg.Rcode == dns.RcodeSuccess && d.noData(target, q.Qtype) {
+			return Secure, nil
+		}
+	}
+
+	l, err := v.chain(ctx, target)
+	if err != nil {
+		return Bogus, err
+	}
+
+	if l.state == Insecure {
+		return Insecure, nil
+	}
+
+	return Bogus, fmt.Errorf("non-existence of %q (%s) not proven", target, dns.TypeToString[q.Qtype])
+}
+
+// verifySection validates all RRsets of rrs. It returns Secure if all RRsets
+// have been validated and Insecure if at least one of them belongs to an
+// insecure zone. The RRsets synthesized from wildcards are returned as well
+func (v *Validator) verifySection(ctx context.Context, rrs []dns.RR) (State, []expansion, error) {
+	state := Secure
+	var wildcards []expansion
+
+	for _, set := range rrsets(rrs) {
+		owner := set.rrs[0].Header().Name
+		t := dns.TypeToString[set.rrs[0].Header().Rrtype]
+
+		if len(set.sigs) == 0 {
+			l, err := v.chain(ctx, owner)
+			if err != nil {
+				return Bogus, nil, err
+			}
+
+			if l.state != Insecure {
+				return Bogus, nil, fmt.Errorf("%s %s: %s", owner, t, ErrNoSignature)
+			}
+
+			state = Insecure
+			continue
+		}
+
+		signer := set.sigs[0].SignerName
+		if !dns.IsSubDomain(signer, owner) {
+			return Bogus, nil, fmt.Errorf("%s %s: signer %q out of zone", owner, t, signer)
+		}
+
+		l, err := v.chain(ctx, signer)
+		if err != nil {
+			return Bogus, nil, err
+		}
+
+		if l.state == Insecure {
+			state = Insecure
+			continue
+		}
+
+		if !equal(l.zone, signer) {
+			return Bogus, nil, fmt.Errorf("%s %s: signer %q is not a zone", owner, t, signer)
+		}
+
+		if err := verify(set.rrs, set.sigs, l.keys); err != nil {
+			return Bogus, nil, fmt.Errorf("%s %s: %s", owner, t, err)
+		}
+
+		// RRSIG labels do not include the wildcard label, the remaining
+		// labels name the closest encloser (RFC 4035 section 5.3.4)
+		if labels := int(set.sigs[0].Labels); labels < dns.CountLabel(owner) {
+			wildcards = append(wildcards, expansion{
+				name:     owner,
+				encloser: ancestor(owner, labels),
+			})
+		}
+	}
+
+	return state, wildcards, nil
+}
+
+// expansion is an RRset owned by name that has been synthesized from the
+// wildcard below the closest encloser
+type expansion struct {
+	name     string
+	encloser string
+}
+
+// rrSet is an RRset together with its signatures
+type rrSet struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// rrsets groups rrs into RRsets. OPT records are ignored
+func rrsets(rrs []dns.RR) []rrSet {
+	var sets []rrSet
+	index := make(map[string]int)
+
+	key := func(name string, t uint16) string {
+		return strings.ToLower(dns.Fqdn(name)) + "/" + dns.TypeToString[t]
+	}
+
+	for _, rr := range rrs {
+		t := rr.Header().Rrtype
+		if t == dns.TypeRRSIG || t == dns.TypeOPT {
+			continue
+		}
+
+		k := key(rr.Header().Name, t)
+		if _, ok := index[k]; !ok {
+			index[k] = len(sets)
+			sets = append(sets, rrSet{})
+		}
+
+		sets[index[k]].rrs = append(sets[index[k]].rrs, rr)
+	}
+
+	for _, rr := range rrs {
+		sig, ok := rr.(*dns.RRSIG)
+		if !ok {
+			continue
+		}
+
+		if idx, ok := index[key(sig.Hdr.Name, sig.TypeCovered)]; ok {
+			sets[idx].sigs = append(sets[idx].sigs, sig)
+		}
+	}
+
+	return sets
+}
+
+// rrset returns the records of type t owned by name and their signatures
+func rrset(rrs []dns.RR, name string, t uint16) ([]dns.RR, []*dns.RRSIG) {
+	for _, s := range rrsets(rrs) {
+		if equal(s.rrs[0].Header().Name, name) && s.rrs[0].Header().Rrtype == t {
+			return s.rrs, s.sigs
+		}
+	}
+
+	return nil, nil
+}
+
+// hasRRset returns true if rrs contains records of type t owned by name
+func hasRRset(rrs []dns.RR, name string, t uint16) bool {
+	set, _ := rrset(rrs, name, t)
+	return len(set) > 0
+}
+
+// follow follows the CNAME chain starting at name and returns its target
+func follow(rrs []dns.RR, name string) string {
+	for hops := 0; hops < len(rrs); hops++ {
+		next := ""
+
+		for _, rr := range rrs {
+			if cname, ok := rr.(*dns.CNAME); ok && equal(cname.Hdr.Name, name) {
+				next = cname.Target
+				break
+			}
+		}
+
+		if next == "" {
+			break
+		}
+
+		name = next
+	}
+
+	return name
+}
+
+// stripDNSSEC removes DNSSEC records that have not been requested by the
+// client (RFC 4035 section 3.2.1)
+func stripDNSSEC(msg *dns.Msg, qtype uint16) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		var result []dns.RR
+
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+
+			result = append(result, rr)
+		}
+
+		return result
+	}
+
+	msg.Answer = strip(msg.Answer)
+	msg.Ns = strip(msg.Ns)
+	msg.Extra = strip(msg.Extra)
+}
+
+// withoutOPT returns rrs without OPT records
+func withoutOPT(rrs []dns.RR) []dns.RR {
+	var result []dns.RR
+
+	for _, rr := range rrs {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			result = append(result, rr)
+		}
+	}
+
+	return result
+}
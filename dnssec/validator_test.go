@@ -0,0 +1,424 @@
+package dnssec
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/homebot/dnswall"
+	"github.com/homebot/dnswall/request"
+	"github.com/miekg/dns"
+)
+
+// zoneKey is a DNSKEY record together with its private key
+type zoneKey struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newKey(t *testing.T, zone string, flags uint16) zoneKey {
+	k := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: zone, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := k.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return zoneKey{key: k, priv: priv.(crypto.Signer)}
+}
+
+// sign returns the signature of rrs using k
+func sign(t *testing.T, k zoneKey, rrs ...dns.RR) *dns.RRSIG {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrs[0].Header().Ttl},
+		KeyTag:     k.key.KeyTag(),
+		SignerName: k.key.Hdr.Name,
+		Algorithm:  k.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+
+	if err := sig.Sign(k.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+
+	return sig
+}
+
+// signWildcard returns the signature of rrs as if they had been expanded
+// from the wildcard owner
+func signWildcard(t *testing.T, k zoneKey, wildcard string, rrs ...dns.RR) *dns.RRSIG {
+	var source []dns.RR
+	for _, rr := range rrs {
+		c := dns.Copy(rr)
+		c.Header().Name = wildcard
+		source = append(source, c)
+	}
+
+	sig := sign(t, k, source...)
+	sig.Hdr.Name = rrs[0].Header().Name
+
+	return sig
+}
+
+func newRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rr
+}
+
+// nsec3 returns an NSEC3 record of zone. If covered is empty, the record
+// matches name, otherwise it covers covered
+func nsec3(zone, name, covered string, optOut bool, types ...uint16) *dns.NSEC3 {
+	owner := dns.HashName(name, dns.SHA1, 0, "")
+	next := nextHash(owner, 1)
+
+	if covered != "" {
+		h := dns.HashName(covered, dns.SHA1, 0, "")
+		owner, next = nextHash(h, -1), nextHash(h, 1)
+	}
+
+	n := &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: owner + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+		Hash:       dns.SHA1,
+		HashLength: 20,
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+
+	if optOut {
+		n.Flags = 1
+	}
+
+	return n
+}
+
+// nextHash adds delta to the base32hex encoded hash h
+func nextHash(h string, delta int) string {
+	const alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUV"
+
+	b := []byte(h)
+	for i := len(b) - 1; i >= 0; i-- {
+		v := strings.IndexByte(alphabet, b[i]) + delta
+		carry := v < 0 || v >= len(alphabet)
+
+		b[i] = alphabet[(v+len(alphabet))%len(alphabet)]
+		if !carry {
+			break
+		}
+	}
+
+	return string(b)
+}
+
+// stubResolver answers DNSKEY and DS lookups from a map keyed by name and
+// type
+type stubResolver map[string]*dns.Msg
+
+func (s stubResolver) Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m, ok := s[strings.ToLower(dns.Fqdn(name))+"/"+dns.TypeToString[qtype]]
+	if !ok {
+		return nil, fmt.Errorf("no records for %s %s", name, dns.TypeToString[qtype])
+	}
+
+	return m.Copy(), nil
+}
+
+func newMsg(name string, qtype uint16, rcode int, answer, ns []dns.RR) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.Rcode = rcode
+	m.Answer = answer
+	m.Ns = ns
+
+	return m
+}
+
+// signedZones sets up a validator for the following zones below the trust
+// anchor example.:
+//
+//	sec.example.    signed zone
+//	insec.example.  insecure delegation
+//
+// It returns the validator and the key of sec.example.
+func signedZones(t *testing.T) (*Validator, zoneKey) {
+	ksk := newKey(t, "example.", dns.ZONE|dns.SEP)
+	zsk := newKey(t, "example.", dns.ZONE)
+	sub := newKey(t, "sec.example.", dns.ZONE|dns.SEP)
+
+	r := stubResolver{}
+	r["example./DNSKEY"] = newMsg("example.", dns.TypeDNSKEY, dns.RcodeSuccess, []dns.RR{ksk.key, zsk.key, sign(t, ksk, ksk.key, zsk.key)}, nil)
+
+	ds := sub.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+	r["sec.example./DS"] = newMsg("sec.example.", dns.TypeDS, dns.RcodeSuccess, []dns.RR{ds, sign(t, zsk, ds)}, nil)
+	r["sec.example./DNSKEY"] = newMsg("sec.example.", dns.TypeDNSKEY, dns.RcodeSuccess, []dns.RR{sub.key, sign(t, sub, sub.key)}, nil)
+
+	nsec := newRR(t, "insec.example. 3600 IN NSEC sec.example. NS RRSIG NSEC")
+	r["insec.example./DS"] = newMsg("insec.example.", dns.TypeDS, dns.RcodeSuccess, nil, []dns.RR{nsec, sign(t, zsk, nsec)})
+
+	// the trust anchor is the DS record of the key signing key
+	anchors, err := ParseTrustAnchors(strings.NewReader(ksk.key.ToDS(dns.SHA256).String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return New(r, anchors...), sub
+}
+
+func TestValidateAnswers(t *testing.T) {
+	v, key := signedZones(t)
+
+	a := newRR(t, "www.sec.example. 300 IN A 192.0.2.1")
+
+	tampered := dns.Copy(a).(*dns.A)
+	tampered.A = net.ParseIP("192.0.2.66")
+
+	insecure := newRR(t, "host.insec.example. 300 IN A 192.0.2.1")
+	outside := newRR(t, "www.other. 300 IN A 192.0.2.1")
+
+	cases := []struct {
+		name  string
+		msg   *dns.Msg
+		state State
+	}{
+		{"signed", newMsg("www.sec.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{a, sign(t, key, a)}, nil), Secure},
+		{"tampered", newMsg("www.sec.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{tampered, sign(t, key, a)}, nil), Bogus},
+		{"unsigned", newMsg("www.sec.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{a}, nil), Bogus},
+		{"insecure delegation", newMsg("host.insec.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{insecure}, nil), Insecure},
+		{"no trust anchor", newMsg("www.other.", dns.TypeA, dns.RcodeSuccess, []dns.RR{outside}, nil), Insecure},
+		{"server failure", newMsg("www.sec.example.", dns.TypeA, dns.RcodeServerFailure, nil, nil), Indeterminate},
+	}
+
+	for _, c := range cases {
+		if state, err := v.Validate(context.Background(), c.msg); state != c.state {
+			t.Errorf("%s: expected %s, got %s (%v)", c.name, c.state, state, err)
+		}
+	}
+}
+
+func TestValidateNSEC(t *testing.T) {
+	v, key := signedZones(t)
+
+	soa := newRR(t, "sec.example. 300 IN SOA ns.sec.example. admin.sec.example. 1 3600 600 86400 300")
+	apex := newRR(t, "sec.example. 300 IN NSEC www.sec.example. SOA NS RRSIG NSEC DNSKEY")
+	www := newRR(t, "www.sec.example. 300 IN NSEC sec.example. A RRSIG NSEC")
+
+	// the same zone with a wildcard
+	wildcard := newRR(t, "*.sec.example. 300 IN NSEC www.sec.example. A RRSIG NSEC")
+
+	signed := func(rrs ...dns.RR) []dns.RR {
+		var result []dns.RR
+		for _, rr := range rrs {
+			result = append(result, rr, sign(t, key, rr))
+		}
+
+		return result
+	}
+
+	expanded := newRR(t, "foo.sec.example. 300 IN A 192.0.2.1")
+	expandedSig := signWildcard(t, key, "*.sec.example.", expanded)
+
+	cases := []struct {
+		name  string
+		msg   *dns.Msg
+		state State
+	}{
+		{"nxdomain", newMsg("zzz.sec.example.", dns.TypeA, dns.RcodeNameError, nil, signed(soa, www, apex)), Secure},
+		{"nxdomain without proof", newMsg("zzz.sec.example.", dns.TypeA, dns.RcodeNameError, nil, signed(soa)), Bogus},
+		{"nodata", newMsg("www.sec.example.", dns.TypeAAAA, dns.RcodeSuccess, nil, signed(soa, www)), Secure},
+		{"nodata for existing type", newMsg("www.sec.example.", dns.TypeA, dns.RcodeSuccess, nil, signed(soa, www)), Bogus},
+		{"wildcard", newMsg("foo.sec.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{expanded, expandedSig}, signed(wildcard)), Secure},
+		{"wildcard without proof", newMsg("foo.sec.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{expanded, expandedSig}, nil), Bogus},
+	}
+
+	for _, c := range cases {
+		if state, err := v.Validate(context.Background(), c.msg); state != c.state {
+			t.Errorf("%s: expected %s, got %s (%v)", c.name, c.state, state, err)
+		}
+	}
+}
+
+func TestValidateNSEC3(t *testing.T) {
+	v, key := signedZones(t)
+
+	signed := func(rrs ...dns.RR) []dns.RR {
+		var result []dns.RR
+		for _, rr := range rrs {
+			result = append(result, rr, sign(t, key, rr))
+		}
+
+		return result
+	}
+
+	soa := newRR(t, "sec.example. 300 IN SOA ns.sec.example. admin.sec.example. 1 3600 600 86400 300")
+	apex := nsec3("sec.example.", "sec.example.", "", false, dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM)
+
+	// answers expanded from *.sec.example. only need to prove that the
+	// next closer name does not exist (RFC 5155 section 7.2.6)
+	expanded := newRR(t, "a.b.sec.example. 300 IN A 192.0.2.1")
+	expandedSig := signWildcard(t, key, "*.sec.example.", expanded)
+	nextCloser := nsec3("sec.example.", "", "b.sec.example.", false)
+	qname := nsec3("sec.example.", "", "a.b.sec.example.", false)
+
+	nxName := nsec3("sec.example.", "", "zzz.sec.example.", false)
+	nxWildcard := nsec3("sec.example.", "", "*.sec.example.", false)
+	nxOptOut := nsec3("sec.example.", "", "zzz.sec.example.", true)
+
+	cases := []struct {
+		name  string
+		msg   *dns.Msg
+		state State
+	}{
+		{"wildcard", newMsg("a.b.sec.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{expanded, expandedSig}, signed(nextCloser)), Secure},
+		{"wildcard with qname covered", newMsg("a.b.sec.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{expanded, expandedSig}, signed(qname)), Bogus},
+		{"nxdomain", newMsg("zzz.sec.example.", dns.TypeA, dns.RcodeNameError, nil, signed(soa, apex, nxName, nxWildcard)), Secure},
+		{"nxdomain without wildcard proof", newMsg("zzz.sec.example.", dns.TypeA, dns.RcodeNameError, nil, signed(soa, apex, nxName)), Bogus},
+		{"nxdomain opt-out", newMsg("zzz.sec.example.", dns.TypeA, dns.RcodeNameError, nil, signed(soa, apex, nxOptOut)), Insecure},
+	}
+
+	for _, c := range cases {
+		if state, err := v.Validate(context.Background(), c.msg); state != c.state {
+			t.Errorf("%s: expected %s, got %s (%v)", c.name, c.state, state, err)
+		}
+	}
+}
+
+// responseWriter records the response written to a UDP client
+type responseWriter struct {
+	msg *dns.Msg
+}
+
+func (w *responseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *responseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+func (w *responseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *responseWriter) Write(buf []byte) (int, error) { return len(buf), nil }
+func (w *responseWriter) Close() error                  { return nil }
+func (w *responseWriter) TsigStatus() error             { return nil }
+func (w *responseWriter) TsigTimersOnly(bool)           {}
+func (w *responseWriter) Hijack()                       {}
+
+// upstream is a middleware that answers with msg and truncates it to the
+// payload size of the request like a forwarder does
+type upstream struct {
+	msg *dns.Msg
+}
+
+func (u upstream) Name() string { return "upstream" }
+
+func (u upstream) Serve(session *dnswall.Session, req *request.Request) error {
+	m := u.msg.Copy()
+	m.SetReply(req.Req)
+	m.Compress = true
+
+	size := dns.MinMsgSize
+	if opt := req.Req.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), opt.Do())
+		size = int(opt.UDPSize())
+	}
+
+	if m.Len() > size {
+		m.Answer = nil
+		m.Truncated = true
+	}
+
+	return session.ResolveWith(m)
+}
+
+func TestServeValidatesBeforeTruncating(t *testing.T) {
+	v, key := signedZones(t)
+
+	serve := func(records int) *dns.Msg {
+		var set []dns.RR
+		for i := 0; i < records; i++ {
+			set = append(set, newRR(t, fmt.Sprintf("www.sec.example. 300 IN A 192.0.2.%d", i+1)))
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.sec.example.", dns.TypeA)
+
+		w := &responseWriter{}
+		up := upstream{msg: newMsg("www.sec.example.", dns.TypeA, dns.RcodeSuccess, append(set, sign(t, key, set...)), nil)}
+
+		session := dnswall.NewSession([]dnswall.Middleware{v, up}, &request.Request{W: w, Req: req}, w)
+		if err := session.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if req.IsEdns0() != nil {
+			t.Error("the request of the client has not been restored")
+		}
+
+		return w.msg
+	}
+
+	// the signed response exceeds 512 bytes while the answer for a client
+	// without EDNS0 does not
+	resp := serve(25)
+	if resp.Truncated || !resp.AuthenticatedData || len(resp.Answer) != 25 {
+		t.Errorf("expected complete secure answer, got TC=%v AD=%v with %d records", resp.Truncated, resp.AuthenticatedData, len(resp.Answer))
+	}
+
+	if resp.IsEdns0() != nil {
+		t.Error("unexpected OPT record in the response to a client without EDNS0")
+	}
+
+	// answers that do not fit are truncated after validation
+	resp = serve(40)
+	if !resp.Truncated || resp.Len() > dns.MinMsgSize {
+		t.Errorf("expected response truncated to %d bytes, got TC=%v with %d bytes", dns.MinMsgSize, resp.Truncated, resp.Len())
+	}
+}
+
+func TestServeClearsAuthenticatedData(t *testing.T) {
+	v, _ := signedZones(t)
+
+	req := new(dns.Msg)
+	req.SetQuestion("host.insec.example.", dns.TypeA)
+
+	m := newMsg("host.insec.example.", dns.TypeA, dns.RcodeSuccess, []dns.RR{newRR(t, "host.insec.example. 300 IN A 192.0.2.1")}, nil)
+	m.AuthenticatedData = true
+
+	w := &responseWriter{}
+	session := dnswall.NewSession([]dnswall.Middleware{v, upstream{msg: m}}, &request.Request{W: w, Req: req}, w)
+	if err := session.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.msg.AuthenticatedData {
+		t.Error("expected AD bit to be cleared for insecure responses")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// canonical order from RFC 4034 section 6.1
+	names := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example."}
+
+	for i := 0; i < len(names)-1; i++ {
+		if compare(names[i], names[i+1]) >= 0 {
+			t.Errorf("expected %q to sort before %q", names[i], names[i+1])
+		}
+	}
+}
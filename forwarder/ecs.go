@@ -0,0 +1,143 @@
+package forwarder
+
+import (
+	"net"
+
+	"github.com/homebot/dnswall/request"
+	"github.com/miekg/dns"
+)
+
+// ClientSubnet configures the handling of EDNS Client Subnet (RFC 7871)
+// options
+type ClientSubnet struct {
+	// Insert adds a client subnet option derived from the address of the
+	// client to requests that do not carry one
+	Insert bool
+
+	// IPv4Prefix is the source prefix length used for IPv4 clients
+	IPv4Prefix uint8
+
+	// IPv6Prefix is the source prefix length used for IPv6 clients
+	IPv6Prefix uint8
+
+	// Passthrough forwards client subnet options sent by clients. If
+	// disabled, they are removed before forwarding the request
+	Passthrough bool
+}
+
+// DefaultClientSubnet is used by forwarders unless configured otherwise.
+// Client subnet options sent by clients are forwarded but none are added
+var DefaultClientSubnet = ClientSubnet{
+	IPv4Prefix:  24,
+	IPv6Prefix:  56,
+	Passthrough: true,
+}
+
+// WithClientSubnet configures how EDNS Client Subnet options are handled
+func (f *Forwarder) WithClientSubnet(c ClientSubnet) *Forwarder {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+
+	f.clientSubnet = c
+
+	return f
+}
+
+// prepareClientSubnet adds, keeps or removes the client subnet option of the
+// EDNS0 record of msg according to the configuration. msg must already
+// contain an OPT record
+func (f *Forwarder) prepareClientSubnet(req *request.Request, msg *dns.Msg) {
+	f.rw.RLock()
+	cfg := f.clientSubnet
+	f.rw.RUnlock()
+
+	opt := msg.IsEdns0()
+
+	if clientSubnet(opt) != nil {
+		if cfg.Passthrough {
+			return
+		}
+
+		var options []dns.EDNS0
+		for _, o := range opt.Option {
+			if o.Option() != dns.EDNS0SUBNET {
+				options = append(options, o)
+			}
+		}
+		opt.Option = options
+	}
+
+	if !cfg.Insert {
+		return
+	}
+
+	ip := net.ParseIP(req.ClientIP())
+	if ip == nil {
+		return
+	}
+
+	subnet := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        2,
+		SourceNetmask: cfg.IPv6Prefix,
+		Address:       ip.To16(),
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		subnet.Family = 1
+		subnet.SourceNetmask = cfg.IPv4Prefix
+		subnet.Address = ip4
+	}
+
+	if subnet.SourceNetmask == 0 {
+		return
+	}
+
+	// do not reveal more than the source prefix
+	bits := len(subnet.Address) * 8
+	subnet.Address = subnet.Address.Mask(net.CIDRMask(int(subnet.SourceNetmask), bits))
+
+	opt.Option = append(opt.Option, subnet)
+}
+
+// scopeResponse records the network the upstream response resp is valid
+// for in req. The client subnet option of the response is returned so it
+// can be passed to the client
+func scopeResponse(req *request.Request, resp *dns.Msg) *dns.EDNS0_SUBNET {
+	subnet := clientSubnet(resp.IsEdns0())
+	if subnet == nil {
+		return nil
+	}
+
+	if subnet.SourceScope > 0 {
+		bits := 8 * net.IPv6len
+		ip := subnet.Address.To16()
+
+		if subnet.Family == 1 {
+			bits = 8 * net.IPv4len
+			ip = subnet.Address.To4()
+		}
+
+		if ip != nil && int(subnet.SourceScope) <= bits {
+			mask := net.CIDRMask(int(subnet.SourceScope), bits)
+			req.ClientSubnet = &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		}
+	}
+
+	return subnet
+}
+
+// clientSubnet returns the client subnet option of opt
+func clientSubnet(opt *dns.OPT) *dns.EDNS0_SUBNET {
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+
+	return nil
+}
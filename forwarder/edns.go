@@ -0,0 +1,110 @@
+package forwarder
+
+import (
+	"net"
+
+	"github.com/homebot/dnswall/request"
+	"github.com/miekg/dns"
+)
+
+// DefaultUDPSize is the EDNS0 UDP payload size advertised to upstream
+// servers unless configured otherwise
+const DefaultUDPSize = 1232
+
+// hopByHopOptions are EDNS0 options that only apply to a single
+// client-server connection and must not be forwarded upstream
+var hopByHopOptions = map[uint16]bool{
+	dns.EDNS0COOKIE:       true,
+	dns.EDNS0TCPKEEPALIVE: true,
+	dns.EDNS0PADDING:      true,
+}
+
+// WithUDPSize sets the EDNS0 UDP payload size advertised to upstream servers
+func (f *Forwarder) WithUDPSize(size uint16) *Forwarder {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+
+	f.udpSize = size
+
+	return f
+}
+
+// prepareEdns0 makes sure msg advertises the configured UDP payload size
+// upstream. Options sent by the client are preserved unless they are only
+// meaningful between the client and dnswall
+func (f *Forwarder) prepareEdns0(msg *dns.Msg) {
+	f.rw.RLock()
+	size := f.udpSize
+	f.rw.RUnlock()
+
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(size, false)
+		return
+	}
+
+	opt.SetUDPSize(size)
+
+	var options []dns.EDNS0
+	for _, o := range opt.Option {
+		if !hopByHopOptions[o.Option()] {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// fitResponse adapts the EDNS0 record of the upstream response resp to the
+// request of the client and truncates it if it exceeds the payload size
+// the client can handle over UDP. The AD bit of the upstream is cleared as
+// only the DNSSEC validator may vouch for the authenticity of responses
+func (f *Forwarder) fitResponse(req *request.Request, resp *dns.Msg) {
+	clientOpt := req.Req.IsEdns0()
+	subnet := scopeResponse(req, resp)
+
+	resp.AuthenticatedData = false
+
+	// remove the OPT record returned by the upstream server. If the client
+	// used EDNS0, a new one is added below
+	var extra []dns.RR
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	resp.Extra = extra
+	resp.Compress = true
+
+	size := dns.MinMsgSize
+	if clientOpt != nil {
+		f.rw.RLock()
+		resp.SetEdns0(f.udpSize, clientOpt.Do())
+		passthrough := f.clientSubnet.Passthrough
+		f.rw.RUnlock()
+
+		// clients that sent a client subnet option expect it to be
+		// returned together with the scope of the answer (RFC 7871)
+		if cs := clientSubnet(clientOpt); cs != nil {
+			if subnet == nil || !passthrough {
+				subnet = &dns.EDNS0_SUBNET{
+					Code:          cs.Code,
+					Family:        cs.Family,
+					SourceNetmask: cs.SourceNetmask,
+					Address:       cs.Address,
+				}
+			}
+
+			resp.IsEdns0().Option = append(resp.IsEdns0().Option, subnet)
+		}
+
+		if int(clientOpt.UDPSize()) > size {
+			size = int(clientOpt.UDPSize())
+		}
+	}
+
+	if _, ok := req.RemoteAddr().(*net.UDPAddr); !ok {
+		return
+	}
+
+	request.Truncate(resp, size)
+}
@@ -0,0 +1,91 @@
+package forwarder
+
+import (
+	"log"
+
+	"github.com/homebot/dnswall"
+	"github.com/homebot/dnswall/request"
+	"github.com/miekg/dns"
+)
+
+// EDENetworkError is the Extended DNS Error (RFC 8914) info-code used if no
+// upstream server could be reached
+const EDENetworkError = 23
+
+// FailurePolicy configures how the forwarder handles upstream failures
+type FailurePolicy struct {
+	// Fallback causes requests to be forwarded to the static servers if
+	// all upstreams of a matching conditional forwarder failed
+	Fallback bool
+
+	// Next passes requests that could not be forwarded to the next
+	// middleware instead of answering them with SERVFAIL
+	Next bool
+
+	// RetryRcodes are upstream response codes that cause the next upstream
+	// to be queried. If all upstreams respond with one of them, the last
+	// response is passed to the client
+	RetryRcodes []int
+
+	// ExtendedErrors attaches an Extended DNS Error (RFC 8914) to SERVFAIL
+	// responses if the client supports EDNS0
+	ExtendedErrors bool
+}
+
+// DefaultFailurePolicy is used by forwarders unless configured otherwise
+var DefaultFailurePolicy = FailurePolicy{
+	RetryRcodes:    []int{dns.RcodeServerFailure, dns.RcodeRefused},
+	ExtendedErrors: true,
+}
+
+// WithFailurePolicy configures how upstream failures are handled
+func (f *Forwarder) WithFailurePolicy(p FailurePolicy) *Forwarder {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+
+	f.failure = p
+
+	return f
+}
+
+// failurePolicy returns the current failure policy
+func (f *Forwarder) failurePolicy() FailurePolicy {
+	f.rw.RLock()
+	defer f.rw.RUnlock()
+
+	return f.failure
+}
+
+// retry returns true if the upstream response should be retried using
+// the next upstream
+func (p FailurePolicy) retry(resp *dns.Msg) bool {
+	for _, rcode := range p.RetryRcodes {
+		if resp.Rcode == rcode {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fail answers a request that could not be forwarded with SERVFAIL or
+// passes it to the next middleware, depending on the failure policy
+func (f *Forwarder) fail(session *dnswall.Session, req *request.Request, err error) error {
+	p := f.failurePolicy()
+
+	if p.Next {
+		log.Printf("[forwarder] failed to forward %q, passing to next middleware: %s\n", req.Name(), err)
+		return session.Next()
+	}
+
+	log.Printf("[forwarder] failed to forward %q: %s\n", req.Name(), err)
+
+	m := req.CreateError(dns.RcodeServerFailure)
+
+	if opt := req.Req.IsEdns0(); opt != nil && p.ExtendedErrors {
+		m.SetEdns0(opt.UDPSize(), false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, request.ExtendedError(EDENetworkError, "upstream unreachable"))
+	}
+
+	return session.ResolveWith(m)
+}
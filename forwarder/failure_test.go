@@ -0,0 +1,126 @@
+package forwarder
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/homebot/dnswall"
+	"github.com/homebot/dnswall/request"
+	"github.com/miekg/dns"
+)
+
+// responseWriter records the response written to a UDP client
+type responseWriter struct {
+	msg *dns.Msg
+}
+
+func (w *responseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *responseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+func (w *responseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *responseWriter) Write(buf []byte) (int, error) { return len(buf), nil }
+func (w *responseWriter) Close() error                  { return nil }
+func (w *responseWriter) TsigStatus() error             { return nil }
+func (w *responseWriter) TsigTimersOnly(bool)           {}
+func (w *responseWriter) Hijack()                       {}
+
+// nxdomain answers all requests with NXDOMAIN
+type nxdomain struct{}
+
+func (nxdomain) Name() string { return "nxdomain" }
+
+func (nxdomain) Serve(session *dnswall.Session, req *request.Request) error {
+	return session.Reject(dns.RcodeNameError)
+}
+
+// extendedErrorCode returns the info-code of the extended DNS error of m or
+// -1 if there is none
+func extendedErrorCode(m *dns.Msg) int {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return -1
+	}
+
+	for _, o := range opt.Option {
+		if local, ok := o.(*dns.EDNS0_LOCAL); ok && local.Code == request.EDEOptionCode && len(local.Data) >= 2 {
+			return int(binary.BigEndian.Uint16(local.Data))
+		}
+	}
+
+	return -1
+}
+
+func TestFailurePolicy(t *testing.T) {
+	static := "192.0.2.1:53"
+	conditional := "192.0.2.2:53"
+
+	cases := []struct {
+		desc        string
+		policy      FailurePolicy
+		edns        bool
+		static      *fakeTransport
+		conditional *fakeTransport
+		rcode       int
+		ede         int
+	}{
+		{"extended error", DefaultFailurePolicy, true, &fakeTransport{fail: true}, &fakeTransport{fail: true}, dns.RcodeServerFailure, EDENetworkError},
+		{"client without EDNS0", DefaultFailurePolicy, false, &fakeTransport{fail: true}, &fakeTransport{fail: true}, dns.RcodeServerFailure, -1},
+		{"extended errors disabled", FailurePolicy{}, true, &fakeTransport{fail: true}, &fakeTransport{fail: true}, dns.RcodeServerFailure, -1},
+		{"next middleware", FailurePolicy{Next: true, ExtendedErrors: true}, true, &fakeTransport{fail: true}, &fakeTransport{fail: true}, dns.RcodeNameError, -1},
+		{"no fallback", FailurePolicy{ExtendedErrors: true}, true, &fakeTransport{}, &fakeTransport{fail: true}, dns.RcodeServerFailure, EDENetworkError},
+		{"fallback", FailurePolicy{Fallback: true, ExtendedErrors: true}, true, &fakeTransport{}, &fakeTransport{fail: true}, dns.RcodeSuccess, -1},
+		{"fallback fails", FailurePolicy{Fallback: true, ExtendedErrors: true}, true, &fakeTransport{fail: true}, &fakeTransport{fail: true}, dns.RcodeServerFailure, EDENetworkError},
+		{"retried rcode", FailurePolicy{RetryRcodes: []int{dns.RcodeRefused}, ExtendedErrors: true}, true, &fakeTransport{rcode: dns.RcodeRefused}, &fakeTransport{rcode: dns.RcodeRefused}, dns.RcodeRefused, -1},
+	}
+
+	for _, c := range cases {
+		cond, err := NewConditional("true", conditional)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f, err := New([]string{static}, []Conditional{cond})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.upstreams[static].transport = c.static
+		f.upstreams[conditional].transport = c.conditional
+		f.WithFailurePolicy(c.policy)
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		if c.edns {
+			req.SetEdns0(4096, false)
+		}
+
+		w := &responseWriter{}
+		session := dnswall.NewSession([]dnswall.Middleware{f, nxdomain{}}, &request.Request{W: w, Req: req}, w)
+		if err := session.Run(context.Background()); err != nil {
+			t.Fatalf("%s: %s", c.desc, err)
+		}
+
+		if w.msg == nil {
+			t.Fatalf("%s: no response has been written", c.desc)
+		}
+
+		if w.msg.Rcode != c.rcode {
+			t.Errorf("%s: expected %s, got %s", c.desc, dns.RcodeToString[c.rcode], dns.RcodeToString[w.msg.Rcode])
+		}
+
+		if ede := extendedErrorCode(w.msg); ede != c.ede {
+			t.Errorf("%s: expected extended error %d, got %d", c.desc, c.ede, ede)
+		}
+	}
+}
@@ -1,7 +1,11 @@
 package forwarder
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
 
 	"github.com/homebot/dnswall"
 	"github.com/homebot/dnswall/request"
@@ -9,32 +13,142 @@ import (
 	"github.com/miekg/dns"
 )
 
+// Conditional is a conditional forwarder entry. If Condition matches a
+// request, the request is forwarded to the upstream servers of the entry
+type Conditional struct {
+	// Condition is the rule expression that must evaluate to true
+	Condition string
+
+	// Servers is the upstream group to use if Condition matches. Servers are
+	// tried in order
+	Servers []string
+
+	expr *rules.Expr
+}
+
+// NewConditional returns a new conditional forwarder entry
+func NewConditional(condition string, servers ...string) (Conditional, error) {
+	if len(servers) == 0 {
+		return Conditional{}, fmt.Errorf("conditional forwarder %q: no servers configured", condition)
+	}
+
+	expr, err := rules.NewExpr(condition)
+	if err != nil {
+		return Conditional{}, err
+	}
+
+	return Conditional{
+		Condition: condition,
+		Servers:   servers,
+		expr:      expr,
+	}, nil
+}
+
 // Forwarder is a dnslog middleware and adds support to use forwarders
 type Forwarder struct {
 	Servers []string
 
-	conditionalResolvers map[string]*rules.Expr
+	// conditionals are evaluated in configuration order and the first
+	// matching entry is used to resolve the request
+	conditionals []Conditional
+
+	rw        sync.RWMutex
+	health    HealthCheck
+	upstreams map[string]*upstream
+	stop      chan struct{}
+	strategy  Strategy
+	raceCount int
+	failure   FailurePolicy
+	udpSize   uint16
+	timeouts  Timeouts
+
+	clientSubnet ClientSubnet
+	zones        *ZoneTable
+
+	// next is used by StrategyRoundRobin and must be accessed atomically
+	next uint64
 }
 
-// New returns a new forwarder middleware
-func New(servers []string, conditionals map[string]string) (*Forwarder, error) {
+// New returns a new forwarder middleware. Conditional forwarders must be
+// created using NewConditional
+func New(servers []string, conditionals []Conditional) (*Forwarder, error) {
+	for _, c := range conditionals {
+		if c.expr == nil {
+			return nil, fmt.Errorf("conditional forwarder %q: not created by NewConditional", c.Condition)
+		}
+	}
+
 	f := &Forwarder{
-		Servers:              servers,
-		conditionalResolvers: make(map[string]*rules.Expr),
+		Servers:      servers,
+		conditionals: conditionals,
+		health:       DefaultHealthCheck,
+		upstreams:    make(map[string]*upstream),
+		strategy:     StrategySequential,
+		raceCount:    2,
+		failure:      DefaultFailurePolicy,
+		udpSize:      DefaultUDPSize,
+		timeouts:     DefaultTimeouts,
+		clientSubnet: DefaultClientSubnet,
 	}
 
-	for key, val := range conditionals {
-		expr, err := rules.NewExpr(val)
-		if err != nil {
+	for _, srv := range servers {
+		if _, err := f.upstream(srv); err != nil {
 			return nil, err
 		}
+	}
+
+	for _, c := range conditionals {
+		for _, srv := range c.Servers {
+			if _, err := f.upstream(srv); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return f, nil
+}
+
+// WithTimeouts sets the default timeouts and connection pool size for all
+// upstreams. Upstream URLs may override them. It must be called before the
+// forwarder is used as connections to upstreams are not migrated
+func (f *Forwarder) WithTimeouts(t Timeouts) (*Forwarder, error) {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+
+	f.timeouts = t
+
+	for addr, u := range f.upstreams {
+		tr, err := newTransport(addr, t, u.metrics)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %s", addr, err)
+		}
 
-		f.conditionalResolvers[key] = expr
+		u.transport = tr
 	}
 
 	return f, nil
 }
 
+// WithZones sets the forward and stub zones of the forwarder. Requests that
+// are not handled by a conditional forwarder are sent to the upstream group
+// of the zone with the longest suffix matching the request
+func (f *Forwarder) WithZones(t *ZoneTable) (*Forwarder, error) {
+	for _, z := range t.Zones() {
+		for _, srv := range z.Servers {
+			if _, err := f.upstream(srv); err != nil {
+				return nil, fmt.Errorf("zone %q: %s", z.Suffix, err)
+			}
+		}
+	}
+
+	f.rw.Lock()
+	defer f.rw.Unlock()
+
+	f.zones = t
+
+	return f, nil
+}
+
 // Name returns the name of the middleware and implements middleware.Middleware
 func (f *Forwarder) Name() string {
 	return "forwarder"
@@ -51,33 +165,237 @@ func (f *Forwarder) Serve(session *dnswall.Session, req *request.Request) error
 		copy.Extra = copy.Extra[:len(copy.Extra)-1]
 	}
 
+	f.prepareEdns0(copy)
+	f.prepareClientSubnet(req, copy)
+
+	matched := false
+
 	// first, try to find a conditional forwarder
-	for srv, expr := range f.conditionalResolvers {
-		res, err := expr.EvaluateBool(req, nil)
-
-		if err == nil && res {
-			resp, err := dns.Exchange(copy, srv)
-			log.Printf("[forwarder] conditional server %q selected\n", srv)
-			if err != nil {
-				return session.RejectError(dns.RcodeNameError, err)
-			}
+	for idx, cond := range f.conditionals {
+		match, err := cond.expr.EvaluateBool(req, nil)
+		if err != nil {
+			log.Printf("[forwarder] conditional forwarder #%d (%s) failed to evaluate: %s\n", idx, cond.Condition, err)
+			continue
+		}
+
+		if !match {
+			continue
+		}
+
+		log.Printf("[forwarder] conditional forwarder #%d (%s) selected for %q\n", idx, cond.Condition, req.Name())
+		matched = true
+
+		resp, err := f.exchange(session.Ctx, copy, req, cond.Servers)
+		if err == nil {
+			f.fitResponse(req, resp)
 			return session.ResolveWith(resp)
-		} else if err != nil {
-			log.Printf("[forwarder] conditional expression for server %q failed to evalutate: %s\n", srv, err)
 		}
+
+		if !f.failurePolicy().Fallback {
+			return f.fail(session, req, err)
+		}
+
+		log.Printf("[forwarder] conditional forwarder #%d (%s) failed, falling back to static servers: %s\n", idx, cond.Condition, err)
+		break
 	}
 
-	for _, srv := range f.Servers {
-		resp, err := dns.Exchange(copy, srv)
+	// second, try the forward and stub zones
+	if zone, ok := f.zoneFor(req); ok && !matched {
+		log.Printf("[forwarder] zone %q selected for %q\n", zone.Suffix, req.Name())
+
+		msg := copy
+		if zone.Stub {
+			// stub zone servers are authoritative and do not recurse
+			msg = copy.Copy()
+			msg.RecursionDesired = false
+		}
+
+		resp, err := f.exchange(session.Ctx, msg, req, zone.Servers)
 		if err == nil {
-			log.Printf("[forwarder] resolved query for %q using %s\n", req.Name(), srv)
+			f.fitResponse(req, resp)
 			return session.ResolveWith(resp)
 		}
 
-		log.Printf("[forwarder] %s: failed to resolve %q: %s\n", srv, req.Name(), err)
+		if !f.failurePolicy().Fallback {
+			return f.fail(session, req, err)
+		}
+
+		log.Printf("[forwarder] zone %q failed, falling back to static servers: %s\n", zone.Suffix, err)
+	}
+
+	if len(f.Servers) == 0 {
+		return session.Next()
+	}
+
+	resp, err := f.exchange(session.Ctx, copy, req, f.Servers)
+	if err != nil {
+		return f.fail(session, req, err)
+	}
+
+	f.fitResponse(req, resp)
+	return session.ResolveWith(resp)
+}
+
+// zoneFor returns the forward or stub zone for req
+func (f *Forwarder) zoneFor(req *request.Request) (Zone, bool) {
+	f.rw.RLock()
+	zones := f.zones
+	f.rw.RUnlock()
+
+	if zones == nil {
+		return Zone{}, false
+	}
+
+	return zones.Lookup(req.Name().String())
+}
+
+// Resolve resolves name and qtype using the static upstream servers. DNSSEC
+// records are requested as well. It is used to look up records that are
+// not requested by clients, like DNSKEY and DS records during validation
+func (f *Forwarder) Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	f.rw.RLock()
+	msg.SetEdns0(f.udpSize, true)
+	f.rw.RUnlock()
+
+	return f.exchange(ctx, msg, &request.Request{Req: msg}, f.Servers)
+}
+
+// Forward sends msg to the upstream group servers and returns the response.
+// Upstreams are created on demand and share health checks, strategy,
+// failure policy and metrics with the other upstreams of the forwarder
+func (f *Forwarder) Forward(ctx context.Context, msg *dns.Msg, servers ...string) (*dns.Msg, error) {
+	return f.exchange(ctx, msg, &request.Request{Req: msg}, servers)
+}
+
+// exchange tries to resolve msg using the available upstreams of servers
+// in the order of the configured strategy and returns the first response
+// received. Responses with an rcode that should be retried according to
+// the failure policy are only returned if no other upstream answered
+func (f *Forwarder) exchange(ctx context.Context, msg *dns.Msg, req *request.Request, servers []string) (*dns.Msg, error) {
+	upstreams := f.order(f.selectUpstreams(servers))
+	policy := f.failurePolicy()
+
+	f.rw.RLock()
+	race := f.strategy == StrategyRace
+	n := f.raceCount
+	f.rw.RUnlock()
+
+	var last *dns.Msg
+	err := errors.New("no servers configured")
+
+	if race && n > 1 && len(upstreams) > 1 {
+		if n > len(upstreams) {
+			n = len(upstreams)
+		}
+
+		var resp *dns.Msg
+
+		resp, err = f.race(ctx, msg, req, upstreams[:n], policy)
+		if err == nil && !policy.retry(resp) {
+			return resp, nil
+		}
+
+		if resp != nil {
+			last = resp
+		}
+
+		upstreams = upstreams[n:]
+	}
+
+	for _, u := range upstreams {
+		var resp *dns.Msg
+
+		resp, err = f.exchangeWith(ctx, msg, req, u)
+		if err != nil {
+			continue
+		}
+
+		if !policy.retry(resp) {
+			return resp, nil
+		}
+
+		log.Printf("[forwarder] %s answered %q with %s, trying next upstream\n", u.addr, req.Name(), dns.RcodeToString[resp.Rcode])
+		last = resp
+	}
+
+	if last != nil {
+		return last, nil
+	}
+
+	return nil, err
+}
+
+// exchangeWith sends msg to the upstream u and updates its health and
+// metrics
+func (f *Forwarder) exchangeWith(ctx context.Context, msg *dns.Msg, req *request.Request, u *upstream) (*dns.Msg, error) {
+	resp, rtt, err := u.transport.Exchange(ctx, msg)
+	u.metrics.observe(ctx, resp, rtt, err)
+
+	if err != nil {
+		if ctx.Err() != nil {
+			// the query has been cancelled, this is not the upstream's fault
+			return nil, err
+		}
+
+		u.failure(f.healthCheck())
+		log.Printf("[forwarder] %s: failed to resolve %q: %s\n", u.addr, req.Name(), err)
+		return nil, err
 	}
 
-	log.Printf("[forwarder] failed to serve request for %q. No servers available\n", req.Name())
+	u.success(rtt)
+	log.Printf("[forwarder] resolved query for %q using %s\n", req.Name(), u.addr)
+
+	return resp, nil
+}
+
+// race sends msg to all upstreams in parallel and returns the first
+// response that should not be retried according to policy. If there is
+// no such response, the first response received is returned instead
+func (f *Forwarder) race(ctx context.Context, msg *dns.Msg, req *request.Request, upstreams []*upstream, policy FailurePolicy) (*dns.Msg, error) {
+	// cancel queries to the remaining upstreams once we have a winner
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+
+	results := make(chan result, len(upstreams))
+
+	for _, u := range upstreams {
+		go func(u *upstream) {
+			resp, err := f.exchangeWith(ctx, msg.Copy(), req, u)
+			results <- result{resp, err}
+		}(u)
+	}
+
+	var first *dns.Msg
+	var err error
+
+	for range upstreams {
+		r := <-results
+
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+
+		if !policy.retry(r.resp) {
+			return r.resp, nil
+		}
+
+		if first == nil {
+			first = r.resp
+		}
+	}
+
+	if first != nil {
+		return first, nil
+	}
 
-	return session.Next()
+	return nil, err
 }
@@ -0,0 +1,309 @@
+package forwarder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HealthCheck configures active and passive health checking of upstream
+// servers
+type HealthCheck struct {
+	// Interval between active health probes. Set to zero to disable
+	// active probing and rely on failures of forwarded queries only
+	Interval time.Duration
+
+	// Timeout for a single health probe
+	Timeout time.Duration
+
+	// MaxFails is the number of consecutive failures after which an
+	// upstream is marked as down
+	MaxFails int
+
+	// Backoff is the time an upstream is skipped after it has been marked
+	// as down. It doubles with each failed retry up to MaxBackoff
+	Backoff time.Duration
+
+	// MaxBackoff is the upper limit for Backoff
+	MaxBackoff time.Duration
+}
+
+// DefaultHealthCheck is used by forwarders unless configured otherwise.
+// Active probes are disabled
+var DefaultHealthCheck = HealthCheck{
+	Timeout:    2 * time.Second,
+	MaxFails:   3,
+	Backoff:    5 * time.Second,
+	MaxBackoff: 5 * time.Minute,
+}
+
+// UpstreamStatus describes the health state of an upstream server
+type UpstreamStatus struct {
+	// Addr is the address of the upstream server
+	Addr string `json:"addr"`
+
+	// Healthy is false if the upstream has been marked as down
+	Healthy bool `json:"healthy"`
+
+	// Fails is the number of consecutive failures
+	Fails int `json:"fails"`
+
+	// RetryAt is the time a down upstream will be tried again
+	RetryAt time.Time `json:"retryAt,omitempty"`
+
+	// Latency is the moving average of the round-trip time
+	Latency time.Duration `json:"latency"`
+}
+
+// WithHealthCheck configures health checking of upstream servers. If
+// hc.Interval is set, all upstreams are actively probed in the background
+func (f *Forwarder) WithHealthCheck(hc HealthCheck) *Forwarder {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+
+	f.health = hc
+
+	if f.stop != nil {
+		close(f.stop)
+		f.stop = nil
+	}
+
+	if hc.Interval > 0 {
+		f.stop = make(chan struct{})
+		go f.probe(hc, f.stop)
+	}
+
+	return f
+}
+
+// Upstreams returns the health status of all upstream servers
+func (f *Forwarder) Upstreams() []UpstreamStatus {
+	f.rw.RLock()
+	defer f.rw.RUnlock()
+
+	var status []UpstreamStatus
+	for _, u := range f.upstreams {
+		status = append(status, u.status())
+	}
+
+	return status
+}
+
+// upstream returns the upstream for addr and creates it if required
+func (f *Forwarder) upstream(addr string) (*upstream, error) {
+	f.rw.RLock()
+	u, ok := f.upstreams[addr]
+	f.rw.RUnlock()
+
+	if ok {
+		return u, nil
+	}
+
+	f.rw.Lock()
+	defer f.rw.Unlock()
+
+	// another request may have created it in the meantime
+	if u, ok := f.upstreams[addr]; ok {
+		return u, nil
+	}
+
+	m := newMetrics()
+
+	t, err := newTransport(addr, f.timeouts, m)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %q: %s", addr, err)
+	}
+
+	u = &upstream{
+		addr:      addr,
+		transport: t,
+		metrics:   m,
+	}
+	f.upstreams[addr] = u
+
+	return u, nil
+}
+
+// healthCheck returns the current health check configuration
+func (f *Forwarder) healthCheck() HealthCheck {
+	f.rw.RLock()
+	defer f.rw.RUnlock()
+
+	return f.health
+}
+
+// probe actively checks the health of all upstreams until stop is closed
+func (f *Forwarder) probe(hc HealthCheck, stop chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(hc.Interval):
+		}
+
+		f.rw.RLock()
+		upstreams := make([]*upstream, 0, len(f.upstreams))
+		for _, u := range f.upstreams {
+			upstreams = append(upstreams, u)
+		}
+		f.rw.RUnlock()
+
+		var wg sync.WaitGroup
+		for _, u := range upstreams {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				u.probe(hc)
+			}(u)
+		}
+		wg.Wait()
+	}
+}
+
+// selectUpstreams returns the upstreams for servers that are currently
+// available. If all of them are down, all upstreams are returned as a
+// last resort
+func (f *Forwarder) selectUpstreams(servers []string) []*upstream {
+	now := time.Now()
+
+	var all, available []*upstream
+	for _, srv := range servers {
+		u, err := f.upstream(srv)
+		if err != nil {
+			log.Printf("[forwarder] %s\n", err)
+			continue
+		}
+
+		all = append(all, u)
+
+		if u.available(now) {
+			available = append(available, u)
+		}
+	}
+
+	if len(available) == 0 {
+		return all
+	}
+
+	return available
+}
+
+// rttWeight is the weight of a new round-trip time sample in the
+// exponentially weighted moving average of an upstream's latency
+const rttWeight = 0.3
+
+// upstream tracks the health and latency of an upstream server
+type upstream struct {
+	addr      string
+	transport transport
+	metrics   *metrics
+
+	rw      sync.RWMutex
+	fails   int
+	down    bool
+	backoff time.Duration
+	retryAt time.Time
+	rtt     time.Duration
+}
+
+// available returns true if the upstream should be used for queries. Down
+// upstreams become available again once their backoff has passed
+func (u *upstream) available(now time.Time) bool {
+	u.rw.RLock()
+	defer u.rw.RUnlock()
+
+	return !u.down || !now.Before(u.retryAt)
+}
+
+// latency returns the moving average of the upstream's round-trip time.
+// Upstreams that have not been queried yet report zero
+func (u *upstream) latency() time.Duration {
+	u.rw.RLock()
+	defer u.rw.RUnlock()
+
+	return u.rtt
+}
+
+// success marks the upstream as healthy and records the round-trip time
+// of the query
+func (u *upstream) success(rtt time.Duration) {
+	u.rw.Lock()
+	defer u.rw.Unlock()
+
+	if u.rtt == 0 {
+		u.rtt = rtt
+	} else {
+		u.rtt = time.Duration(rttWeight*float64(rtt) + (1-rttWeight)*float64(u.rtt))
+	}
+
+	if u.down {
+		log.Printf("[forwarder] upstream %s is up again\n", u.addr)
+	}
+
+	u.fails = 0
+	u.down = false
+	u.backoff = 0
+	u.retryAt = time.Time{}
+}
+
+// failure records a failed query and marks the upstream as down once
+// hc.MaxFails has been reached
+func (u *upstream) failure(hc HealthCheck) {
+	u.rw.Lock()
+	defer u.rw.Unlock()
+
+	u.fails++
+
+	if u.fails < hc.MaxFails {
+		return
+	}
+
+	switch {
+	case !u.down:
+		u.backoff = hc.Backoff
+	case u.backoff*2 > hc.MaxBackoff:
+		u.backoff = hc.MaxBackoff
+	default:
+		u.backoff *= 2
+	}
+
+	u.down = true
+	u.retryAt = time.Now().Add(u.backoff)
+
+	log.Printf("[forwarder] upstream %s marked as down after %d failures, retrying in %s\n", u.addr, u.fails, u.backoff)
+}
+
+func (u *upstream) status() UpstreamStatus {
+	u.rw.RLock()
+	defer u.rw.RUnlock()
+
+	return UpstreamStatus{
+		Addr:    u.addr,
+		Healthy: !u.down,
+		Fails:   u.fails,
+		RetryAt: u.retryAt,
+		Latency: u.rtt,
+	}
+}
+
+// probe sends a health probe to the upstream and updates its state
+func (u *upstream) probe(hc HealthCheck) {
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+
+	_, rtt, err := u.transport.Exchange(ctx, m)
+	if err != nil {
+		log.Printf("[forwarder] health probe for %s failed: %s\n", u.addr, err)
+		u.failure(hc)
+		return
+	}
+
+	u.success(rtt)
+}
@@ -0,0 +1,227 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeTransport answers queries with a fixed response code or fails them
+type fakeTransport struct {
+	mu    sync.Mutex
+	fail  bool
+	rcode int
+	calls int
+}
+
+func (t *fakeTransport) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.calls++
+
+	if t.fail {
+		return nil, 0, errors.New("upstream unreachable")
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(msg, t.rcode)
+
+	return m, time.Millisecond, nil
+}
+
+func (t *fakeTransport) set(fail bool, rcode int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.fail = fail
+	t.rcode = rcode
+}
+
+func (t *fakeTransport) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	calls := t.calls
+	t.calls = 0
+
+	return calls
+}
+
+// newFakeForwarder returns a forwarder for servers whose upstreams use fake
+// transports
+func newFakeForwarder(t *testing.T, servers []string, conditionals ...Conditional) (*Forwarder, map[string]*fakeTransport) {
+	f, err := New(servers, conditionals)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakes := make(map[string]*fakeTransport)
+	for addr, u := range f.upstreams {
+		fake := &fakeTransport{}
+		u.transport = fake
+		fakes[addr] = fake
+	}
+
+	return f, fakes
+}
+
+func TestUpstreamBackoff(t *testing.T) {
+	hc := HealthCheck{
+		MaxFails:   2,
+		Backoff:    time.Second,
+		MaxBackoff: 3 * time.Second,
+	}
+
+	u := &upstream{addr: "192.0.2.1:53"}
+
+	cases := []struct {
+		desc    string
+		success bool
+		down    bool
+		fails   int
+		backoff time.Duration
+	}{
+		{"first failure", false, false, 1, 0},
+		{"max fails reached", false, true, 2, time.Second},
+		{"retry failed", false, true, 3, 2 * time.Second},
+		{"backoff capped", false, true, 4, 3 * time.Second},
+		{"backoff stays capped", false, true, 5, 3 * time.Second},
+		{"recovered", true, false, 0, 0},
+		{"failure after recovery", false, false, 1, 0},
+		{"down again", false, true, 2, time.Second},
+	}
+
+	for _, c := range cases {
+		if c.success {
+			u.success(10 * time.Millisecond)
+		} else {
+			u.failure(hc)
+		}
+
+		status := u.status()
+		if status.Healthy == c.down || status.Fails != c.fails || u.backoff != c.backoff {
+			t.Errorf("%s: expected down=%v fails=%d backoff=%s, got down=%v fails=%d backoff=%s", c.desc, c.down, c.fails, c.backoff, !status.Healthy, status.Fails, u.backoff)
+		}
+
+		now := time.Now()
+		if available := u.available(now); available == c.down {
+			t.Errorf("%s: expected available=%v", c.desc, !c.down)
+		}
+
+		// down upstreams are retried once the backoff passed
+		if c.down && !u.available(now.Add(c.backoff)) {
+			t.Errorf("%s: expected upstream to be retried after %s", c.desc, c.backoff)
+		}
+	}
+}
+
+func TestForwarderSkipsDownUpstreams(t *testing.T) {
+	f, fakes := newFakeForwarder(t, []string{"192.0.2.1:53", "192.0.2.2:53"})
+	f.WithHealthCheck(HealthCheck{MaxFails: 2, Backoff: time.Hour, MaxBackoff: time.Hour})
+
+	primary, secondary := fakes["192.0.2.1:53"], fakes["192.0.2.2:53"]
+	primary.set(true, 0)
+
+	cases := []struct {
+		desc      string
+		primary   int
+		secondary int
+	}{
+		{"first failure", 1, 1},
+		{"marked as down", 1, 1},
+		{"skipped while down", 0, 1},
+		{"still skipped", 0, 1},
+	}
+
+	for _, c := range cases {
+		if _, err := f.Resolve(context.Background(), "example.com.", dns.TypeA); err != nil {
+			t.Fatalf("%s: %s", c.desc, err)
+		}
+
+		if p, s := primary.count(), secondary.count(); p != c.primary || s != c.secondary {
+			t.Errorf("%s: expected %d/%d queries, got %d/%d", c.desc, c.primary, c.secondary, p, s)
+		}
+	}
+
+	// the upstream recovers once its backoff passed
+	u := f.upstreams["192.0.2.1:53"]
+	u.rw.Lock()
+	u.retryAt = time.Now().Add(-time.Second)
+	u.rw.Unlock()
+
+	primary.set(false, dns.RcodeSuccess)
+
+	if _, err := f.Resolve(context.Background(), "example.com.", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+
+	if p, s := primary.count(), secondary.count(); p != 1 || s != 0 {
+		t.Errorf("expected the recovered upstream to be queried, got %d/%d queries", p, s)
+	}
+
+	for _, status := range f.Upstreams() {
+		if !status.Healthy {
+			t.Errorf("expected %s to be healthy", status.Addr)
+		}
+	}
+}
+
+func TestStrategyOrder(t *testing.T) {
+	servers := []string{"192.0.2.1:53", "192.0.2.2:53", "192.0.2.3:53"}
+	latency := map[string]time.Duration{
+		"192.0.2.1:53": 30 * time.Millisecond,
+		"192.0.2.2:53": 10 * time.Millisecond,
+		"192.0.2.3:53": 20 * time.Millisecond,
+	}
+
+	cases := []struct {
+		strategy Strategy
+		want     [][]string
+	}{
+		{StrategySequential, [][]string{servers, servers}},
+		{StrategyRoundRobin, [][]string{
+			{"192.0.2.2:53", "192.0.2.3:53", "192.0.2.1:53"},
+			{"192.0.2.3:53", "192.0.2.1:53", "192.0.2.2:53"},
+		}},
+		{StrategyLowestLatency, [][]string{
+			{"192.0.2.2:53", "192.0.2.3:53", "192.0.2.1:53"},
+		}},
+		{StrategyRace, [][]string{
+			{"192.0.2.2:53", "192.0.2.3:53", "192.0.2.1:53"},
+		}},
+	}
+
+	for _, c := range cases {
+		f, _ := newFakeForwarder(t, servers)
+		f.WithStrategy(c.strategy)
+
+		for addr, rtt := range latency {
+			f.upstreams[addr].success(rtt)
+		}
+
+		for i, want := range c.want {
+			var got []string
+			for _, u := range f.order(f.selectUpstreams(servers)) {
+				got = append(got, u.addr)
+			}
+
+			if strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("%s #%d: expected %v, got %v", c.strategy, i, want, got)
+			}
+		}
+	}
+
+	// random keeps all upstreams
+	f, _ := newFakeForwarder(t, servers)
+	f.WithStrategy(StrategyRandom)
+
+	if got := f.order(f.selectUpstreams(servers)); len(got) != len(servers) {
+		t.Errorf("random: expected %d upstreams, got %d", len(servers), len(got))
+	}
+}
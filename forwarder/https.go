@@ -0,0 +1,192 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the media type of DNS wire format messages (RFC 8484)
+const dohMediaType = "application/dns-message"
+
+// dohParams are query parameters of https:// upstream URLs that configure
+// the transport and are not sent to the server
+var dohParams = append([]string{"servername", "ca", "pin", "bootstrap", "method", "timeout"}, transportParams...)
+
+// httpsTransport sends queries using DNS over HTTPS (RFC 8484)
+type httpsTransport struct {
+	url     string
+	get     bool
+	timeout time.Duration
+	client  *http.Client
+}
+
+// newHTTPSTransport returns a DNS over HTTPS transport for u. In addition to
+// the parameters supported by newTLSTransport, the following query parameters
+// are supported:
+//
+//	bootstrap  IP address used to connect to the server instead of resolving
+//	           its host name. May be repeated
+//	method     either POST (default) or GET
+//	timeout    overall timeout for a single query, e.g. 2s. Defaults to
+//	           the sum of the dial, write and read timeouts
+func newHTTPSTransport(u *url.URL, to Timeouts) (transport, error) {
+	params := u.Query()
+
+	cfg, err := tlsConfig(u)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &httpsTransport{
+		timeout: to.Dial + to.Write + to.Read,
+	}
+
+	switch m := strings.ToUpper(params.Get("method")); m {
+	case "", http.MethodPost:
+	case http.MethodGet:
+		t.get = true
+	default:
+		return nil, fmt.Errorf("unsupported method %q", m)
+	}
+
+	if timeout := params.Get("timeout"); timeout != "" {
+		t.timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %s", err)
+		}
+	}
+
+	var bootstrap []string
+	for _, ip := range params["bootstrap"] {
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("invalid bootstrap address %q", ip)
+		}
+
+		bootstrap = append(bootstrap, ip)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   to.Dial,
+		KeepAlive: 30 * time.Second,
+	}
+
+	dial := dialer.DialContext
+	if len(bootstrap) > 0 {
+		// connect to the bootstrap addresses so resolving the host name of
+		// the upstream does not loop through dnswall itself
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, ip := range bootstrap {
+				var conn net.Conn
+
+				conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+				if err == nil {
+					return conn, nil
+				}
+			}
+
+			return nil, err
+		}
+	}
+
+	t.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dial,
+			TLSClientConfig:       cfg,
+			ForceAttemptHTTP2:     true,
+			MaxIdleConnsPerHost:   4,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   to.Dial,
+			ResponseHeaderTimeout: to.Write + to.Read,
+		},
+	}
+
+	for _, p := range dohParams {
+		params.Del(p)
+	}
+
+	target := *u
+	target.RawQuery = params.Encode()
+	t.url = target.String()
+
+	return t, nil
+}
+
+// Exchange implements transport
+func (t *httpsTransport) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, t.timeout)
+	defer cancel()
+
+	// RFC 8484 recommends a message ID of zero to improve HTTP caching
+	out := msg.Copy()
+	out.Id = 0
+
+	buf, err := out.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var req *http.Request
+	if t.get {
+		sep := "?"
+		if strings.Contains(t.url, "?") {
+			sep = "&"
+		}
+
+		req, err = http.NewRequest(http.MethodGet, t.url+sep+"dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, t.url, bytes.NewReader(buf))
+		if err == nil {
+			req.Header.Set("Content-Type", dohMediaType)
+		}
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req.Header.Set("Accept", dohMediaType)
+
+	start := time.Now()
+
+	res, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected HTTP status: %s", res.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rtt := time.Since(start)
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, 0, err
+	}
+
+	resp.Id = msg.Id
+
+	return resp, rtt, nil
+}
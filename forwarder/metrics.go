@@ -0,0 +1,241 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of the upstream latency
+// histograms. A final bucket without upper bound is added implicitly
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// Bucket is a bucket of a latency histogram
+type Bucket struct {
+	// UpperBound is the inclusive upper bound of the bucket. It is zero
+	// for the last bucket, which has no upper bound
+	UpperBound time.Duration `json:"le"`
+
+	// Count is the number of samples less than or equal to UpperBound
+	// (cumulative)
+	Count uint64 `json:"count"`
+}
+
+// Histogram is a latency histogram
+type Histogram struct {
+	// Buckets holds the cumulative sample counts per bucket
+	Buckets []Bucket `json:"buckets"`
+
+	// Count is the total number of samples
+	Count uint64 `json:"count"`
+
+	// Sum is the sum of all samples
+	Sum time.Duration `json:"sum"`
+}
+
+// UpstreamMetrics holds query statistics of an upstream server
+type UpstreamMetrics struct {
+	// Addr is the address of the upstream server
+	Addr string `json:"addr"`
+
+	// Queries is the number of queries sent to the upstream
+	Queries uint64 `json:"queries"`
+
+	// Errors is the number of queries that failed for reasons other
+	// than timeouts
+	Errors uint64 `json:"errors"`
+
+	// Timeouts is the number of queries that timed out
+	Timeouts uint64 `json:"timeouts"`
+
+	// Cancelled is the number of queries that have been cancelled before
+	// the upstream answered, e.g. because another upstream won a race
+	Cancelled uint64 `json:"cancelled"`
+
+	// Rcodes counts the responses by response code
+	Rcodes map[string]uint64 `json:"rcodes"`
+
+	// Truncated is the number of truncated responses received
+	Truncated uint64 `json:"truncated"`
+
+	// TCPRetries is the number of queries retried over TCP after a
+	// truncated UDP response
+	TCPRetries uint64 `json:"tcpRetries"`
+
+	// Latency is the histogram of round-trip times of answered queries
+	Latency Histogram `json:"latency"`
+}
+
+// Metrics returns query statistics of all upstream servers sorted by
+// address
+func (f *Forwarder) Metrics() []UpstreamMetrics {
+	f.rw.RLock()
+	upstreams := make([]*upstream, 0, len(f.upstreams))
+	for _, u := range f.upstreams {
+		upstreams = append(upstreams, u)
+	}
+	f.rw.RUnlock()
+
+	result := make([]UpstreamMetrics, 0, len(upstreams))
+	for _, u := range upstreams {
+		result = append(result, u.metrics.snapshot(u.addr))
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Addr < result[j].Addr
+	})
+
+	return result
+}
+
+// metrics collects the query statistics of an upstream
+type metrics struct {
+	mu         sync.Mutex
+	queries    uint64
+	errors     uint64
+	timeouts   uint64
+	cancelled  uint64
+	truncated  uint64
+	tcpRetries uint64
+	rcodes     map[int]uint64
+
+	// buckets holds non-cumulative sample counts. The last element counts
+	// samples above the largest bucket
+	buckets []uint64
+	count   uint64
+	sum     time.Duration
+}
+
+// newMetrics returns a new metrics collector
+func newMetrics() *metrics {
+	return &metrics{
+		rcodes:  make(map[int]uint64),
+		buckets: make([]uint64, len(LatencyBuckets)+1),
+	}
+}
+
+// observe records the result of a query sent to the upstream
+func (m *metrics) observe(ctx context.Context, resp *dns.Msg, rtt time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.queries++
+
+	switch {
+	case err != nil && ctx.Err() == context.Canceled:
+		m.cancelled++
+
+	case err != nil && isTimeout(err):
+		m.timeouts++
+
+	case err != nil:
+		m.errors++
+
+	default:
+		m.rcodes[resp.Rcode]++
+
+		if resp.Truncated {
+			m.truncated++
+		}
+
+		idx := sort.Search(len(LatencyBuckets), func(i int) bool {
+			return rtt <= LatencyBuckets[i]
+		})
+
+		m.buckets[idx]++
+		m.count++
+		m.sum += rtt
+	}
+}
+
+// truncation records a truncated UDP response that is retried over TCP
+func (m *metrics) truncation() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.truncated++
+	m.tcpRetries++
+}
+
+// snapshot returns the current statistics
+func (m *metrics) snapshot(addr string) UpstreamMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := UpstreamMetrics{
+		Addr:       addr,
+		Queries:    m.queries,
+		Errors:     m.errors,
+		Timeouts:   m.timeouts,
+		Cancelled:  m.cancelled,
+		Truncated:  m.truncated,
+		TCPRetries: m.tcpRetries,
+		Rcodes:     make(map[string]uint64),
+		Latency: Histogram{
+			Count: m.count,
+			Sum:   m.sum,
+		},
+	}
+
+	for rcode, n := range m.rcodes {
+		name, ok := dns.RcodeToString[rcode]
+		if !ok {
+			name = "RCODE" + strconv.Itoa(rcode)
+		}
+
+		result.Rcodes[name] += n
+	}
+
+	var cumulative uint64
+	for i, n := range m.buckets {
+		cumulative += n
+
+		var bound time.Duration
+		if i < len(LatencyBuckets) {
+			bound = LatencyBuckets[i]
+		}
+
+		result.Latency.Buckets = append(result.Latency.Buckets, Bucket{
+			UpperBound: bound,
+			Count:      cumulative,
+		})
+	}
+
+	return result
+}
+
+// timeoutError is returned if an upstream did not answer in time
+type timeoutError struct {
+	addr string
+}
+
+func (e *timeoutError) Error() string   { return e.addr + ": i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// isTimeout returns true if err has been caused by a timeout
+func isTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
@@ -0,0 +1,244 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// errConnClosed is returned for queries that were outstanding when the
+// connection to the upstream has been closed
+var errConnClosed = errors.New("connection closed")
+
+// pipelineResult is the result of a query sent over a pipeline
+type pipelineResult struct {
+	msg *dns.Msg
+	err error
+}
+
+// pipeline is a persistent stream connection (TCP or TLS) to an upstream
+// server. Multiple queries may be outstanding at the same time; responses
+// are matched to queries by their message ID (RFC 7766)
+type pipeline struct {
+	addr     string
+	timeouts Timeouts
+	dial     func(ctx context.Context) (net.Conn, error)
+
+	mu      sync.Mutex
+	conn    *dns.Conn
+	dialing chan struct{}
+	pending map[uint16]chan pipelineResult
+	nextID  uint16
+}
+
+// newPipeline returns a new pipeline using dial to connect to the upstream
+func newPipeline(addr string, t Timeouts, dial func(ctx context.Context) (net.Conn, error)) *pipeline {
+	return &pipeline{
+		addr:     addr,
+		timeouts: t,
+		dial:     dial,
+		pending:  make(map[uint16]chan pipelineResult),
+	}
+}
+
+// Exchange implements transport
+func (p *pipeline) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	start := time.Now()
+
+	conn, id, ch, err := p.send(ctx, msg)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	timer := time.NewTimer(p.timeouts.Read)
+	defer timer.Stop()
+
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			return nil, 0, res.err
+		}
+
+		res.msg.Id = msg.Id
+		return res.msg, time.Since(start), nil
+
+	case <-timer.C:
+		// the upstream stopped answering, the next query uses a new
+		// connection
+		err := &timeoutError{addr: p.addr}
+
+		p.mu.Lock()
+		delete(p.pending, id)
+		p.closeLocked(conn, err)
+		p.mu.Unlock()
+
+		log.Printf("[forwarder] %s: no response within %s, closing connection\n", p.addr, p.timeouts.Read)
+		return nil, 0, err
+
+	case <-ctx.Done():
+		p.forget(id)
+		return nil, 0, ctx.Err()
+	}
+}
+
+// forget removes the outstanding query with the given id
+func (p *pipeline) forget(id uint16) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.pending, id)
+}
+
+// send writes msg to the connection using a message ID that is unique among
+// all outstanding queries and returns the connection and the channel the
+// response will be delivered on. A broken connection is re-established once
+func (p *pipeline) send(ctx context.Context, msg *dns.Msg) (*dns.Conn, uint16, chan pipelineResult, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := p.connect(ctx)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		id, ch, err := p.write(ctx, conn, msg)
+		if err == nil {
+			return conn, id, ch, nil
+		}
+
+		if attempt > 0 {
+			return nil, 0, nil, err
+		}
+
+		log.Printf("[forwarder] %s: connection broken, reconnecting: %s\n", p.addr, err)
+	}
+}
+
+// write sends msg over conn unless it has been closed in the meantime
+func (p *pipeline) write(ctx context.Context, conn *dns.Conn, msg *dns.Msg) (uint16, chan pipelineResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != conn {
+		return 0, nil, errConnClosed
+	}
+
+	id := p.nextID
+	for {
+		id++
+		if _, ok := p.pending[id]; !ok {
+			break
+		}
+	}
+	p.nextID = id
+
+	out := msg.Copy()
+	out.Id = id
+
+	ch := make(chan pipelineResult, 1)
+	p.pending[id] = ch
+
+	conn.SetWriteDeadline(deadline(ctx, p.timeouts.Write))
+
+	if err := conn.WriteMsg(out); err != nil {
+		delete(p.pending, id)
+		p.closeLocked(conn, err)
+		return 0, nil, err
+	}
+
+	return id, ch, nil
+}
+
+// connect returns the current connection or dials a new one. Dialing
+// happens without holding p.mu so responses are still delivered meanwhile.
+// Concurrent queries wait for the same dial
+func (p *pipeline) connect(ctx context.Context) (*dns.Conn, error) {
+	p.mu.Lock()
+
+	for p.conn == nil && p.dialing != nil {
+		dialing := p.dialing
+		p.mu.Unlock()
+
+		select {
+		case <-dialing:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		p.mu.Lock()
+	}
+
+	if p.conn != nil {
+		conn := p.conn
+		p.mu.Unlock()
+		return conn, nil
+	}
+
+	dialing := make(chan struct{})
+	p.dialing = dialing
+	p.mu.Unlock()
+
+	c, err := p.dial(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dialing = nil
+	close(dialing)
+
+	if err != nil {
+		return nil, err
+	}
+
+	p.conn = &dns.Conn{Conn: c}
+	go p.read(p.conn)
+
+	return p.conn, nil
+}
+
+// read delivers responses received on conn to the waiting queries until
+// the connection fails
+func (p *pipeline) read(conn *dns.Conn) {
+	for {
+		msg, err := conn.ReadMsg()
+		if err != nil {
+			p.mu.Lock()
+			p.closeLocked(conn, err)
+			p.mu.Unlock()
+			return
+		}
+
+		p.mu.Lock()
+		ch, ok := p.pending[msg.Id]
+		delete(p.pending, msg.Id)
+		p.mu.Unlock()
+
+		if ok {
+			ch <- pipelineResult{msg: msg}
+		}
+	}
+}
+
+// closeLocked closes conn and fails all outstanding queries if conn is still
+// the current connection. It must be called with p.mu held
+func (p *pipeline) closeLocked(conn *dns.Conn, err error) {
+	conn.Close()
+
+	if p.conn != conn {
+		return
+	}
+
+	p.conn = nil
+
+	if err == nil {
+		err = errConnClosed
+	}
+
+	for id, ch := range p.pending {
+		ch <- pipelineResult{err: err}
+		delete(p.pending, id)
+	}
+}
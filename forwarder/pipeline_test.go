@@ -0,0 +1,158 @@
+package forwarder
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// stallingStandIn is a TCP upstream that never answers on its first
+// connection and answers every A query with 192.0.2.1 on all others
+type stallingStandIn struct {
+	l      net.Listener
+	conns  int32
+	closed chan struct{}
+}
+
+func newStallingStandIn(t *testing.T) *stallingStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &stallingStandIn{
+		l:      l,
+		closed: make(chan struct{}),
+	}
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(&dns.Conn{Conn: c}, atomic.AddInt32(&s.conns, 1) == 1)
+		}
+	}()
+
+	return s
+}
+
+func (s *stallingStandIn) serve(conn *dns.Conn, stall bool) {
+	defer conn.Close()
+
+	for {
+		r, err := conn.ReadMsg()
+		if err != nil {
+			if stall {
+				close(s.closed)
+			}
+			return
+		}
+
+		if stall {
+			continue
+		}
+
+		m := new(dns.Msg)
+		m.SetReply(r)
+
+		rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+		m.Answer = []dns.RR{rr}
+
+		conn.WriteMsg(m)
+	}
+}
+
+func TestPipelineClosesStalledConnection(t *testing.T) {
+	s := newStallingStandIn(t)
+	defer s.l.Close()
+
+	timeouts := DefaultTimeouts
+	timeouts.Read = 100 * time.Millisecond
+
+	p := newPipeline(s.l.Addr().String(), timeouts, func(ctx context.Context) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, "tcp", s.l.Addr().String())
+	})
+
+	m := new(dns.Msg)
+	m.SetQuestion("a.example.", dns.TypeA)
+
+	if _, _, err := p.Exchange(context.Background(), m); !isTimeout(err) {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+
+	select {
+	case <-s.closed:
+	case <-time.After(time.Second):
+		t.Fatal("the stalled connection has not been closed")
+	}
+
+	resp, _, err := p.Exchange(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Id != m.Id || len(resp.Answer) != 1 {
+		t.Errorf("unexpected response: %v", resp)
+	}
+
+	if conns := atomic.LoadInt32(&s.conns); conns != 2 {
+		t.Errorf("expected a new connection, got %d connections", conns)
+	}
+}
+
+func TestPipelineDialsWithoutLock(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+
+	p := newPipeline("192.0.2.1:53", DefaultTimeouts, func(ctx context.Context) (net.Conn, error) {
+		started <- struct{}{}
+		<-release
+		return nil, errConnClosed
+	})
+
+	m := new(dns.Msg)
+	m.SetQuestion("a.example.", dns.TypeA)
+
+	// blocks in dial until the test ends
+	go p.Exchange(context.Background(), m)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := p.Exchange(ctx, m)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("query blocked by a pending dial")
+	}
+
+	// responses for other queries can still be delivered
+	locked := make(chan struct{})
+	go func() {
+		p.forget(1)
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("pipeline locked while dialing")
+	}
+}
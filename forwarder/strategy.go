@@ -0,0 +1,94 @@
+package forwarder
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+)
+
+// Strategy selects the order in which upstream servers are queried
+type Strategy string
+
+// Available strategies
+const (
+	// StrategySequential queries upstreams in configuration order
+	StrategySequential = Strategy("sequential")
+
+	// StrategyRoundRobin rotates the first upstream to query with each request
+	StrategyRoundRobin = Strategy("round-robin")
+
+	// StrategyRandom queries upstreams in random order
+	StrategyRandom = Strategy("random")
+
+	// StrategyLowestLatency prefers upstreams with the lowest average
+	// round-trip time
+	StrategyLowestLatency = Strategy("lowest-latency")
+
+	// StrategyRace sends the query to the fastest upstreams in parallel
+	// and uses the first valid answer
+	StrategyRace = Strategy("race")
+)
+
+// ParseStrategy parses the name of a load-balancing strategy
+func ParseStrategy(s string) (Strategy, error) {
+	switch st := Strategy(s); st {
+	case StrategySequential, StrategyRoundRobin, StrategyRandom, StrategyLowestLatency, StrategyRace:
+		return st, nil
+	}
+
+	return "", fmt.Errorf("unknown forwarding strategy: %q", s)
+}
+
+// WithStrategy sets the strategy used to select upstream servers
+func (f *Forwarder) WithStrategy(s Strategy) *Forwarder {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+
+	f.strategy = s
+
+	return f
+}
+
+// WithRaceCount sets the number of upstreams that are queried in parallel
+// when using StrategyRace
+func (f *Forwarder) WithRaceCount(n int) *Forwarder {
+	f.rw.Lock()
+	defer f.rw.Unlock()
+
+	f.raceCount = n
+
+	return f
+}
+
+// order sorts upstreams according to the configured strategy
+func (f *Forwarder) order(upstreams []*upstream) []*upstream {
+	f.rw.RLock()
+	strategy := f.strategy
+	f.rw.RUnlock()
+
+	ordered := make([]*upstream, len(upstreams))
+	copy(ordered, upstreams)
+
+	if len(ordered) < 2 {
+		return ordered
+	}
+
+	switch strategy {
+	case StrategyRoundRobin:
+		offset := int(atomic.AddUint64(&f.next, 1) % uint64(len(ordered)))
+		ordered = append(ordered[offset:], ordered[:offset]...)
+
+	case StrategyRandom:
+		rand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+
+	case StrategyLowestLatency, StrategyRace:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].latency() < ordered[j].latency()
+		})
+	}
+
+	return ordered
+}
@@ -0,0 +1,117 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"time"
+)
+
+// newTLSTransport returns a DNS over TLS (RFC 7858) transport for u. The
+// following query parameters are supported:
+//
+//	servername  name used for SNI and certificate verification. Defaults
+//	            to the host of the URL
+//	ca          file containing PEM encoded CA certificates to trust instead
+//	            of the system roots
+//	pin         base64 encoded SHA-256 hash of a trusted SubjectPublicKeyInfo
+//	            (RFC 7469). May be repeated
+func newTLSTransport(u *url.URL, t Timeouts) (transport, error) {
+	addr := withPort(u.Host, "853")
+
+	cfg, err := tlsConfig(u)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout: t.Dial,
+	}
+
+	return newPool(addr, t, func(ctx context.Context) (net.Conn, error) {
+		raw, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		conn := tls.Client(raw, cfg)
+		conn.SetDeadline(deadline(ctx, t.Dial))
+
+		if err := conn.Handshake(); err != nil {
+			raw.Close()
+			return nil, err
+		}
+
+		conn.SetDeadline(time.Time{})
+
+		return conn, nil
+	}), nil
+}
+
+// tlsConfig builds the TLS client configuration for the upstream URL u
+func tlsConfig(u *url.URL) (*tls.Config, error) {
+	params := u.Query()
+
+	cfg := &tls.Config{
+		ServerName: params.Get("servername"),
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+
+	if ca := params.Get("ca"); ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", ca)
+		}
+
+		cfg.RootCAs = pool
+	}
+
+	if pins := params["pin"]; len(pins) > 0 {
+		hashes := make(map[[sha256.Size]byte]bool)
+
+		for _, pin := range pins {
+			raw, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SPKI pin %q: %s", pin, err)
+			}
+
+			if len(raw) != sha256.Size {
+				return nil, fmt.Errorf("invalid SPKI pin %q: not a SHA-256 hash", pin)
+			}
+
+			var h [sha256.Size]byte
+			copy(h[:], raw)
+			hashes[h] = true
+		}
+
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			for _, chain := range chains {
+				for _, cert := range chain {
+					if hashes[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+						return nil
+					}
+				}
+			}
+
+			return errors.New("no certificate matches the configured SPKI pins")
+		}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,239 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tlsStandIn is a local DNS over TLS server used as upstream in tests
+type tlsStandIn struct {
+	addr   string
+	caFile string
+	pin    string
+	conns  int32
+
+	srv *dns.Server
+	dir string
+}
+
+// countingListener counts the accepted connections
+type countingListener struct {
+	net.Listener
+	conns *int32
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(l.conns, 1)
+	}
+
+	return c, err
+}
+
+// newTLSStandIn starts a DNS over TLS server with a self-signed certificate
+// for dns.test that answers every A query with 192.0.2.1
+func newTLSStandIn(t *testing.T) *tlsStandIn {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.test"},
+		DNSNames:              []string{"dns.test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "dnswall-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &tlsStandIn{
+		caFile: filepath.Join(dir, "ca.pem"),
+		dir:    dir,
+	}
+
+	if err := ioutil.WriteFile(s.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pin := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	s.pin = base64.StdEncoding.EncodeToString(pin[:])
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.addr = l.Addr().String()
+	s.srv = &dns.Server{
+		Listener: countingListener{Listener: l, conns: &s.conns},
+		Net:      "tcp-tls",
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+
+			rr, _ := dns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+			m.Answer = []dns.RR{rr}
+
+			// keep queries in flight so they are pipelined
+			time.Sleep(10 * time.Millisecond)
+			w.WriteMsg(m)
+		}),
+	}
+
+	go s.srv.ActivateAndServe()
+
+	return s
+}
+
+// url returns the upstream URL of the stand-in with the given parameters
+func (s *tlsStandIn) url(params url.Values) string {
+	return "tls://" + s.addr + "?" + params.Encode()
+}
+
+func (s *tlsStandIn) close() {
+	s.srv.Shutdown()
+	os.RemoveAll(s.dir)
+}
+
+func TestTLSTransportPipelinesQueries(t *testing.T) {
+	s := newTLSStandIn(t)
+	defer s.close()
+
+	u, _ := url.Parse(s.url(url.Values{"servername": {"dns.test"}, "ca": {s.caFile}, "pin": {s.pin}}))
+
+	timeouts := DefaultTimeouts
+	timeouts.PoolSize = 1
+
+	tr, err := newTLSTransport(u, timeouts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			m := new(dns.Msg)
+			m.SetQuestion("a.example.", dns.TypeA)
+			m.Id = uint16(i * 7)
+
+			resp, _, err := tr.Exchange(context.Background(), m)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			if resp.Id != m.Id {
+				t.Errorf("expected response id %d, got %d", m.Id, resp.Id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if conns := atomic.LoadInt32(&s.conns); conns != 1 {
+		t.Errorf("expected queries to share one connection, got %d", conns)
+	}
+}
+
+func TestTLSTransportVerification(t *testing.T) {
+	s := newTLSStandIn(t)
+	defer s.close()
+
+	wrongPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	cases := []struct {
+		name   string
+		params url.Values
+		ok     bool
+	}{
+		{"trusted CA", url.Values{"servername": {"dns.test"}, "ca": {s.caFile}}, true},
+		{"system roots", url.Values{"servername": {"dns.test"}}, false},
+		{"wrong server name", url.Values{"servername": {"other.test"}, "ca": {s.caFile}}, false},
+		{"matching pin", url.Values{"servername": {"dns.test"}, "ca": {s.caFile}, "pin": {wrongPin, s.pin}}, true},
+		{"wrong pin", url.Values{"servername": {"dns.test"}, "ca": {s.caFile}, "pin": {wrongPin}}, false},
+	}
+
+	for _, c := range cases {
+		u, _ := url.Parse(s.url(c.params))
+
+		tr, err := newTLSTransport(u, DefaultTimeouts)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("a.example.", dns.TypeA)
+
+		_, _, err = tr.Exchange(context.Background(), m)
+		if c.ok && err != nil {
+			t.Errorf("%s: unexpected error: %s", c.name, err)
+		}
+
+		if !c.ok && err == nil {
+			t.Errorf("%s: expected verification to fail", c.name)
+		}
+	}
+}
+
+func TestForwarderTLSUpstream(t *testing.T) {
+	s := newTLSStandIn(t)
+	defer s.close()
+
+	f, err := New([]string{s.url(url.Values{"servername": {"dns.test"}, "ca": {s.caFile}})}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := f.Resolve(context.Background(), "www.example.", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "192.0.2.1" {
+		t.Fatalf("unexpected answer: %v", resp.Answer)
+	}
+}
@@ -0,0 +1,289 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Timeouts configures timeouts for queries sent to upstream servers
+type Timeouts struct {
+	// Dial is the timeout for establishing a connection (including the
+	// TLS handshake)
+	Dial time.Duration
+
+	// Read is the timeout for receiving a response after the query
+	// has been sent
+	Read time.Duration
+
+	// Write is the timeout for sending a query
+	Write time.Duration
+
+	// PoolSize is the number of stream (TCP and TLS) connections kept open
+	// to each upstream. Queries are pipelined on each connection
+	PoolSize int
+}
+
+// DefaultTimeouts are used for upstreams unless configured otherwise
+var DefaultTimeouts = Timeouts{
+	Dial:     2 * time.Second,
+	Read:     2 * time.Second,
+	Write:    2 * time.Second,
+	PoolSize: 2,
+}
+
+// transportParams are query parameters supported by all upstream URLs
+var transportParams = []string{"dial-timeout", "read-timeout", "write-timeout", "pool"}
+
+// transport sends DNS queries to an upstream server
+type transport interface {
+	// Exchange sends msg to the upstream and returns the response together
+	// with the round-trip time
+	Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error)
+}
+
+// newTransport returns the transport for the upstream address addr. addr is
+// either a plain host:port (DNS over UDP with TCP fallback) or a URL with
+// one of the following schemes:
+//
+//	udp://host[:port]  DNS over UDP with TCP fallback
+//	tcp://host[:port]  DNS over TCP
+//	tls://host[:port]  DNS over TLS (RFC 7858)
+//	https://host/path  DNS over HTTPS (RFC 8484)
+//
+// URLs may override the timeouts t using the dial-timeout, read-timeout and
+// write-timeout query parameters and the connection pool size using pool.
+// Truncated responses retried over TCP are recorded in m
+func newTransport(addr string, t Timeouts, m *metrics) (transport, error) {
+	if !strings.Contains(addr, "://") {
+		return newDNSTransport(withPort(addr, "53"), "", t, m), nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Host == "" {
+		return nil, errors.New("missing host")
+	}
+
+	t, err = urlTimeouts(u, t)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "udp":
+		return newDNSTransport(withPort(u.Host, "53"), "", t, m), nil
+	case "tcp":
+		return newDNSTransport(withPort(u.Host, "53"), "tcp", t, m), nil
+	case "tls":
+		return newTLSTransport(u, t)
+	case "https":
+		return newHTTPSTransport(u, t)
+	}
+
+	return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+}
+
+// urlTimeouts applies the timeouts configured in the query parameters of
+// u to t
+func urlTimeouts(u *url.URL, t Timeouts) (Timeouts, error) {
+	params := u.Query()
+
+	for key, d := range map[string]*time.Duration{
+		"dial-timeout":  &t.Dial,
+		"read-timeout":  &t.Read,
+		"write-timeout": &t.Write,
+	} {
+		if v := params.Get(key); v != "" {
+			var err error
+			if *d, err = time.ParseDuration(v); err != nil {
+				return t, fmt.Errorf("invalid %s: %s", key, err)
+			}
+		}
+	}
+
+	if v := params.Get("pool"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 1 {
+			return t, fmt.Errorf("invalid pool size %q", v)
+		}
+
+		t.PoolSize = size
+	}
+
+	return t, nil
+}
+
+// withPort appends port to host if it does not specify one
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// dnsTransport sends queries using plain DNS. If net is empty, UDP is used
+// and truncated responses are retried over TCP
+type dnsTransport struct {
+	addr     string
+	net      string
+	timeouts Timeouts
+	dialer   *net.Dialer
+	tcp      *pool
+	metrics  *metrics
+}
+
+// newDNSTransport returns a plain DNS transport for addr. Queries sent over
+// TCP are pipelined on a pool of persistent connections
+func newDNSTransport(addr, network string, t Timeouts, m *metrics) *dnsTransport {
+	dialer := &net.Dialer{
+		Timeout: t.Dial,
+	}
+
+	return &dnsTransport{
+		addr:     addr,
+		net:      network,
+		timeouts: t,
+		dialer:   dialer,
+		metrics:  m,
+		tcp: newPool(addr, t, func(ctx context.Context) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", addr)
+		}),
+	}
+}
+
+// Exchange implements transport
+func (t *dnsTransport) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	if t.net == "tcp" {
+		return t.tcp.Exchange(ctx, msg)
+	}
+
+	resp, rtt, err := t.exchangeUDP(ctx, msg)
+	if err == nil && resp.Truncated {
+		log.Printf("[forwarder] %s: truncated response for %q, retrying over TCP\n", t.addr, msg.Question[0].Name)
+		t.metrics.truncation()
+
+		return t.tcp.Exchange(ctx, msg)
+	}
+
+	return resp, rtt, err
+}
+
+// exchangeUDP sends msg using a new UDP socket. The socket is closed as soon
+// as ctx is cancelled
+func (t *dnsTransport) exchangeUDP(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	c, err := t.dialer.DialContext(ctx, "udp", t.addr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	conn := &dns.Conn{Conn: c}
+	defer conn.Close()
+
+	if opt := msg.IsEdns0(); opt != nil {
+		conn.UDPSize = opt.UDPSize()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	start := time.Now()
+
+	conn.SetWriteDeadline(deadline(ctx, t.timeouts.Write))
+	if err := conn.WriteMsg(msg); err != nil {
+		return nil, 0, contextError(ctx, err)
+	}
+
+	conn.SetReadDeadline(deadline(ctx, t.timeouts.Read))
+
+	for {
+		resp, err := conn.ReadMsg()
+		if err == dns.ErrTruncated && resp != nil {
+			// we still get the partial message so the caller can
+			// retry over TCP
+			err = nil
+		}
+
+		if err != nil {
+			return nil, 0, contextError(ctx, err)
+		}
+
+		// ignore responses that do not belong to our query
+		if resp.Id == msg.Id {
+			return resp, time.Since(start), nil
+		}
+	}
+}
+
+// deadline returns the time after timeout or the deadline of ctx, whichever
+// is earlier
+func deadline(ctx context.Context, timeout time.Duration) time.Time {
+	d := time.Now().Add(timeout)
+
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(d) {
+		return ctxDeadline
+	}
+
+	return d
+}
+
+// contextError returns the error of ctx if it has been cancelled and err
+// otherwise
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+
+	return err
+}
+
+// pool distributes queries over a fixed number of pipelined stream
+// connections
+type pool struct {
+	pipelines []*pipeline
+	next      uint64
+}
+
+// newPool returns a new pool of t.PoolSize pipelines using dial to connect
+// to the upstream
+func newPool(addr string, t Timeouts, dial func(ctx context.Context) (net.Conn, error)) *pool {
+	size := t.PoolSize
+	if size < 1 {
+		size = 1
+	}
+
+	p := &pool{}
+	for i := 0; i < size; i++ {
+		p.pipelines = append(p.pipelines, newPipeline(addr, t, dial))
+	}
+
+	return p
+}
+
+// Exchange implements transport
+func (p *pool) Exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, time.Duration, error) {
+	idx := atomic.AddUint64(&p.next, 1) % uint64(len(p.pipelines))
+
+	return p.pipelines[idx].Exchange(ctx, msg)
+}
@@ -0,0 +1,252 @@
+package forwarder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Zone is an entry of a ZoneTable. Requests for Suffix and all its
+// sub-domains are sent to Servers
+type Zone struct {
+	// Suffix is the domain the entry applies to
+	Suffix string
+
+	// Servers is the upstream group used for the zone. Servers accept the
+	// same formats as static forwarders
+	Servers []string
+
+	// Stub marks the servers as authoritative for the zone. Requests are
+	// sent without the RD bit (stub-zone) instead of being forwarded to
+	// recursive resolvers (forward-zone)
+	Stub bool
+}
+
+// ZoneTable maps domain suffixes to upstream groups. Lookups are performed
+// using a trie of labels and the longest matching suffix wins
+type ZoneTable struct {
+	root  *zoneNode
+	zones []*Zone
+}
+
+// zoneNode is a node of the label trie of a ZoneTable
+type zoneNode struct {
+	children map[string]*zoneNode
+	zone     *Zone
+}
+
+// NewZoneTable returns a new, empty zone table
+func NewZoneTable() *ZoneTable {
+	return &ZoneTable{
+		root: &zoneNode{},
+	}
+}
+
+// Add adds zone to the table. Each suffix may only be added once
+func (t *ZoneTable) Add(zone Zone) error {
+	if _, ok := dns.IsDomainName(zone.Suffix); !ok {
+		return fmt.Errorf("invalid zone %q", zone.Suffix)
+	}
+
+	if len(zone.Servers) == 0 {
+		return fmt.Errorf("zone %q: no servers configured", zone.Suffix)
+	}
+
+	zone.Suffix = strings.ToLower(dns.Fqdn(zone.Suffix))
+
+	node := t.root
+	labels := dns.SplitDomainName(zone.Suffix)
+
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = make(map[string]*zoneNode)
+		}
+
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &zoneNode{}
+			node.children[labels[i]] = child
+		}
+
+		node = child
+	}
+
+	if node.zone != nil {
+		return fmt.Errorf("duplicate zone %q", zone.Suffix)
+	}
+
+	node.zone = &zone
+	t.zones = append(t.zones, &zone)
+
+	return nil
+}
+
+// Lookup returns the zone with the longest suffix matching name
+func (t *ZoneTable) Lookup(name string) (Zone, bool) {
+	match := t.root.zone
+	node := t.root
+
+	labels := dns.SplitDomainName(strings.ToLower(name))
+
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			break
+		}
+
+		node = child
+
+		if node.zone != nil {
+			match = node.zone
+		}
+	}
+
+	if match == nil {
+		return Zone{}, false
+	}
+
+	return *match, true
+}
+
+// Zones returns all zones of the table in the order they have been added
+func (t *ZoneTable) Zones() []Zone {
+	zones := make([]Zone, len(t.zones))
+	for i, z := range t.zones {
+		zones[i] = *z
+	}
+
+	return zones
+}
+
+// Len returns the number of zones in the table
+func (t *ZoneTable) Len() int {
+	return len(t.zones)
+}
+
+// ParseZoneTable adds the zones read from r to the table. Each line holds
+// a domain suffix followed by one or more upstream servers. Lines may start
+// with the keyword "forward" (default) or "stub" to select the zone type.
+// Comments start with '#' or ';':
+//
+//	# suffix            servers
+//	corp.example        10.0.0.1 10.0.0.2:5353
+//	stub lab.example    10.0.1.1
+//	forward .           tls://1.1.1.1
+func (t *ZoneTable) ParseZoneTable(r io.Reader) error {
+	return scanLines(r, func(fields []string) error {
+		zone := Zone{}
+
+		if len(fields) > 2 {
+			switch fields[0] {
+			case "stub":
+				zone.Stub = true
+				fields = fields[1:]
+			case "forward":
+				fields = fields[1:]
+			}
+		}
+
+		if len(fields) < 2 {
+			return fmt.Errorf("expected a domain followed by servers")
+		}
+
+		zone.Suffix = fields[0]
+		zone.Servers = fields[1:]
+
+		return t.Add(zone)
+	})
+}
+
+// ParseResolvConf adds the zones read from r in resolv.conf(5) syntax to the
+// table. All name servers are used for the domains listed by the "domain"
+// and "search" keywords, or for all domains if there is none. Other keywords
+// are ignored:
+//
+//	search corp.example lab.example
+//	nameserver 10.0.0.1
+//	nameserver 10.0.0.2
+func (t *ZoneTable) ParseResolvConf(r io.Reader) error {
+	var domains, servers []string
+
+	err := scanLines(r, func(fields []string) error {
+		switch fields[0] {
+		case "nameserver":
+			if len(fields) != 2 {
+				return fmt.Errorf("expected a single address after nameserver")
+			}
+
+			servers = append(servers, fields[1])
+
+		case "domain", "search":
+			domains = append(domains, fields[1:]...)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(domains) == 0 {
+		domains = []string{"."}
+	}
+
+	for _, d := range domains {
+		if err := t.Add(Zone{Suffix: d, Servers: servers}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadZoneTable adds the zones of file to the table. If resolvConf is set, the
+// file is expected to use resolv.conf(5) syntax
+func (t *ZoneTable) ReadZoneTable(file string, resolvConf bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if resolvConf {
+		err = t.ParseResolvConf(f)
+	} else {
+		err = t.ParseZoneTable(f)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+
+	return nil
+}
+
+// scanLines calls fn with the whitespace separated fields of each line of r
+// that is neither empty nor a comment
+func scanLines(r io.Reader, fn func(fields []string) error) error {
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if idx := strings.IndexAny(text, "#;"); idx >= 0 {
+			text = text[:idx]
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if err := fn(fields); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,111 @@
+package management
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/homebot/dnswall/cache"
+	"github.com/miekg/dns"
+)
+
+// CacheEntry is the representation of a cached resource record returned
+// by the management API
+type CacheEntry struct {
+	Name    string    `json:"name"`
+	Class   string    `json:"class"`
+	Type    string    `json:"type"`
+	TTL     int64     `json:"ttl"`
+	Expires time.Time `json:"expires"`
+	Secure  bool      `json:"secure"`
+	Subnet  string    `json:"subnet,omitempty"`
+	Record  string    `json:"record"`
+}
+
+// subnet returns the client subnet rr is scoped to or an empty string
+func subnet(rr cache.RR) string {
+	if rr.Subnet == nil {
+		return ""
+	}
+
+	return rr.Subnet.String()
+}
+
+// CacheHandler returns a http.Handler for inspecting and flushing c. It
+// should be mounted at "/cache/" and serves the following endpoints:
+//
+//	GET    /cache/stats                  returns cache statistics
+//	GET    /cache/entries?name=<name>    lists the records cached for name
+//	DELETE /cache/entries?name=<name>    flushes all records for name
+//	DELETE /cache/entries?suffix=<name>  flushes name and all sub-domains
+//	DELETE /cache/entries?all=true       flushes the whole cache
+func CacheHandler(c *cache.Cache) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/cache/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, c.Stats())
+	})
+
+	mux.HandleFunc("/cache/entries", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		suffix := r.URL.Query().Get("suffix")
+		all := r.URL.Query().Get("all") == "true"
+
+		switch r.Method {
+		case http.MethodGet:
+			if name == "" {
+				writeError(w, http.StatusBadRequest, "missing name parameter")
+				return
+			}
+
+			entries := []CacheEntry{}
+			for _, rr := range c.Entries(name) {
+				hdr := rr.Header()
+				entries = append(entries, CacheEntry{
+					Name:    hdr.Name,
+					Class:   dns.Class(hdr.Class).String(),
+					Type:    dns.Type(hdr.Rrtype).String(),
+					TTL:     int64(time.Until(rr.Expires()) / time.Second),
+					Expires: rr.Expires(),
+					Secure:  rr.Secure,
+					Subnet:  subnet(rr),
+					Record:  rr.String(),
+				})
+			}
+
+			writeJSON(w, http.StatusOK, entries)
+
+		case http.MethodDelete:
+			var count int
+
+			switch {
+			case name != "" && suffix != "", all && (name != "" || suffix != ""):
+				writeError(w, http.StatusBadRequest, "name, suffix and all are mutually exclusive")
+				return
+			case name != "":
+				count = c.Flush(name)
+			case suffix != "":
+				count = c.FlushSuffix(suffix)
+			case all:
+				count = c.FlushAll()
+			default:
+				// do not flush the whole cache by accident
+				writeError(w, http.StatusBadRequest, "missing name, suffix or all=true parameter")
+				return
+			}
+
+			writeJSON(w, http.StatusOK, map[string]int{
+				"flushed": count,
+			})
+
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	})
+
+	return mux
+}
@@ -0,0 +1,131 @@
+package management
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/homebot/dnswall/cache"
+)
+
+// newTestCache returns a cache restored from a snapshot holding the given
+// records
+func newTestCache(t *testing.T, records ...string) *cache.Cache {
+	snapshot := fmt.Sprintf("; dnswall cache snapshot %d\n%s\n", time.Now().Unix(), strings.Join(records, "\n"))
+
+	c := cache.New()
+	if err := c.ReadSnapshot(strings.NewReader(snapshot)); err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// do sends a request to h and decodes the JSON response into v
+func do(t *testing.T, h http.Handler, method, target string, v interface{}) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+
+	if v != nil && w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: %s", method, target, err)
+		}
+	}
+
+	return w.Code
+}
+
+var testRecords = []string{
+	"example.com. 300 IN A 192.0.2.1",
+	"example.com. 300 IN AAAA 2001:db8::1 ; secure subnet=192.0.2.0/24",
+	"www.example.com. 300 IN A 192.0.2.2",
+	"example.org. 300 IN A 198.51.100.1",
+}
+
+func TestCacheHandlerEntries(t *testing.T) {
+	h := CacheHandler(newTestCache(t, testRecords...))
+
+	var entries []CacheEntry
+	if code := do(t, h, http.MethodGet, "/cache/entries?name=example.com", &entries); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", entries)
+	}
+
+	for _, e := range entries {
+		switch e.Type {
+		case "A":
+			if e.Secure || e.Subnet != "" || e.TTL <= 0 || e.TTL > 300 || !strings.HasSuffix(e.Record, "192.0.2.1") {
+				t.Errorf("unexpected entry %+v", e)
+			}
+		case "AAAA":
+			if !e.Secure || e.Subnet != "192.0.2.0/24" || e.Name != "example.com." {
+				t.Errorf("unexpected entry %+v", e)
+			}
+		default:
+			t.Errorf("unexpected entry %+v", e)
+		}
+	}
+
+	if code := do(t, h, http.MethodGet, "/cache/entries?name=other.example.com", &entries); code != http.StatusOK || len(entries) != 0 {
+		t.Errorf("expected no entries, got %d %v", code, entries)
+	}
+
+	if code := do(t, h, http.MethodGet, "/cache/entries", nil); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 without name, got %d", code)
+	}
+
+	var stats cache.Stats
+	if code := do(t, h, http.MethodGet, "/cache/stats", &stats); code != http.StatusOK || stats.Records != len(testRecords) {
+		t.Errorf("unexpected stats: %d %+v", code, stats)
+	}
+}
+
+func TestCacheHandlerFlush(t *testing.T) {
+	cases := []struct {
+		query   string
+		code    int
+		flushed int
+	}{
+		{"", http.StatusBadRequest, 0},
+		{"?all=false", http.StatusBadRequest, 0},
+		{"?name=example.com&suffix=example.com", http.StatusBadRequest, 0},
+		{"?name=example.com&all=true", http.StatusBadRequest, 0},
+		{"?name=example.com", http.StatusOK, 2},
+		{"?name=other.example.com", http.StatusOK, 0},
+		{"?suffix=example.com", http.StatusOK, 3},
+		{"?all=true", http.StatusOK, 4},
+	}
+
+	for _, c := range cases {
+		ca := newTestCache(t, testRecords...)
+		h := CacheHandler(ca)
+
+		var res map[string]int
+		if code := do(t, h, http.MethodDelete, "/cache/entries"+c.query, &res); code != c.code {
+			t.Errorf("DELETE %q: expected status %d, got %d", c.query, c.code, code)
+			continue
+		}
+
+		if c.code != http.StatusOK {
+			if records := ca.Stats().Records; records != len(testRecords) {
+				t.Errorf("DELETE %q: expected the cache to be left alone, %d records left", c.query, records)
+			}
+			continue
+		}
+
+		if res["flushed"] != c.flushed {
+			t.Errorf("DELETE %q: expected %d records to be flushed, got %d", c.query, c.flushed, res["flushed"])
+		}
+
+		if records := ca.Stats().Records; records != len(testRecords)-c.flushed {
+			t.Errorf("DELETE %q: expected %d records left, got %d", c.query, len(testRecords)-c.flushed, records)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package management
+
+import (
+	"net/http"
+
+	"github.com/homebot/dnswall/forwarder"
+)
+
+// ForwarderHandler returns a http.Handler reporting the state of the
+// upstream servers of f. It should be mounted at "/forwarder/" and serves
+// the following endpoints:
+//
+//	GET /forwarder/upstreams  returns the health status of all upstreams
+//	GET /forwarder/metrics    returns query counters and latency histograms
+//	                          of all upstreams
+func ForwarderHandler(f *forwarder.Forwarder) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/forwarder/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, f.Upstreams())
+	})
+
+	mux.HandleFunc("/forwarder/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, f.Metrics())
+	})
+
+	return mux
+}
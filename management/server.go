@@ -0,0 +1,56 @@
+package management
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Server is the HTTP transport of the management API
+type Server struct {
+	mux *http.ServeMux
+	srv *http.Server
+}
+
+// New returns a new management API server listening on addr
+func New(addr string) *Server {
+	mux := http.NewServeMux()
+
+	return &Server{
+		mux: mux,
+		srv: &http.Server{
+			Addr:    addr,
+			Handler: mux,
+		},
+	}
+}
+
+// Handle registers the handler for the given pattern
+func (s *Server) Handle(pattern string, handler http.Handler) *Server {
+	s.mux.Handle(pattern, handler)
+
+	return s
+}
+
+// ListenAndServe starts serving the management API. It blocks until
+// the server has been stopped
+func (s *Server) ListenAndServe() error {
+	return s.srv.ListenAndServe()
+}
+
+// writeJSON encodes v as JSON and sends it to the client
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[management] failed to encode response: %s\n", err)
+	}
+}
+
+// writeError sends an error message to the client
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{
+		"error": msg,
+	})
+}
@@ -0,0 +1,50 @@
+package management
+
+import (
+	"net/http"
+
+	"github.com/homebot/dnswall/zone"
+)
+
+// ZoneHandler returns a http.Handler for inspecting and reloading the zones
+// served by p. It should be mounted at "/zones/" and serves the following
+// endpoints:
+//
+//	GET  /zones/status                 returns the status of all zones
+//	POST /zones/reload?name=<origin>   reloads a zone from its file
+//	POST /zones/reload                 reloads all zones
+func ZoneHandler(p *zone.Provider) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/zones/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, p.Zones())
+	})
+
+	mux.HandleFunc("/zones/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		var err error
+		if name := r.URL.Query().Get("name"); name != "" {
+			err = p.Reload(name)
+		} else {
+			err = p.ReloadAll()
+		}
+
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusOK, p.Zones())
+	})
+
+	return mux
+}
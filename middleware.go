@@ -41,6 +41,10 @@ type Session struct {
 
 	ended bool
 
+	// hijacked is set if a middleware wrote to the client directly, e.g.
+	// to stream a zone transfer. No response is sent by the session then
+	hijacked bool
+
 	onComplete []CompleteFunc
 }
 
@@ -83,6 +87,7 @@ func (s *Session) RemoteAddr() net.Addr {
 // Next(), Resolve(), .. fail
 func (s *Session) WriteMsg(msg *dns.Msg) error {
 	s.ended = true
+	s.hijacked = true
 	return s.w.WriteMsg(msg)
 }
 
@@ -90,12 +95,14 @@ func (s *Session) WriteMsg(msg *dns.Msg) error {
 // ended
 func (s *Session) Write(buf []byte) (int, error) {
 	s.ended = true
+	s.hijacked = true
 	return s.w.Write(buf)
 }
 
 // Hijack the session and marks it as ended. See dns.ResponseWriter
 func (s *Session) Hijack() {
 	s.ended = true
+	s.hijacked = true
 	s.w.Hijack()
 }
 
@@ -123,6 +130,13 @@ func (s *Session) Prepare() *dns.Msg {
 	return m
 }
 
+// Response returns the response for the request or nil if the session has
+// not been resolved yet. Middlewares may modify the response after calling
+// Next()
+func (s *Session) Response() *dns.Msg {
+	return s.res
+}
+
 // Run the session, resolve the request and send it back
 func (s *Session) Run(ctx context.Context) error {
 	s.Ctx = ctx
@@ -138,7 +152,7 @@ func (s *Session) Run(ctx context.Context) error {
 		panic("session not ended! A middleware seems to block the chain or returned without a result")
 	}
 
-	if err != nil {
+	if err != nil || s.hijacked {
 		return err
 	}
 
@@ -185,6 +199,37 @@ func (s *Session) Next() error {
 	return s.handlers[s.i].Serve(s, s.req)
 }
 
+// Fork resolves req in a new session using the handlers that follow the
+// current one in the middleware stack and returns the response. Complete
+// handlers registered while serving req are executed before Fork returns.
+// The current session is not affected
+func (s *Session) Fork(req *request.Request) (*dns.Msg, error) {
+	sub := &Session{
+		handlers: s.handlers[s.i+1:],
+		w:        s.w,
+		Ctx:      s.Ctx,
+		req:      req,
+	}
+
+	if len(sub.handlers) == 0 {
+		return nil, ErrNotServed
+	}
+
+	if err := sub.handlers[0].Serve(sub, req); err != nil {
+		return nil, err
+	}
+
+	if !sub.ended || sub.res == nil {
+		return nil, ErrNotServed
+	}
+
+	for _, fn := range sub.onComplete {
+		fn(sub, req, sub.res)
+	}
+
+	return sub.res, nil
+}
+
 // ResolveWith sets the response for the session and ends it
 func (s *Session) ResolveWith(r *dns.Msg) error {
 	if s.ended {
@@ -0,0 +1,63 @@
+package recursor
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultRootHints holds the IPv4 addresses of the IANA root name servers
+var DefaultRootHints = []string{
+	"198.41.0.4:53",     // a.root-servers.net
+	"199.9.14.201:53",   // b.root-servers.net
+	"192.33.4.12:53",    // c.root-servers.net
+	"199.7.91.13:53",    // d.root-servers.net
+	"192.203.230.10:53", // e.root-servers.net
+	"192.5.5.241:53",    // f.root-servers.net
+	"192.112.36.4:53",   // g.root-servers.net
+	"198.97.190.53:53",  // h.root-servers.net
+	"192.36.148.17:53",  // i.root-servers.net
+	"192.58.128.30:53",  // j.root-servers.net
+	"193.0.14.129:53",   // k.root-servers.net
+	"199.7.83.42:53",    // l.root-servers.net
+	"202.12.27.33:53",   // m.root-servers.net
+}
+
+// ParseRootHints parses a root hints file in zone file format (e.g. named.root)
+// and returns the addresses of all A and AAAA records using the given port
+func ParseRootHints(r io.Reader, port string) ([]string, error) {
+	var hints []string
+
+	for token := range dns.ParseZone(r, ".", "") {
+		if token.Error != nil {
+			return nil, token.Error
+		}
+
+		switch rr := token.RR.(type) {
+		case *dns.A:
+			hints = append(hints, net.JoinHostPort(rr.A.String(), port))
+		case *dns.AAAA:
+			hints = append(hints, net.JoinHostPort(rr.AAAA.String(), port))
+		}
+	}
+
+	if len(hints) == 0 {
+		return nil, errors.New("no root server addresses found")
+	}
+
+	return hints, nil
+}
+
+// ReadRootHints parses the root hints file f
+func ReadRootHints(f string, port string) ([]string, error) {
+	r, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ParseRootHints(r, port)
+}
@@ -0,0 +1,485 @@
+package recursor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/homebot/dnswall"
+	"github.com/homebot/dnswall/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxIterations limits the number of queries sent while resolving
+	// a single name
+	maxIterations = 30
+
+	// maxDepth limits the nesting of resolutions required to follow CNAME
+	// chains and to resolve name servers without glue
+	maxDepth = 8
+)
+
+var (
+	// ErrMaxDepth is returned if resolving a name requires too many nested
+	// resolutions (e.g. long CNAME chains)
+	ErrMaxDepth = errors.New("maximum recursion depth exceeded")
+
+	// ErrMaxIterations is returned if resolving a name requires too many
+	// referrals
+	ErrMaxIterations = errors.New("too many referrals")
+)
+
+// delegation is a cached zone cut together with the addresses of its
+// name servers
+type delegation struct {
+	servers []string
+	expires time.Time
+}
+
+// Recursor is a DNS server middleware that iteratively resolves requests
+// starting at the root name servers
+type Recursor struct {
+	hints    []string
+	port     string
+	minimize bool
+	dnssec   bool
+	timeout  time.Duration
+
+	rw    sync.RWMutex
+	infra map[string]delegation
+}
+
+// New returns a new recursor middleware using the given root hints. Hints
+// are addresses in host:port format. If no hints are given,
+// DefaultRootHints is used
+func New(hints ...string) *Recursor {
+	if len(hints) == 0 {
+		hints = DefaultRootHints
+	}
+
+	return &Recursor{
+		hints:    hints,
+		port:     "53",
+		minimize: true,
+		timeout:  2 * time.Second,
+		infra:    make(map[string]delegation),
+	}
+}
+
+// WithPort sets the port used to contact name servers learned from
+// referrals. Defaults to 53
+func (r *Recursor) WithPort(port string) *Recursor {
+	r.port = port
+	return r
+}
+
+// WithQNameMinimization enables or disables QNAME minimization (RFC 9156).
+// It is enabled by default
+func (r *Recursor) WithQNameMinimization(enabled bool) *Recursor {
+	r.minimize = enabled
+	return r
+}
+
+// WithDNSSEC enables or disables requesting DNSSEC records (RRSIG, NSEC and
+// NSEC3) from authoritative servers. It is required for validation
+func (r *Recursor) WithDNSSEC(enabled bool) *Recursor {
+	r.dnssec = enabled
+	return r
+}
+
+// WithTimeout sets the timeout for a single query sent to a name server
+func (r *Recursor) WithTimeout(d time.Duration) *Recursor {
+	r.timeout = d
+	return r
+}
+
+// Name returns "recursor" and implements dnswall.Middleware
+func (r *Recursor) Name() string {
+	return "recursor"
+}
+
+// Serve resolves the request starting at the closest known delegation and
+// implements dnswall.Middleware
+func (r *Recursor) Serve(session *dnswall.Session, req *request.Request) error {
+	resp, err := r.Resolve(session.Ctx, req.Name().String(), uint16(req.Type()))
+	if err != nil {
+		log.Printf("[recursor] failed to resolve %q (%s): %s\n", req.Name(), req.Type(), err)
+		return session.Reject(dns.RcodeServerFailure)
+	}
+
+	// the AD bit is left to the DNSSEC validator
+	m := session.Prepare()
+	m.RecursionAvailable = true
+	m.AuthenticatedData = false
+	m.Rcode = resp.Rcode
+	m.Answer = resp.Answer
+	m.Ns = resp.Ns
+
+	return session.ResolveWith(m)
+}
+
+// Resolve iteratively resolves name and qtype and returns the final
+// response. CNAME chains are followed and included in the answer section
+func (r *Recursor) Resolve(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	return r.resolve(ctx, dns.Fqdn(name), qtype, 0)
+}
+
+func (r *Recursor) resolve(ctx context.Context, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	if depth > maxDepth {
+		return nil, ErrMaxDepth
+	}
+
+	// DS records are served by the parent side of a zone cut
+	closest := name
+	if qtype == dns.TypeDS {
+		closest = "."
+		if n := dns.CountLabel(name); n > 1 {
+			closest = suffix(name, n-1)
+		}
+	}
+
+	zone, servers := r.closest(closest)
+	minimize := r.minimize
+	known := dns.CountLabel(zone)
+	total := dns.CountLabel(name)
+
+	for i := 0; i < maxIterations; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		qname, qt := name, qtype
+
+		// QNAME minimization (RFC 9156): only reveal one more label than
+		// the zone we are currently asking knows about
+		if minimize && known+1 < total {
+			qname, qt = suffix(name, known+1), dns.TypeA
+		}
+
+		resp, err := r.query(ctx, servers, zone, qname, qt)
+		if err != nil {
+			return nil, err
+		}
+
+		if cut := referral(resp, zone, qname); cut != "" {
+			servers, err = r.delegate(ctx, resp, zone, cut, depth)
+			if err != nil {
+				return nil, err
+			}
+
+			zone = cut
+			known = dns.CountLabel(cut)
+			continue
+		}
+
+		if qname != name {
+			// the minimized name is not delegated, continue with the
+			// next label. Some servers answer empty non-terminals with
+			// NXDOMAIN, fall back to the full name in that case
+			if resp.Rcode == dns.RcodeSuccess {
+				known++
+			} else {
+				minimize = false
+			}
+
+			continue
+		}
+
+		return r.followCNAME(ctx, resp, zone, name, qtype, depth)
+	}
+
+	return nil, ErrMaxIterations
+}
+
+// followCNAME follows the CNAME chain starting at name in resp, the
+// response of a server for zone, and resolves the target of the chain if
+// the server did not include it. Records outside of zone are dropped so a
+// server cannot inject records for names it is not authoritative for.
+// Targets outside of zone are resolved starting at their own delegation
+func (r *Recursor) followCNAME(ctx context.Context, resp *dns.Msg, zone, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	resp.Answer = inBailiwick(resp.Answer, zone)
+	resp.Ns = inBailiwick(resp.Ns, zone)
+
+	if resp.Rcode != dns.RcodeSuccess || qtype == dns.TypeCNAME {
+		return resp, nil
+	}
+
+	owner := name
+	for hops := 0; hops <= maxDepth; hops++ {
+		var target string
+
+		for _, rr := range resp.Answer {
+			if !equal(rr.Header().Name, owner) {
+				continue
+			}
+
+			if rr.Header().Rrtype == qtype {
+				return resp, nil
+			}
+
+			if cname, ok := rr.(*dns.CNAME); ok {
+				target = cname.Target
+			}
+		}
+
+		if target == "" {
+			// owner is not an alias, the chain ends here
+			return resp, nil
+		}
+
+		owner = target
+
+		if !hasOwner(resp.Answer, owner) {
+			sub, err := r.resolve(ctx, owner, qtype, depth+1)
+			if err != nil {
+				return nil, err
+			}
+
+			resp.Answer = append(resp.Answer, sub.Answer...)
+			resp.Ns = sub.Ns
+			resp.Rcode = sub.Rcode
+
+			return resp, nil
+		}
+	}
+
+	return nil, ErrMaxDepth
+}
+
+// delegate returns the addresses of the name servers for the zone cut in
+// the referral resp. The delegation is added to the infrastructure cache
+func (r *Recursor) delegate(ctx context.Context, resp *dns.Msg, parent, cut string, depth int) ([]string, error) {
+	var names []string
+	ttl := uint32(0)
+
+	for _, rr := range resp.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok || !equal(ns.Header().Name, cut) {
+			continue
+		}
+
+		names = append(names, ns.Ns)
+
+		if ttl == 0 || ns.Header().Ttl < ttl {
+			ttl = ns.Header().Ttl
+		}
+	}
+
+	var servers []string
+
+	// only accept glue that is within the zone of the server that sent
+	// the referral
+	for _, rr := range resp.Extra {
+		if !dns.IsSubDomain(parent, rr.Header().Name) || !contains(names, rr.Header().Name) {
+			continue
+		}
+
+		switch glue := rr.(type) {
+		case *dns.A:
+			servers = append(servers, net.JoinHostPort(glue.A.String(), r.port))
+		case *dns.AAAA:
+			servers = append(servers, net.JoinHostPort(glue.AAAA.String(), r.port))
+		}
+	}
+
+	// no usable glue, resolve the name servers ourself
+	for _, ns := range names {
+		if len(servers) > 0 {
+			break
+		}
+
+		addrs, err := r.resolve(ctx, ns, dns.TypeA, depth+1)
+		if err != nil {
+			log.Printf("[recursor] failed to resolve name server %q for %q: %s\n", ns, cut, err)
+			continue
+		}
+
+		for _, rr := range addrs.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				servers = append(servers, net.JoinHostPort(a.A.String(), r.port))
+			}
+		}
+	}
+
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no reachable name servers for %q", cut)
+	}
+
+	r.rw.Lock()
+	r.infra[dns.Fqdn(cut)] = delegation{
+		servers: servers,
+		expires: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	r.rw.Unlock()
+
+	return servers, nil
+}
+
+// closest returns the closest cached delegation for name. If no delegation
+// is cached, the root hints are returned
+func (r *Recursor) closest(name string) (string, []string) {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+
+	now := time.Now()
+
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		zone := dns.Fqdn(name[off:])
+
+		d, ok := r.infra[zone]
+		if !ok {
+			continue
+		}
+
+		if now.After(d.expires) {
+			delete(r.infra, zone)
+			continue
+		}
+
+		return zone, d.servers
+	}
+
+	return ".", r.hints
+}
+
+// query sends the question to servers until one of them returns a usable
+// response. Servers that fail, refuse the query or return an invalid
+// referral for zone are considered lame and skipped. Queries do not outlive
+// the deadline of ctx
+func (r *Recursor) query(ctx context.Context, servers []string, zone, qname string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(qname, qtype)
+	m.RecursionDesired = false
+	m.SetEdns0(1232, r.dnssec)
+
+	for _, srv := range servers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		timeout := r.timeout
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < timeout {
+			timeout = time.Until(deadline)
+		}
+
+		c := &dns.Client{
+			Timeout: timeout,
+		}
+
+		resp, _, err := c.Exchange(m, srv)
+		if err == nil && resp.Truncated {
+			c.Net = "tcp"
+			resp, _, err = c.Exchange(m, srv)
+		}
+
+		if err != nil {
+			log.Printf("[recursor] %s: failed to query %q: %s\n", srv, qname, err)
+			continue
+		}
+
+		if lame(resp, zone) {
+			log.Printf("[recursor] %s: lame delegation for %q\n", srv, zone)
+			continue
+		}
+
+		return resp, nil
+	}
+
+	return nil, fmt.Errorf("no name server for %q answered", zone)
+}
+
+// referral returns the zone cut resp refers to if it is a referral for
+// qname from a server authoritative for zone
+func referral(resp *dns.Msg, zone, qname string) string {
+	if resp.Rcode != dns.RcodeSuccess || resp.Authoritative || len(resp.Answer) > 0 {
+		return ""
+	}
+
+	for _, rr := range resp.Ns {
+		if rr.Header().Rrtype != dns.TypeNS {
+			continue
+		}
+
+		cut := rr.Header().Name
+		if !equal(cut, zone) && dns.IsSubDomain(zone, cut) && dns.IsSubDomain(cut, qname) {
+			return cut
+		}
+	}
+
+	return ""
+}
+
+// lame returns true if resp indicates that the server is not authoritative
+// for zone
+func lame(resp *dns.Msg, zone string) bool {
+	if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+		return true
+	}
+
+	if resp.Authoritative || len(resp.Answer) > 0 {
+		return false
+	}
+
+	// upward or sideways referrals
+	for _, rr := range resp.Ns {
+		if rr.Header().Rrtype == dns.TypeNS && !dns.IsSubDomain(zone, rr.Header().Name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// suffix returns the last n labels of name
+func suffix(name string, n int) string {
+	idx := dns.Split(name)
+	if n >= len(idx) {
+		return name
+	}
+
+	return name[idx[len(idx)-n]:]
+}
+
+func equal(a, b string) bool {
+	return dns.CountLabel(a) == dns.CountLabel(b) && dns.IsSubDomain(a, b)
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if equal(n, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasOwner(rrs []dns.RR, name string) bool {
+	for _, rr := range rrs {
+		if equal(rr.Header().Name, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inBailiwick returns the records of rrs that are at or below zone
+func inBailiwick(rrs []dns.RR, zone string) []dns.RR {
+	var result []dns.RR
+
+	for _, rr := range rrs {
+		if dns.IsSubDomain(zone, rr.Header().Name) {
+			result = append(result, rr)
+		} else {
+			log.Printf("[recursor] dropping out-of-bailiwick record for zone %q: %s\n", zone, rr)
+		}
+	}
+
+	return result
+}
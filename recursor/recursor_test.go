@@ -0,0 +1,318 @@
+package recursor
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/homebot/dnswall"
+	"github.com/homebot/dnswall/cache"
+	"github.com/homebot/dnswall/request"
+	"github.com/homebot/dnswall/server"
+	"github.com/homebot/dnswall/zone"
+	"github.com/miekg/dns"
+)
+
+const rootZone = `
+.                  3600 IN SOA a.root.test. admin.root.test. 1 3600 600 86400 60
+.                  3600 IN NS  a.root.test.
+a.root.test.       3600 IN A   127.0.0.2
+test.              3600 IN NS  ns.test.
+ns.test.           3600 IN A   127.0.0.3
+`
+
+const tldZone = `
+test.              3600 IN SOA ns.test. admin.test. 1 3600 600 86400 60
+test.              3600 IN NS  ns.test.
+ns.test.           3600 IN A   127.0.0.3
+example.test.      3600 IN NS  ns.example.test.
+ns.example.test.   3600 IN A   127.0.0.4
+other.test.        3600 IN NS  ns.example.test.
+evil.test.         3600 IN NS  ns.evil.test.
+ns.evil.test.      3600 IN A   127.0.0.5
+`
+
+const exampleZone = `
+example.test.      3600 IN SOA ns.example.test. admin.example.test. 1 3600 600 86400 60
+example.test.      3600 IN NS  ns.example.test.
+ns.example.test.   3600 IN A   127.0.0.4
+www.example.test.  60   IN CNAME web.other.test.
+a.b.example.test.  60   IN A   192.0.2.2
+`
+
+const otherZone = `
+other.test.        3600 IN SOA ns.example.test. admin.other.test. 1 3600 600 86400 60
+other.test.        3600 IN NS  ns.example.test.
+web.other.test.    60   IN A   192.0.2.1
+`
+
+// standIn serves zones on ip using the zone provider and returns the port
+// it listens on. If port is empty, a random port is chosen
+func standIn(t *testing.T, ip, port string, zones ...string) (string, func()) {
+	var loaded []*zone.Zone
+	for _, z := range zones {
+		origin := strings.Fields(z)[0]
+
+		parsed, err := zone.LoadZone(origin, strings.NewReader(z))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		loaded = append(loaded, parsed)
+	}
+
+	if port == "" {
+		port = "0"
+	}
+
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+	if err != nil {
+		t.Skipf("cannot listen on %s: %s", ip, err)
+	}
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler:    server.New().Use(zone.NewProvider(loaded...)),
+	}
+
+	go srv.ActivateAndServe()
+
+	_, port, _ = net.SplitHostPort(pc.LocalAddr().String())
+
+	return port, func() { srv.Shutdown() }
+}
+
+// forgingStandIn serves evil.test. on ip and port. It answers every query
+// with an alias to web.other.test. together with a forged address for the
+// alias target, which is not part of its zone
+func forgingStandIn(t *testing.T, ip, port string) func() {
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+	if err != nil {
+		t.Skipf("cannot listen on %s: %s", ip, err)
+	}
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Authoritative = true
+
+			for _, s := range []string{
+				r.Question[0].Name + " 60 IN CNAME web.other.test.",
+				"web.other.test. 60 IN A 198.51.100.66",
+			} {
+				rr, _ := dns.NewRR(s)
+				m.Answer = append(m.Answer, rr)
+			}
+
+			w.WriteMsg(m)
+		}),
+	}
+
+	go srv.ActivateAndServe()
+
+	return func() { srv.Shutdown() }
+}
+
+// newStandIns serves the test hierarchy on 127.0.0.2 (root), 127.0.0.3
+// (test.), 127.0.0.4 (example.test. and other.test.) and 127.0.0.5
+// (evil.test.) using a common port
+func newStandIns(t *testing.T) (string, func()) {
+	port, stopRoot := standIn(t, "127.0.0.2", "", rootZone)
+	_, stopTLD := standIn(t, "127.0.0.3", port, tldZone)
+	_, stopExample := standIn(t, "127.0.0.4", port, exampleZone, otherZone)
+	stopEvil := forgingStandIn(t, "127.0.0.5", port)
+
+	return port, func() {
+		stopRoot()
+		stopTLD()
+		stopExample()
+		stopEvil()
+	}
+}
+
+// responseWriter records the response written to a UDP client
+type responseWriter struct {
+	msg *dns.Msg
+}
+
+func (w *responseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *responseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}
+}
+
+func (w *responseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *responseWriter) Write(buf []byte) (int, error) { return len(buf), nil }
+func (w *responseWriter) Close() error                  { return nil }
+func (w *responseWriter) TsigStatus() error             { return nil }
+func (w *responseWriter) TsigTimersOnly(bool)           {}
+func (w *responseWriter) Hijack()                       {}
+
+func TestResolve(t *testing.T) {
+	port, stop := newStandIns(t)
+	defer stop()
+
+	for _, minimize := range []bool{true, false} {
+		r := New("127.0.0.2:" + port).WithPort(port).WithQNameMinimization(minimize)
+
+		resp, err := r.Resolve(context.Background(), "www.example.test", dns.TypeA)
+		if err != nil {
+			t.Fatalf("minimize=%v: %s", minimize, err)
+		}
+
+		if len(resp.Answer) != 2 {
+			t.Fatalf("minimize=%v: expected CNAME and A record, got %v", minimize, resp.Answer)
+		}
+
+		if a, ok := resp.Answer[1].(*dns.A); !ok || a.A.String() != "192.0.2.1" {
+			t.Errorf("minimize=%v: unexpected answer %v", minimize, resp.Answer[1])
+		}
+
+		// empty non-terminals are resolved with and without minimization
+		resp, err = r.Resolve(context.Background(), "a.b.example.test", dns.TypeA)
+		if err != nil {
+			t.Fatalf("minimize=%v: %s", minimize, err)
+		}
+
+		if len(resp.Answer) != 1 {
+			t.Errorf("minimize=%v: expected one record, got %v", minimize, resp.Answer)
+		}
+
+		resp, err = r.Resolve(context.Background(), "missing.example.test", dns.TypeA)
+		if err != nil {
+			t.Fatalf("minimize=%v: %s", minimize, err)
+		}
+
+		if resp.Rcode != dns.RcodeNameError {
+			t.Errorf("minimize=%v: expected NXDOMAIN, got %s", minimize, dns.RcodeToString[resp.Rcode])
+		}
+	}
+}
+
+func TestResolveDropsOutOfBailiwickRecords(t *testing.T) {
+	port, stop := newStandIns(t)
+	defer stop()
+
+	c := cache.New()
+	r := New("127.0.0.2:" + port).WithPort(port)
+
+	req := new(dns.Msg)
+	req.SetQuestion("a.evil.test.", dns.TypeA)
+
+	w := &responseWriter{}
+	session := dnswall.NewSession([]dnswall.Middleware{c, r}, &request.Request{W: w, Req: req}, w)
+	if err := session.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.msg == nil || len(w.msg.Answer) != 2 {
+		t.Fatalf("expected CNAME and A record, got %v", w.msg)
+	}
+
+	// the alias target is resolved from its own zone
+	if a, ok := w.msg.Answer[1].(*dns.A); !ok || a.A.String() != "192.0.2.1" {
+		t.Errorf("unexpected answer %v", w.msg.Answer[1])
+	}
+
+	for _, rr := range c.Entries("web.other.test.") {
+		if a, ok := rr.RR.(*dns.A); ok && a.A.String() == "198.51.100.66" {
+			t.Errorf("forged record has been cached: %s", rr.RR)
+		}
+	}
+}
+
+func TestResolveCachesDelegations(t *testing.T) {
+	port, stop := newStandIns(t)
+	defer stop()
+
+	r := New("127.0.0.2:" + port).WithPort(port)
+
+	if _, err := r.Resolve(context.Background(), "www.example.test", dns.TypeA); err != nil {
+		t.Fatal(err)
+	}
+
+	zone, servers := r.closest("host.example.test.")
+	if zone != "example.test." || len(servers) != 1 || servers[0] != "127.0.0.4:"+port {
+		t.Errorf("unexpected delegation %q %v", zone, servers)
+	}
+}
+
+func TestRootHints(t *testing.T) {
+	port, stop := newStandIns(t)
+	defer stop()
+
+	named := `
+.            3600000 IN NS a.root.test.
+a.root.test. 3600000 IN A  127.0.0.2
+`
+
+	hints, err := ParseRootHints(strings.NewReader(named), port)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hints) != 1 || hints[0] != "127.0.0.2:"+port {
+		t.Fatalf("unexpected root hints %v", hints)
+	}
+
+	resp, err := New(hints...).WithPort(port).Resolve(context.Background(), "web.other.test", dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Answer) != 1 {
+		t.Errorf("expected one record, got %v", resp.Answer)
+	}
+
+	if _, err := ParseRootHints(strings.NewReader(". 3600 IN NS a.root.test.\n"), "53"); err == nil {
+		t.Error("expected hints without addresses to be rejected")
+	}
+}
+
+func TestResolveHonorsDeadline(t *testing.T) {
+	// a server that never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	r := New(pc.LocalAddr().String()).WithTimeout(10 * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := r.Resolve(ctx, "www.example.test", dns.TypeA); err == nil {
+		t.Fatal("expected resolving to fail")
+	}
+
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("query outlived the context deadline by %s", d-200*time.Millisecond)
+	}
+}
+
+func TestSuffix(t *testing.T) {
+	cases := map[int]string{
+		1: "test.",
+		2: "example.test.",
+		3: "www.example.test.",
+		4: "www.example.test.",
+	}
+
+	for n, want := range cases {
+		if got := suffix("www.example.test.", n); got != want {
+			t.Errorf("suffix(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
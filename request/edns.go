@@ -0,0 +1,53 @@
+package request
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+)
+
+// EDEOptionCode is the EDNS0 option code for Extended DNS Errors (RFC 8914)
+const EDEOptionCode = 15
+
+// ExtendedError returns an EDNS0 option carrying an extended DNS error
+func ExtendedError(code uint16, text string) dns.EDNS0 {
+	data := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+	copy(data[2:], text)
+
+	return &dns.EDNS0_LOCAL{
+		Code: EDEOptionCode,
+		Data: data,
+	}
+}
+
+// Truncate removes resource records from the end of msg until it fits into
+// size bytes. The TC bit is set if records from the answer or authority
+// section had to be removed
+func Truncate(msg *dns.Msg, size int) {
+	if msg.Len() <= size {
+		return
+	}
+
+	// keep the OPT record, everything else in the additional section
+	// is optional
+	var opt dns.RR
+	if o := msg.IsEdns0(); o != nil {
+		opt = o
+	}
+
+	msg.Extra = nil
+	if opt != nil {
+		msg.Extra = []dns.RR{opt}
+	}
+
+	for msg.Len() > size && len(msg.Ns) > 0 {
+		msg.Ns = msg.Ns[:len(msg.Ns)-1]
+		msg.Truncated = true
+	}
+
+	for msg.Len() > size && len(msg.Answer) > 0 {
+		msg.Answer = msg.Answer[:len(msg.Answer)-1]
+		msg.Truncated = true
+	}
+}
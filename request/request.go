@@ -29,6 +29,11 @@ type Request struct {
 
 	// Req is the actual DNS request message received
 	Req *dns.Msg
+
+	// ClientSubnet is the network the response is scoped to if it has been
+	// resolved using EDNS Client Subnet (RFC 7871). It is nil if the
+	// response is valid for all clients
+	ClientSubnet *net.IPNet
 }
 
 // RemoteAddr returns the remote address of the client that
@@ -44,6 +44,14 @@ type Question struct {
 	Class string
 }
 
+// Response is the struct passed as "response" during rule evaluation
+type Response struct {
+	*dns.Msg
+
+	// Secure is true if the response has been validated using DNSSEC
+	Secure bool
+}
+
 // NewExpr creates a new evaluable DNS expression
 func NewExpr(expr string, consts ...map[string]interface{}) (*Expr, error) {
 	e, err := govaluate.NewEvaluableExpressionWithFunctions(expr, functions)
@@ -78,7 +86,10 @@ func (e *Expr) Evaluate(req *request.Request, resp *dns.Msg, ctx ...Context) (in
 	}
 
 	if resp != nil {
-		params["response"] = resp
+		params["response"] = Response{
+			Msg:    resp,
+			Secure: resp.AuthenticatedData,
+		}
 	}
 
 	for key, value := range e.consts {
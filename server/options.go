@@ -13,4 +13,9 @@ type Options struct {
 
 	// The address to listen on, defaults to ":dns"
 	Addr string
+
+	// TsigSecrets maps TSIG key names to their base64 encoded secrets.
+	// Requests signed with one of the keys are validated and responses
+	// are signed
+	TsigSecrets map[string]string
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/homebot/dnswall"
 	"github.com/homebot/dnswall/request"
@@ -32,6 +33,9 @@ type DNSServer struct {
 
 	middlewares []dnswall.Middleware
 
+	// queryTimeout limits the time spent on resolving a single request
+	queryTimeout time.Duration
+
 	wg sync.WaitGroup
 }
 
@@ -65,9 +69,7 @@ func (srv *DNSServer) WithTCP(opts *Options) *DNSServer {
 		ReadTimeout:  opts.ReadTimeout,
 		WriteTimeout: opts.WriteTimeout,
 		Handler:      srv,
-		TsigSecret: map[string]string{
-			"test.": "dGVzdAo=",
-		},
+		TsigSecret:   opts.tsigSecrets(),
 	}
 	srv.tcpErr = make(chan error, 1)
 
@@ -88,15 +90,40 @@ func (srv *DNSServer) WithUDP(opts *Options) *DNSServer {
 		ReadTimeout:  opts.ReadTimeout,
 		WriteTimeout: opts.WriteTimeout,
 		Handler:      srv,
-		TsigSecret: map[string]string{
-			"test.": "dGVzdAo=",
-		},
+		TsigSecret:   opts.tsigSecrets(),
 	}
 	srv.udpErr = make(chan error, 1)
 
 	return srv
 }
 
+// tsigSecrets returns the TSIG secrets to use by the server
+func (opts *Options) tsigSecrets() map[string]string {
+	if len(opts.TsigSecrets) == 0 {
+		return map[string]string{
+			"test.": "dGVzdAo=",
+		}
+	}
+
+	secrets := make(map[string]string, len(opts.TsigSecrets))
+	for name, secret := range opts.TsigSecrets {
+		secrets[dns.Fqdn(name)] = secret
+	}
+
+	return secrets
+}
+
+// WithQueryTimeout limits the time spent on resolving a single request. Once
+// the timeout has passed, the context of the session is cancelled so
+// middlewares stop working on a request the client has given up on
+func (srv *DNSServer) WithQueryTimeout(d time.Duration) *DNSServer {
+	srv.assertNotStarted()
+
+	srv.queryTimeout = d
+
+	return srv
+}
+
 // Use specifies the middleware stack to use
 func (srv *DNSServer) Use(middlewares ...dnswall.Middleware) *DNSServer {
 	srv.assertNotStarted()
@@ -165,7 +192,14 @@ func (srv *DNSServer) ListenAndServe() error {
 
 // ServeDNS serves a DNS request and implements dns.Handler
 func (srv *DNSServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if srv.queryTimeout > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, srv.queryTimeout)
+		defer cancelTimeout()
+	}
 
 	r := &request.Request{
 		W:   w,
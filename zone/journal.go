@@ -0,0 +1,346 @@
+package zone
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultJournalSize is the number of changes kept in the journal of a zone
+var DefaultJournalSize = 100
+
+// Delta holds the changes between two versions of a zone in the format
+// used by incremental zone transfers (RFC 1995)
+type Delta struct {
+	// From is the SOA record of the old version
+	From *dns.SOA
+
+	// To is the SOA record of the new version
+	To *dns.SOA
+
+	// Deleted holds the records removed from the old version
+	Deleted []dns.RR
+
+	// Added holds the records added by the new version
+	Added []dns.RR
+}
+
+// Journal records the changes of a zone so secondary servers can catch up
+// using incremental zone transfers. Only the latest changes are kept
+type Journal struct {
+	mu     sync.Mutex
+	size   int
+	deltas []Delta
+}
+
+// NewJournal returns a new journal that keeps up to size changes
+func NewJournal(size int) *Journal {
+	return &Journal{
+		size: size,
+	}
+}
+
+// Add appends d to the journal. If d does not continue the latest change,
+// the older changes are dropped
+func (j *Journal) Add(d Delta) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if n := len(j.deltas); n > 0 && j.deltas[n-1].To.Serial != d.From.Serial {
+		j.deltas = nil
+	}
+
+	j.deltas = append(j.deltas, d)
+
+	if len(j.deltas) > j.size {
+		j.deltas = append([]Delta(nil), j.deltas[len(j.deltas)-j.size:]...)
+	}
+}
+
+// Reset drops all changes of the journal
+func (j *Journal) Reset() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.deltas = nil
+}
+
+// Since returns the changes from the version with the given serial to the
+// latest one. It returns false if the journal does not reach back to serial
+func (j *Journal) Since(serial uint32) ([]Delta, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for i, d := range j.deltas {
+		if d.From.Serial == serial {
+			return append([]Delta(nil), j.deltas[i:]...), true
+		}
+	}
+
+	return nil, false
+}
+
+// Diff returns the changes between the zones old and new. SOA records are
+// not part of the added and deleted records
+func Diff(old, new *Zone) Delta {
+	var d Delta
+
+	d.From, _ = old.SOA(dns.Class(dns.ClassINET))
+	d.To, _ = new.SOA(dns.Class(dns.ClassINET))
+
+	existing := make(map[string]bool, old.Len())
+	for _, rr := range old.Records() {
+		if rr.Header().Rrtype != dns.TypeSOA {
+			existing[recordKey(rr)] = true
+		}
+	}
+
+	for _, rr := range new.Records() {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			continue
+		}
+
+		key := recordKey(rr)
+		if existing[key] {
+			delete(existing, key)
+			continue
+		}
+
+		d.Added = append(d.Added, rr)
+	}
+
+	for _, rr := range old.Records() {
+		if existing[recordKey(rr)] {
+			d.Deleted = append(d.Deleted, rr)
+		}
+	}
+
+	return d
+}
+
+// recordKey returns a key that identifies rr including its TTL, so records
+// with changed TTLs are transferred as well
+func recordKey(rr dns.RR) string {
+	c := dns.Copy(rr)
+	c.Header().Name = strings.ToLower(dns.Fqdn(c.Header().Name))
+
+	return c.String()
+}
+
+// inverse returns the changes that undo d
+func (d Delta) inverse() Delta {
+	return Delta{
+		From:    d.To,
+		To:      d.From,
+		Deleted: d.Added,
+		Added:   d.Deleted,
+	}
+}
+
+// applyDelta applies the changes of d to z. Added records outside of the
+// zone are ignored
+func (z *Zone) applyDelta(d Delta) {
+	z.Remove(d.From)
+
+	for _, rr := range d.Deleted {
+		z.Remove(rr)
+	}
+
+	for _, rr := range d.Added {
+		if z.Contains(dns.Name(rr.Header().Name)) {
+			z.Insert(rr)
+		}
+	}
+
+	z.Insert(d.To)
+}
+
+// splitDeltas splits records in the format of incremental zone transfers
+// (RFC 1995 section 4) without the leading and trailing SOA records into
+// the changes they describe
+func splitDeltas(rrs []dns.RR) ([]Delta, error) {
+	var deltas []Delta
+
+	for i := 0; i < len(rrs); {
+		var d Delta
+
+		from, ok := rrs[i].(*dns.SOA)
+		if !ok {
+			return nil, errors.New("changes do not start with a SOA record")
+		}
+
+		d.From = from
+		for i++; i < len(rrs); i++ {
+			if _, ok := rrs[i].(*dns.SOA); ok {
+				break
+			}
+
+			d.Deleted = append(d.Deleted, rrs[i])
+		}
+
+		if i >= len(rrs) {
+			return nil, errors.New("changes without SOA record of the new version")
+		}
+
+		d.To = rrs[i].(*dns.SOA)
+		for i++; i < len(rrs); i++ {
+			if _, ok := rrs[i].(*dns.SOA); ok {
+				break
+			}
+
+			d.Added = append(d.Added, rrs[i])
+		}
+
+		deltas = append(deltas, d)
+	}
+
+	return deltas, nil
+}
+
+// journalExt is the extension of journal files. Files with this extension
+// are not loaded as zones by DirSources
+const journalExt = ".jnl"
+
+// journalFile returns the name of the journal file of the zone file file
+func journalFile(file string) string {
+	return file + journalExt
+}
+
+// appendJournal appends d to the journal file in the format of incremental
+// zone transfers so the changes survive restarts
+func appendJournal(file string, d Delta) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := writeDeltas(f, d); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// rewriteJournal replaces the journal file with deltas. The file is removed
+// if there are no changes left
+func rewriteJournal(file string, deltas []Delta) error {
+	if len(deltas) == 0 {
+		return os.Remove(file)
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+
+	if err := writeDeltas(f, deltas...); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), file)
+}
+
+// writeDeltas writes deltas to w in the format of incremental zone
+// transfers
+func writeDeltas(w io.Writer, deltas ...Delta) error {
+	b := bufio.NewWriter(w)
+
+	for _, d := range deltas {
+		fmt.Fprintln(b, d.From.String())
+		for _, rr := range d.Deleted {
+			fmt.Fprintln(b, rr.String())
+		}
+
+		fmt.Fprintln(b, d.To.String())
+		for _, rr := range d.Added {
+			fmt.Fprintln(b, rr.String())
+		}
+	}
+
+	return b.Flush()
+}
+
+// replay applies the changes recorded in the journal file to z. Changes
+// that do not continue the serial of z, e.g. those made before the zone
+// file has been edited, are skipped. Once the serial of the zone file moved
+// past them, they are removed from the journal file
+func (z *Zone) replay(file string) error {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var rrs []dns.RR
+	for t := range dns.ParseZone(bufio.NewReader(f), string(z.Name), file) {
+		if t.Error != nil {
+			return fmt.Errorf("journal %s: %s", file, t.Error)
+		}
+
+		rrs = append(rrs, t.RR)
+	}
+
+	deltas, err := splitDeltas(rrs)
+	if err != nil {
+		return fmt.Errorf("journal %s: %s", file, err)
+	}
+
+	base, ok := z.Serial()
+	if !ok {
+		return nil
+	}
+
+	var applied []Delta
+	superseded := true
+
+	for _, d := range deltas {
+		serial, _ := z.Serial()
+		if d.From.Serial == serial {
+			z.applyDelta(d)
+			z.journal.Add(d)
+			applied = append(applied, d)
+			continue
+		}
+
+		// changes newer than the zone file are kept, the serial of the
+		// file may have been decreased by mistake
+		if serialGreater(d.To.Serial, base) {
+			superseded = false
+		}
+	}
+
+	if len(applied) > 0 {
+		serial, _ := z.Serial()
+		log.Printf("[zone] applied %d changes of %s to %s (serial %d)\n", len(applied), file, z.Name, serial)
+	}
+
+	if superseded && len(applied) < len(deltas) {
+		if err := rewriteJournal(file, applied); err != nil {
+			log.Printf("[zone] failed to compact %s: %s\n", file, err)
+		} else {
+			log.Printf("[zone] removed %d outdated changes from %s\n", len(deltas)-len(applied), file)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package zone
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Source describes a zone file to load
+type Source struct {
+	// File is the path of the zone file
+	File string
+
+	// Origin is the name of the zone
+	Origin string
+}
+
+// ParseSource parses a zone source in the format file=origin. If the
+// origin is omitted, defaultOrigin is used
+func ParseSource(s, defaultOrigin string) (Source, error) {
+	src := Source{
+		File:   s,
+		Origin: defaultOrigin,
+	}
+
+	if idx := strings.LastIndex(s, "="); idx >= 0 {
+		src.File = s[:idx]
+		src.Origin = s[idx+1:]
+	}
+
+	if src.File == "" {
+		return Source{}, fmt.Errorf("%q: missing zone file", s)
+	}
+
+	if src.Origin == "" {
+		return Source{}, fmt.Errorf("%q: missing zone origin, expected file=origin", s)
+	}
+
+	return src, nil
+}
+
+// DirSources returns the sources of all zone files in dir. The origin of a
+// zone is taken from the $ORIGIN directive at the top of the file or from
+// the file name otherwise. The extensions ".zone" and ".db" as well as a
+// "db." prefix are stripped from file names, so "example.com.zone" and
+// "db.example.com" both hold the zone example.com. Hidden files and
+// journal files are ignored
+func DirSources(dir string) ([]Source, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []Source
+	var errs Errors
+
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") || strings.HasSuffix(fi.Name(), journalExt) {
+			continue
+		}
+
+		file := filepath.Join(dir, fi.Name())
+
+		origin, err := fileOrigin(file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", file, err))
+			continue
+		}
+
+		sources = append(sources, Source{
+			File:   file,
+			Origin: origin,
+		})
+	}
+
+	return sources, errs.err()
+}
+
+// LoadZones loads the zones of all sources. Sources that fail to load do
+// not stop the remaining ones from being loaded, all errors are reported
+// together
+func LoadZones(sources ...Source) ([]*Zone, error) {
+	var zones []*Zone
+	var errs Errors
+
+	files := make(map[string]string)
+
+	for _, src := range sources {
+		z, err := LoadZoneFile(src.File, src.Origin)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("zone %s: %s", src.Origin, err))
+			continue
+		}
+
+		origin := strings.ToLower(string(z.Name))
+		if other, ok := files[origin]; ok {
+			errs = append(errs, fmt.Errorf("zone %s: %s: already loaded from %s", z.Name, src.File, other))
+			continue
+		}
+
+		files[origin] = src.File
+		zones = append(zones, z)
+	}
+
+	return zones, errs.err()
+}
+
+// Errors holds the errors of all zones that failed to load
+type Errors []error
+
+// Error implements error and returns one error message per line
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// err returns nil if there are no errors and e otherwise
+func (e Errors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// fileOrigin returns the origin of the zone file. It is taken from the
+// $ORIGIN directive if the file starts with one and from the file name
+// otherwise
+func fileOrigin(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, ";"); idx >= 0 {
+			line = line[:idx]
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if strings.EqualFold(fields[0], "$ORIGIN") && len(fields) > 1 {
+			return fields[1], nil
+		}
+
+		// $TTL and friends may precede $ORIGIN, records may not
+		if !strings.HasPrefix(fields[0], "$") {
+			break
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(file)
+	name = strings.TrimSuffix(name, ".zone")
+	name = strings.TrimSuffix(name, ".db")
+	name = strings.TrimPrefix(name, "db.")
+
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return "", fmt.Errorf("cannot derive zone origin from file name, add an $ORIGIN directive")
+	}
+
+	return name, nil
+}
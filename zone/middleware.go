@@ -1,44 +1,373 @@
 package zone
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
 	"github.com/homebot/dnswall"
 	"github.com/homebot/dnswall/request"
 	"github.com/miekg/dns"
 )
 
+// Forwarder sends requests to a group of upstream servers
+type Forwarder interface {
+	// Forward sends msg to servers and returns the first response
+	Forward(ctx context.Context, msg *dns.Msg, servers ...string) (*dns.Msg, error)
+}
+
 // Provider is a DNS server middleware that resolves queries for
 // registered zones
 type Provider struct {
+	rw    sync.RWMutex
 	zones []*Zone
+
+	// serialCheck refuses to reload zones whose serial did not increase
+	serialCheck bool
+
+	// delegations resolves requests below zone cuts using the delegated
+	// servers instead of answering with a referral
+	delegations Forwarder
+
+	// transfers restricts zone transfers. They are refused if nil
+	transfers *TransferACL
+
+	// secondaries holds the secondary zones by lowercase origin
+	secondaries map[string]*secondary
+
+	// policies authorizes dynamic updates. Updates are refused if empty
+	policies []UpdatePolicy
+
+	// updateLock serializes dynamic updates
+	updateLock sync.Mutex
+
+	// notifyConfig configures NOTIFY messages sent when zones change
+	notifyConfig *NotifyConfig
 }
 
 func NewProvider(z ...*Zone) *Provider {
 	return &Provider{
-		zones: z,
+		zones:       z,
+		serialCheck: true,
 	}
 }
 
+// WithDelegations configures the provider to resolve requests for names
+// below a zone cut by sending them to the delegated servers using f. By
+// default, such requests are answered with a referral
+func (p *Provider) WithDelegations(f Forwarder) *Provider {
+	p.delegations = f
+
+	return p
+}
+
 func (p *Provider) Name() string {
 	return "zone"
 }
 
+// outcome describes how a zone answered a question
+type outcome int
+
+const (
+	// answered means the answer is complete
+	answered outcome = iota
+
+	// alias means the answer ends with an alias pointing outside of the
+	// zone
+	alias
+
+	// referral means the name is below a zone cut and the answer is a
+	// referral to the servers of the sub-zone
+	referral
+)
+
+// maxChain is the maximum number of CNAME and DNAME records followed while
+// answering a request
+const maxChain = 8
+
 // Serve serves the DNS request and implements middleware.Middleware
 func (p *Provider) Serve(session *dnswall.Session, req *request.Request) error {
+	switch req.Req.Opcode {
+	case dns.OpcodeNotify:
+		return p.notify(session, req)
+	case dns.OpcodeUpdate:
+		return p.update(session, req)
+	}
+
+	if t := uint16(req.Type()); t == dns.TypeAXFR || t == dns.TypeIXFR {
+		return p.transfer(session, req)
+	}
+
+	zone := p.zoneFor(req.Name())
+	if zone == nil {
+		// Nothing found, continue middleware stack
+		return session.Next()
+	}
+
+	// Do not pass the request down the middleware handler as
+	// we are the responsible zone handler
+	m := session.Prepare()
+	m.Authoritative = true
+
+	target, res := zone.answer(m, req.Class(), req.Type(), req.Name())
+
+	for i := 0; res == alias && i < maxChain; i++ {
+		if z := p.zoneFor(target); z != nil {
+			target, res = z.answer(m, req.Class(), req.Type(), target)
+			continue
+		}
+
+		// the alias points outside of our zones, resolve the target
+		// using the rest of the middleware stack
+		resp, err := session.Fork(req.NewWithQuestion(string(target), uint16(req.Type())))
+		if err != nil {
+			log.Printf("[zone] failed to resolve alias target %q: %s\n", target, err)
+			break
+		}
+
+		m.Rcode = resp.Rcode
+		m.Answer = append(m.Answer, resp.Answer...)
+		m.Ns = resp.Ns
+		m.Extra = nil
+		break
+	}
+
+	if res == referral && p.delegations != nil {
+		p.resolveDelegation(session.Ctx, m, req, target)
+	}
+
+	return session.ResolveWith(m)
+}
+
+// resolveDelegation replaces the referral in m by the answer of the
+// delegated servers for name. Only servers with glue records are used
+func (p *Provider) resolveDelegation(ctx context.Context, m *dns.Msg, req *request.Request, name dns.Name) {
+	var servers []string
+	for _, rr := range m.Extra {
+		switch v := rr.(type) {
+		case *dns.A:
+			servers = append(servers, net.JoinHostPort(v.A.String(), "53"))
+		case *dns.AAAA:
+			servers = append(servers, net.JoinHostPort(v.AAAA.String(), "53"))
+		}
+	}
+
+	if len(servers) == 0 {
+		log.Printf("[zone] no glue for the delegation of %q, sending referral\n", name)
+		return
+	}
+
+	msg := req.NewWithQuestion(string(name), uint16(req.Type())).Req
+	msg.RecursionDesired = false
+
+	if tsig := msg.IsTsig(); tsig != nil {
+		// the delegated servers do not know our transaction keys
+		msg.Extra = msg.Extra[:len(msg.Extra)-1]
+	}
+
+	resp, err := p.delegations.Forward(ctx, msg, servers...)
+	if err != nil {
+		log.Printf("[zone] failed to resolve %q using the delegated servers: %s\n", name, err)
+
+		m.Rcode = dns.RcodeServerFailure
+		m.Ns = nil
+		m.Extra = nil
+		return
+	}
+
+	if len(m.Answer) == 0 {
+		m.Authoritative = resp.Authoritative
+	}
+
+	m.Rcode = resp.Rcode
+	m.Answer = append(m.Answer, resp.Answer...)
+	m.Ns = resp.Ns
+	m.Extra = resp.Extra
+}
+
+// zoneFor returns the most specific zone that contains name
+func (p *Provider) zoneFor(name dns.Name) *Zone {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+
+	var match *Zone
+
 	for _, zone := range p.zones {
-		// TODO(ppacher): we are using the first zone that is a parent of the request
-		// however, check if we may have a better match (deligation in the parent zone)
-		if dns.IsSubDomain(zone.Name.String(), req.Name().String()) {
-			rr, ok := zone.Lookup(req.Class(), req.Type(), req.Name())
+		if !dns.IsSubDomain(string(zone.Name), string(name)) {
+			continue
+		}
+
+		if match == nil || dns.CountLabel(string(zone.Name)) > dns.CountLabel(string(match.Name)) {
+			match = zone
+		}
+	}
+
+	return match
+}
+
+// answer adds the authoritative answer of the zone for the given question
+// to m. CNAME and DNAME records are followed within the zone and wildcard
+// records are expanded (RFC 4592). If an alias points outside of the zone,
+// its target is returned with the outcome alias. Names below a zone cut are
+// answered with a referral to the delegated servers. Positive answers carry the NS
+// records of the zone in the authority section and their glue in the
+// additional section. Negative answers carry the SOA record instead
+// (RFC 2308)
+func (z *Zone) answer(m *dns.Msg, class dns.Class, rtype dns.Type, name dns.Name) (dns.Name, outcome) {
+	z.rw.RLock()
+	defer z.rw.RUnlock()
+
+	for i := 0; i < maxChain; i++ {
+		d, isDNAME := z.dname(class, name)
+		ns, isCut := z.cut(class, rtype, name)
+
+		// whichever is closer to the apex occludes the other
+		if isCut && (!isDNAME || dns.CountLabel(ns[0].Header().Name) < dns.CountLabel(d.Header().Name)) {
+			if len(m.Answer) == 0 {
+				m.Authoritative = false
+			}
+
+			m.Ns = ns
+			m.Extra = z.Glue(class, ns)
+			return name, referral
+		}
+
+		if isDNAME {
+			cname, err := synthesizeCNAME(d, name)
+			if err != nil {
+				// the substitution exceeds the maximum length of a domain
+				// name (RFC 6672 section 2.2)
+				m.Rcode = dns.RcodeYXDomain
+				m.Answer = append(m.Answer, d)
+				return "", answered
+			}
+
+			m.Answer = append(m.Answer, d, cname)
+			name = dns.Name(cname.Target)
+
+			if !z.Contains(name) {
+				return name, alias
+			}
+
+			continue
+		}
+
+		owner := name
+		if !z.Exists(class, name) {
+			source, ok := z.wildcard(class, name)
 			if !ok {
-				// No not pass the request down the middleware handler as
-				// we are the responsible zone handler
-				return session.Reject(dns.RcodeNameError)
+				m.Rcode = dns.RcodeNameError
+				z.negative(m, class)
+				return "", answered
+			}
+
+			owner = source
+		}
+
+		if rrs, ok := z.Lookup(class, rtype, owner); ok {
+			m.Answer = append(m.Answer, synthesize(rrs, name)...)
+
+			// the NS records are already part of the answer
+			m.Ns = nil
+			if !(rtype == dns.Type(dns.TypeNS) && equal(string(name), string(z.Name))) {
+				m.Ns = z.NS(class)
+			}
+
+			m.Extra = z.Glue(class, append(m.Answer, m.Ns...))
+			return "", answered
+		}
+
+		if rtype != dns.Type(dns.TypeCNAME) {
+			if rrs, ok := z.Lookup(class, dns.Type(dns.TypeCNAME), owner); ok {
+				cname := synthesize(rrs[:1], name)[0].(*dns.CNAME)
+
+				m.Answer = append(m.Answer, cname)
+				name = dns.Name(cname.Target)
+
+				if !z.Contains(name) {
+					return name, alias
+				}
+
+				continue
 			}
+		}
+
+		// NODATA, the name exists but not with the requested type
+		z.negative(m, class)
+		return "", answered
+	}
+
+	log.Printf("[zone] alias chain for %q exceeds %d records\n", name, maxChain)
+	return "", answered
+}
+
+// negative adds the SOA record of the zone to the negative answer m
+func (z *Zone) negative(m *dns.Msg, class dns.Class) {
+	m.Ns = nil
+	m.Extra = nil
+
+	if soa, ok := z.SOA(class); ok {
+		m.Ns = []dns.RR{negativeSOA(soa)}
+	}
+}
+
+// synthesize returns copies of rrs owned by name if they are owned by a
+// wildcard domain name. Other records are returned as they are
+func synthesize(rrs []dns.RR, name dns.Name) []dns.RR {
+	var result []dns.RR
 
-			return session.Resolve(dns.RcodeSuccess, rr, nil)
+	for _, rr := range rrs {
+		if !strings.HasPrefix(rr.Header().Name, "*.") || equal(rr.Header().Name, string(name)) {
+			result = append(result, rr)
+			continue
 		}
+
+		cpy := dns.Copy(rr)
+		cpy.Header().Name = dns.Fqdn(string(name))
+		result = append(result, cpy)
+	}
+
+	return result
+}
+
+// synthesizeCNAME returns the CNAME record synthesized from d for name by
+// replacing the owner of d with its target (RFC 6672 section 2.2)
+func synthesizeCNAME(d *dns.DNAME, name dns.Name) (*dns.CNAME, error) {
+	labels := dns.SplitDomainName(string(name))
+	prefix := labels[:len(labels)-dns.CountLabel(d.Header().Name)]
+
+	target := dns.Fqdn(d.Target)
+	if len(prefix) > 0 {
+		target = strings.Join(prefix, ".") + "." + target
+	}
+
+	if _, ok := dns.IsDomainName(target); !ok || len(target) > 255 {
+		return nil, fmt.Errorf("invalid DNAME substitution %q", target)
+	}
+
+	return &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   dns.Fqdn(string(name)),
+			Rrtype: dns.TypeCNAME,
+			Class:  d.Header().Class,
+			Ttl:    d.Header().Ttl,
+		},
+		Target: target,
+	}, nil
+}
+
+// negativeSOA returns a copy of soa to be added to negative answers. Its
+// TTL is the minimum of the SOA's TTL and its MINIMUM field (RFC 2308
+// section 3)
+func negativeSOA(soa *dns.SOA) dns.RR {
+	cpy := dns.Copy(soa)
+
+	if soa.Minttl < cpy.Header().Ttl {
+		cpy.Header().Ttl = soa.Minttl
 	}
 
-	// Nothing found, continue middleware stack
-	return session.Next()
+	return cpy
 }
@@ -0,0 +1,190 @@
+package zone
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// NotifyConfig configures the NOTIFY messages (RFC 1996) sent to secondary
+// servers when a zone changes
+type NotifyConfig struct {
+	// Secondaries holds the addresses (host:port) notified about changes
+	// of all zones
+	Secondaries []string
+
+	// NotifyNS also notifies the name servers of the NS records at the
+	// apex of a zone, except the primary named in its SOA record
+	NotifyNS bool
+
+	// Retries is the number of times a NOTIFY message is retransmitted if
+	// not acknowledged
+	Retries int
+
+	// Interval is the time to wait for an acknowledgement before a NOTIFY
+	// message is retransmitted
+	Interval time.Duration
+
+	// Key is the TSIG key used to sign NOTIFY messages. Optional
+	Key *TsigKey
+}
+
+// DefaultNotifyConfig holds the retry settings suggested by RFC 1996
+// section 3.6
+var DefaultNotifyConfig = NotifyConfig{
+	Retries:  5,
+	Interval: time.Minute,
+}
+
+// WithNotify configures the provider to notify secondary servers when a
+// zone is reloaded, updated or transferred
+func (p *Provider) WithNotify(cfg NotifyConfig) *Provider {
+	p.rw.Lock()
+	defer p.rw.Unlock()
+
+	p.notifyConfig = &cfg
+
+	return p
+}
+
+// notifyChanged sends NOTIFY messages for z to all secondaries and waits
+// until all of them acknowledged or retries are exhausted
+func (p *Provider) notifyChanged(z *Zone) {
+	p.rw.RLock()
+	cfg := p.notifyConfig
+	p.rw.RUnlock()
+
+	if cfg == nil {
+		return
+	}
+
+	soa, ok := z.currentSOA()
+	if !ok {
+		return
+	}
+
+	targets := append([]string(nil), cfg.Secondaries...)
+	if cfg.NotifyNS {
+		targets = append(targets, nsTargets(z, soa)...)
+	}
+
+	done := make(chan struct{})
+	for _, target := range targets {
+		go func(target string) {
+			p.sendNotify(cfg, z, soa, target)
+			done <- struct{}{}
+		}(target)
+	}
+
+	for range targets {
+		<-done
+	}
+}
+
+// sendNotify sends a NOTIFY message for z to target until it is
+// acknowledged. It gives up once z has been replaced or updated to a newer
+// version
+func (p *Provider) sendNotify(cfg *NotifyConfig, z *Zone, soa *dns.SOA, target string) {
+	c := &dns.Client{
+		Timeout: cfg.Interval,
+	}
+
+	for attempt := 0; attempt <= cfg.Retries; attempt++ {
+		// a newer version of the zone is notified on its own
+		if current, ok := z.currentSOA(); p.zone(string(z.Name)) != z || !ok || current.Serial != soa.Serial {
+			return
+		}
+
+		m := new(dns.Msg)
+		m.SetNotify(string(z.Name))
+
+		// packing modifies records, do not share them between goroutines
+		m.Answer = []dns.RR{dns.Copy(soa)}
+
+		if cfg.Key != nil {
+			c.TsigSecret = cfg.Key.sign(m)
+		}
+
+		start := time.Now()
+
+		resp, _, err := c.Exchange(m, target)
+		if err == nil {
+			if resp.Rcode != dns.RcodeSuccess {
+				log.Printf("[zone] NOTIFY for %s (serial %d) rejected by %s: %s\n", z.Name, soa.Serial, target, dns.RcodeToString[resp.Rcode])
+			} else {
+				log.Printf("[zone] NOTIFY for %s (serial %d) acknowledged by %s\n", z.Name, soa.Serial, target)
+			}
+
+			return
+		}
+
+		log.Printf("[zone] NOTIFY for %s (serial %d) to %s failed: %s\n", z.Name, soa.Serial, target, err)
+
+		// wait for the rest of the interval if the exchange failed early
+		if wait := cfg.Interval - time.Since(start); wait > 0 && attempt < cfg.Retries {
+			time.Sleep(wait)
+		}
+	}
+
+	log.Printf("[zone] giving up on NOTIFY for %s (serial %d) to %s\n", z.Name, soa.Serial, target)
+}
+
+// nsTargets returns the addresses of the name servers of z except the
+// primary named in soa. Addresses are taken from glue records within the
+// zone or looked up otherwise
+func nsTargets(z *Zone, soa *dns.SOA) []string {
+	var targets []string
+
+	// the records are collected first so the zone is not locked while
+	// addresses are looked up
+	z.rw.RLock()
+	nameservers := z.NS(dns.Class(dns.ClassINET))
+	glue := make([][]dns.RR, len(nameservers))
+	for i, ns := range nameservers {
+		glue[i] = z.Glue(dns.Class(dns.ClassINET), []dns.RR{ns})
+	}
+	z.rw.RUnlock()
+
+	for i, rr := range nameservers {
+		ns := rr.(*dns.NS)
+		if equal(ns.Ns, soa.Ns) {
+			continue
+		}
+
+		var addrs []string
+		for _, glue := range glue[i] {
+			switch v := glue.(type) {
+			case *dns.A:
+				addrs = append(addrs, v.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, v.AAAA.String())
+			}
+		}
+
+		if len(addrs) == 0 {
+			var err error
+			addrs, err = net.LookupHost(ns.Ns)
+			if err != nil {
+				log.Printf("[zone] cannot notify %s for %s: %s\n", ns.Ns, z.Name, err)
+				continue
+			}
+		}
+
+		for _, addr := range addrs {
+			targets = append(targets, net.JoinHostPort(addr, "53"))
+		}
+	}
+
+	return targets
+}
+
+// currentSOA returns the SOA record of z. It is safe to use while z is
+// updated
+func (z *Zone) currentSOA() (*dns.SOA, bool) {
+	z.rw.RLock()
+	defer z.rw.RUnlock()
+
+	return z.SOA(dns.Class(dns.ClassINET))
+}
@@ -0,0 +1,116 @@
+package zone
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// notifyStandIn records the NOTIFY messages it receives and acknowledges
+// them if ack is set. Messages signed with key are validated
+type notifyStandIn struct {
+	mu       sync.Mutex
+	received []*dns.Msg
+	tsig     []error
+	ack      bool
+}
+
+func (s *notifyStandIn) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.mu.Lock()
+	s.received = append(s.received, r)
+	s.tsig = append(s.tsig, w.TsigStatus())
+	s.mu.Unlock()
+
+	if !s.ack {
+		return
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+
+	if tsig := r.IsTsig(); tsig != nil {
+		m.SetTsig(tsig.Header().Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+
+	w.WriteMsg(m)
+}
+
+// messages returns the received messages and the status of their
+// signatures
+func (s *notifyStandIn) messages() ([]*dns.Msg, []error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*dns.Msg(nil), s.received...), append([]error(nil), s.tsig...)
+}
+
+// listen serves s on a random local UDP port
+func (s *notifyStandIn) listen(t *testing.T, key TsigKey) (string, func()) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &dns.Server{
+		PacketConn: pc,
+		Handler:    s,
+		TsigSecret: map[string]string{key.Name: key.Secret},
+	}
+
+	go srv.ActivateAndServe()
+
+	return pc.LocalAddr().String(), func() { srv.Shutdown() }
+}
+
+func TestNotifyChanged(t *testing.T) {
+	z, err := LoadZone("example.com.", strings.NewReader("@ 60 IN SOA ns admin 7 7200 600 360000 60\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ParseTsigKey("hmac-sha512:notify:c2VjcmV0c2VjcmV0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acking := &notifyStandIn{ack: true}
+	ackAddr, stopAcking := acking.listen(t, key)
+	defer stopAcking()
+
+	silent := &notifyStandIn{}
+	silentAddr, stopSilent := silent.listen(t, key)
+	defer stopSilent()
+
+	p := NewProvider(z).WithNotify(NotifyConfig{
+		Secondaries: []string{ackAddr, silentAddr},
+		Retries:     2,
+		Interval:    100 * time.Millisecond,
+		Key:         &key,
+	})
+
+	// returns once all secondaries acknowledged or retries are exhausted
+	p.notifyChanged(z)
+
+	received, status := acking.messages()
+	if len(received) != 1 {
+		t.Fatalf("expected one NOTIFY message, got %d", len(received))
+	}
+
+	m := received[0]
+	if m.Opcode != dns.OpcodeNotify || len(m.Answer) != 1 || m.Answer[0].(*dns.SOA).Serial != 7 {
+		t.Errorf("unexpected NOTIFY message: %v", m)
+	}
+
+	if tsig := m.IsTsig(); tsig == nil || tsig.Algorithm != dns.HmacSHA512 || status[0] != nil {
+		t.Errorf("NOTIFY message has not been signed with %s: %v (%v)", dns.HmacSHA512, tsig, status[0])
+	}
+
+	if received, _ := silent.messages(); len(received) != 3 {
+		t.Errorf("expected NOTIFY message to be sent 3 times, got %d", len(received))
+	}
+}
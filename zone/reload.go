@@ -0,0 +1,253 @@
+package zone
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Status describes a zone served by a Provider
+type Status struct {
+	// Name is the origin of the zone
+	Name string `json:"name"`
+
+	// File is the zone file the zone has been loaded from
+	File string `json:"file,omitempty"`
+
+	// Serial is the serial of the SOA record of the zone
+	Serial uint32 `json:"serial"`
+
+	// Records is the number of records in the zone
+	Records int `json:"records"`
+
+	// Loaded is the time the zone has been loaded
+	Loaded time.Time `json:"loaded"`
+
+	// Primaries holds the primary servers of secondary zones
+	Primaries []string `json:"primaries,omitempty"`
+}
+
+// WithSerialCheck configures whether reloaded zones are refused if the
+// serial of their SOA record did not increase (RFC 1982 serial number
+// arithmetic). Enabled by default
+func (p *Provider) WithSerialCheck(enabled bool) *Provider {
+	p.rw.Lock()
+	defer p.rw.Unlock()
+
+	p.serialCheck = enabled
+
+	return p
+}
+
+// Zones returns the status of all zones served by the provider
+func (p *Provider) Zones() []Status {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+
+	status := make([]Status, len(p.zones))
+	for i, z := range p.zones {
+		z.rw.RLock()
+		serial, _ := z.Serial()
+
+		status[i] = Status{
+			Name:    string(z.Name),
+			File:    z.file,
+			Serial:  serial,
+			Records: z.Len(),
+			Loaded:  z.loaded,
+		}
+		z.rw.RUnlock()
+
+		if s, ok := p.secondaries[strings.ToLower(string(z.Name))]; ok {
+			status[i].Primaries = s.Primaries
+		}
+	}
+
+	return status
+}
+
+// Reload loads the zone name from its file again and replaces the served
+// zone once the file has been parsed successfully. Requests are answered
+// from the old zone in the meantime. Zones whose records did not change are
+// left alone. Secondary zones are refreshed from their primaries instead
+func (p *Provider) Reload(name string) error {
+	if s := p.secondary(name); s != nil {
+		s.trigger()
+		return nil
+	}
+
+	old := p.zone(name)
+	if old == nil {
+		return fmt.Errorf("zone %s: not served", name)
+	}
+
+	if old.file == "" {
+		return fmt.Errorf("zone %s: not loaded from a file", old.Name)
+	}
+
+	// updates in the meantime would be lost
+	p.updateLock.Lock()
+	defer p.updateLock.Unlock()
+
+	z, err := LoadZoneFile(old.file, string(old.Name))
+	if err != nil {
+		return fmt.Errorf("zone %s: %s", old.Name, err)
+	}
+
+	p.rw.RLock()
+	serialCheck := p.serialCheck
+	p.rw.RUnlock()
+
+	prev, hasPrev := old.Serial()
+	next, hasNext := z.Serial()
+
+	// files that have been touched or saved without changes are not an
+	// error, there is just nothing to reload
+	if hasPrev && hasNext && next == prev && unchanged(old, z) {
+		old.rw.Lock()
+		old.modTime = z.modTime
+		old.rw.Unlock()
+
+		log.Printf("[zone] %s is unchanged, not reloaded\n", old.Name)
+		return nil
+	}
+
+	if serialCheck && !serialGreater(next, prev) {
+		return fmt.Errorf("zone %s: serial %d has not been increased (current %d)", old.Name, next, prev)
+	}
+
+	// keep the history of the zone for incremental transfers. It cannot be
+	// continued if the serial did not increase. The changes are computed
+	// before taking the lock so requests are not blocked meanwhile
+	var delta *Delta
+	if hasPrev && hasNext && serialGreater(next, prev) {
+		d := Diff(old, z)
+		delta = &d
+	}
+
+	z.journal = old.journal
+
+	p.rw.Lock()
+	defer p.rw.Unlock()
+
+	for i, current := range p.zones {
+		if current == old {
+			p.zones[i] = z
+
+			if delta != nil {
+				z.journal.Add(*delta)
+			} else {
+				z.journal.Reset()
+			}
+
+			log.Printf("[zone] reloaded %s from %s\n", z.Name, z.file)
+
+			go p.notifyChanged(z)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("zone %s: replaced during reload", old.Name)
+}
+
+// ReloadAll reloads all zones that have been loaded from files. Errors of
+// all zones are reported together
+func (p *Provider) ReloadAll() error {
+	var errs Errors
+
+	for _, z := range p.Zones() {
+		if z.File == "" {
+			continue
+		}
+
+		if err := p.Reload(z.Name); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs.err()
+}
+
+// WatchEvery periodically checks the files of all zones for modifications
+// and reloads zones whose file has changed
+func (p *Provider) WatchEvery(interval time.Duration) {
+	go func() {
+		// modification times of files that failed to reload so they are
+		// not retried until modified again
+		failed := make(map[string]time.Time)
+
+		for {
+			select {
+			case <-time.After(interval):
+			}
+
+			p.rw.RLock()
+			zones := make([]*Zone, len(p.zones))
+			copy(zones, p.zones)
+			p.rw.RUnlock()
+
+			for _, z := range zones {
+				// secondary zones are saved to their file, not loaded
+				if z.file == "" || p.secondary(string(z.Name)) != nil {
+					continue
+				}
+
+				fi, err := os.Stat(z.file)
+				if err != nil {
+					continue
+				}
+
+				z.rw.RLock()
+				loaded := z.modTime
+				z.rw.RUnlock()
+
+				mod := fi.ModTime()
+				if mod.Equal(loaded) || mod.Equal(failed[z.file]) {
+					continue
+				}
+
+				if err := p.Reload(string(z.Name)); err != nil {
+					log.Printf("[zone] failed to reload: %s\n", err)
+					failed[z.file] = mod
+				}
+			}
+		}
+	}()
+}
+
+// zone returns the served zone with the given origin
+func (p *Provider) zone(name string) *Zone {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+
+	for _, z := range p.zones {
+		if equal(string(z.Name), name) {
+			return z
+		}
+	}
+
+	return nil
+}
+
+// unchanged returns true if the zones a and b hold the same records
+func unchanged(a, b *Zone) bool {
+	soaA, _ := a.SOA(dns.Class(dns.ClassINET))
+	soaB, _ := b.SOA(dns.Class(dns.ClassINET))
+
+	if recordKey(soaA) != recordKey(soaB) {
+		return false
+	}
+
+	d := Diff(a, b)
+	return len(d.Added) == 0 && len(d.Deleted) == 0
+}
+
+// serialGreater returns true if the zone serial a is greater than b using
+// serial number arithmetic (RFC 1982 section 3.2)
+func serialGreater(a, b uint32) bool {
+	return (a < b && b-a > 1<<31) || (a > b && a-b < 1<<31)
+}
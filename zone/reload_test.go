@@ -0,0 +1,240 @@
+package zone
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// writeZone writes a zone file for example.com. with the given serial and
+// hosts
+func writeZone(t *testing.T, file string, serial uint32, hosts ...string) {
+	data := fmt.Sprintf("$TTL 60\n@ IN SOA ns admin %d 7200 600 360000 60\n@ NS ns\nns A 192.0.2.1\n", serial)
+	for i, h := range hosts {
+		data += fmt.Sprintf("%s A 192.0.2.%d\n", h, i+10)
+	}
+
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnswall-zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "example.com.zone")
+	writeZone(t, file, 1, "www", "mail")
+
+	z, err := LoadZoneFile(file, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProvider(z)
+
+	// requests are answered while zones are reloaded
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			m := new(dns.Msg)
+			p.zoneFor("www.example.com.").answer(m, dns.Class(dns.ClassINET), dns.Type(dns.TypeA), "www.example.com.")
+		}
+	}()
+
+	writeZone(t, file, 1, "www")
+	if err := p.Reload("example.com"); err == nil {
+		t.Error("expected reload without serial increase to be refused")
+	}
+
+	writeZone(t, file, 2, "www", "ftp")
+	if err := p.Reload("example.com."); err != nil {
+		t.Fatal(err)
+	}
+
+	close(stop)
+	<-done
+
+	if serial := p.Zones()[0].Serial; serial != 2 {
+		t.Errorf("expected serial 2, got %d", serial)
+	}
+
+	deltas, ok := p.zone("example.com.").Journal().Since(1)
+	if !ok || len(deltas) != 1 {
+		t.Fatalf("expected one journal entry, got %v", deltas)
+	}
+
+	if d := deltas[0]; len(d.Deleted) != 1 || len(d.Added) != 1 || d.Deleted[0].Header().Name != "mail.example.com." || d.Added[0].Header().Name != "ftp.example.com." {
+		t.Errorf("unexpected changes: -%v +%v", d.Deleted, d.Added)
+	}
+
+	// the history cannot be continued without a serial increase
+	writeZone(t, file, 2, "www")
+	if err := p.WithSerialCheck(false).Reload("example.com."); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := p.zone("example.com.").Journal().Since(1); ok {
+		t.Error("expected journal to be reset")
+	}
+}
+
+func TestReloadAllUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnswall-zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "example.com.zone")
+	writeZone(t, file, 1, "www")
+
+	z, err := LoadZoneFile(file, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProvider(z)
+
+	// the file is rewritten with the same content, e.g. on SIGHUP after
+	// editing another zone
+	writeZone(t, file, 1, "www")
+	if err := p.ReloadAll(); err != nil {
+		t.Errorf("expected unchanged zone to be skipped, got %s", err)
+	}
+
+	if p.zone("example.com.") != z {
+		t.Error("unchanged zone has been replaced")
+	}
+
+	// changes still require a serial increase
+	writeZone(t, file, 1, "www", "ftp")
+	if err := p.ReloadAll(); err == nil {
+		t.Error("expected changed zone without serial increase to be refused")
+	}
+
+	writeZone(t, file, 2, "www", "ftp")
+	if err := p.ReloadAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	if serial, _ := p.zone("example.com.").Serial(); serial != 2 {
+		t.Errorf("expected serial 2, got %d", serial)
+	}
+}
+
+func TestReloadZonesDirWithJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnswall-zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "example.com.zone")
+	writeZone(t, file, 1, "www")
+
+	load := func() []*Zone {
+		sources, err := DirSources(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(sources) != 1 || sources[0].File != file {
+			t.Fatalf("expected %s to be the only source, got %v", file, sources)
+		}
+
+		zones, err := LoadZones(sources...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return zones
+	}
+
+	p := NewProvider(load()...).WithUpdatePolicies(UpdatePolicy{Key: "dhcp."})
+
+	m := newUpdate("dhcp.")
+	m.Insert([]dns.RR{newRR(t, "ftp.example.com. 300 A 192.0.2.2")})
+
+	if resp := serve(t, p, "127.0.0.1", m); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("update failed: %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	if _, err := os.Stat(journalFile(file)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the journal is replayed, not loaded as a zone of its own
+	if zones := load(); len(zones) != 1 {
+		t.Errorf("expected one zone, got %d", len(zones))
+	} else if serial, _ := zones[0].Serial(); serial != 2 {
+		t.Errorf("expected serial 2, got %d", serial)
+	}
+
+	// once the zone file moves past the journal, it is removed
+	writeZone(t, file, 3, "www", "ftp")
+	if err := p.ReloadAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	if serial, _ := p.zone("example.com.").Serial(); serial != 3 {
+		t.Errorf("expected serial 3, got %d", serial)
+	}
+
+	if _, err := os.Stat(journalFile(file)); !os.IsNotExist(err) {
+		t.Errorf("expected outdated journal to be removed, got %v", err)
+	}
+
+	// changes that continue the zone file are kept
+	m = newUpdate("dhcp.")
+	m.Insert([]dns.RR{newRR(t, "mail.example.com. 300 A 192.0.2.3")})
+
+	if resp := serve(t, p, "127.0.0.1", m); resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("update failed: %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	if zones := load(); len(zones) != 1 {
+		t.Errorf("expected one zone, got %d", len(zones))
+	} else if serial, _ := zones[0].Serial(); serial != 4 {
+		t.Errorf("expected serial 4, got %d", serial)
+	}
+
+	if _, err := os.Stat(journalFile(file)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSerialGreater(t *testing.T) {
+	cases := []struct {
+		a, b uint32
+		want bool
+	}{
+		{2, 1, true},
+		{1, 2, false},
+		{5, 5, false},
+		{0, 0xffffffff, true},
+		{0xffffffff, 0, false},
+	}
+
+	for _, c := range cases {
+		if got := serialGreater(c.a, c.b); got != c.want {
+			t.Errorf("serialGreater(%d, %d) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
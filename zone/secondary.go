@@ -0,0 +1,532 @@
+package zone
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/homebot/dnswall"
+	"github.com/homebot/dnswall/request"
+	"github.com/miekg/dns"
+)
+
+// DefaultRetry is the interval between attempts to transfer a secondary
+// zone that has not been transferred yet
+var DefaultRetry = time.Minute
+
+// Secondary describes a zone that is transferred from primary servers
+type Secondary struct {
+	// Origin is the name of the zone
+	Origin string
+
+	// Primaries holds the addresses (ip:port) of the primary servers. NOTIFY
+	// messages are only accepted from these addresses
+	Primaries []string
+
+	// File is the file transferred zones are saved to. If it exists, the
+	// zone is loaded from it on start-up so it can be served before the
+	// primaries are reachable. Optional
+	File string
+
+	// Key is the TSIG key used to sign requests to the primaries. Optional
+	Key *TsigKey
+}
+
+// ParseSecondary parses a secondary zone in the format
+// origin=primary[,primary...]. Primaries are IP addresses, those without a
+// port use port 53
+func ParseSecondary(s string) (Secondary, error) {
+	idx := strings.Index(s, "=")
+	if idx <= 0 || idx == len(s)-1 {
+		return Secondary{}, fmt.Errorf("%q: expected origin=primary[,primary...]", s)
+	}
+
+	sec := Secondary{
+		Origin: s[:idx],
+	}
+
+	for _, primary := range strings.Split(s[idx+1:], ",") {
+		if _, _, err := net.SplitHostPort(primary); err != nil {
+			primary = net.JoinHostPort(primary, "53")
+		}
+
+		if err := checkPrimary(primary); err != nil {
+			return Secondary{}, fmt.Errorf("%q: %s", s, err)
+		}
+
+		sec.Primaries = append(sec.Primaries, primary)
+	}
+
+	return sec, nil
+}
+
+// secondary holds the state of a secondary zone served by a Provider
+type secondary struct {
+	Secondary
+
+	// refresh triggers an immediate refresh of the zone
+	refresh chan struct{}
+}
+
+// AddSecondary serves the secondary zone s. The zone is loaded from its
+// file if available and transferred from the primaries in the background.
+// It is refreshed based on the timers of its SOA record (RFC 1035 section
+// 3.3.13) and on NOTIFY messages from its primaries (RFC 1996)
+func (p *Provider) AddSecondary(s Secondary) error {
+	if _, ok := dns.IsDomainName(s.Origin); !ok {
+		return fmt.Errorf("secondary zone %s: invalid origin", s.Origin)
+	}
+
+	if len(s.Primaries) == 0 {
+		return fmt.Errorf("secondary zone %s: no primaries configured", s.Origin)
+	}
+
+	for _, primary := range s.Primaries {
+		if err := checkPrimary(primary); err != nil {
+			return fmt.Errorf("secondary zone %s: %s", s.Origin, err)
+		}
+	}
+
+	s.Origin = dns.Fqdn(s.Origin)
+
+	sec := &secondary{
+		Secondary: s,
+		refresh:   make(chan struct{}, 1),
+	}
+
+	if p.zone(s.Origin) != nil {
+		return fmt.Errorf("secondary zone %s: already served", s.Origin)
+	}
+
+	p.rw.Lock()
+	if p.secondaries == nil {
+		p.secondaries = make(map[string]*secondary)
+	}
+
+	key := strings.ToLower(s.Origin)
+	if _, ok := p.secondaries[key]; ok {
+		p.rw.Unlock()
+		return fmt.Errorf("secondary zone %s: already configured", s.Origin)
+	}
+
+	p.secondaries[key] = sec
+	p.rw.Unlock()
+
+	if s.File != "" {
+		z, err := LoadZoneFile(s.File, s.Origin)
+		switch {
+		case err == nil:
+			p.replace(z)
+		case !os.IsNotExist(err):
+			log.Printf("[zone] secondary zone %s: failed to load %s: %s\n", s.Origin, s.File, err)
+		}
+	}
+
+	go p.maintain(sec)
+
+	return nil
+}
+
+// secondary returns the secondary zone with the given origin
+func (p *Provider) secondary(name string) *secondary {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+
+	return p.secondaries[strings.ToLower(dns.Fqdn(name))]
+}
+
+// maintain keeps the secondary zone s up to date. It stops serving the
+// zone once it could not be refreshed for the expire interval of its SOA
+// record
+func (p *Provider) maintain(s *secondary) {
+	var refreshed time.Time
+
+	if z := p.zone(s.Origin); z != nil {
+		refreshed = z.modTime
+	}
+
+	for {
+		wait := DefaultRetry
+
+		err := p.refreshSecondary(s)
+		if err == nil {
+			refreshed = time.Now()
+		} else {
+			log.Printf("[zone] secondary zone %s: refresh failed:\n%s\n", s.Origin, err)
+		}
+
+		if z := p.zone(s.Origin); z != nil {
+			if soa, ok := z.SOA(dns.Class(dns.ClassINET)); ok {
+				if err == nil {
+					wait = time.Duration(soa.Refresh) * time.Second
+				} else {
+					wait = time.Duration(soa.Retry) * time.Second
+
+					if time.Since(refreshed) > time.Duration(soa.Expire)*time.Second {
+						p.expire(z)
+					}
+				}
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-s.refresh:
+		}
+	}
+}
+
+// trigger schedules an immediate refresh of s
+func (s *secondary) trigger() {
+	select {
+	case s.refresh <- struct{}{}:
+	default:
+	}
+}
+
+// refreshSecondary transfers s from the first primary that succeeds if its
+// serial has been increased and replaces the served zone
+func (p *Provider) refreshSecondary(s *secondary) error {
+	current := p.zone(s.Origin)
+
+	var errs Errors
+
+	for _, primary := range s.Primaries {
+		z, err := s.fetch(primary, current)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", primary, err))
+			continue
+		}
+
+		// up to date
+		if z == nil {
+			return nil
+		}
+
+		if s.File != "" {
+			if err := z.save(s.File); err != nil {
+				log.Printf("[zone] secondary zone %s: failed to save %s: %s\n", s.Origin, s.File, err)
+			}
+		}
+
+		serial, _ := z.Serial()
+		log.Printf("[zone] transferred secondary zone %s from %s (serial %d, %d records)\n", z.Name, primary, serial, z.Len())
+
+		p.replace(z)
+		go p.notifyChanged(z)
+
+		return nil
+	}
+
+	return errs.err()
+}
+
+// replace serves z instead of the zone with the same origin
+func (p *Provider) replace(z *Zone) {
+	p.rw.Lock()
+	defer p.rw.Unlock()
+
+	for i, current := range p.zones {
+		if equal(string(current.Name), string(z.Name)) {
+			p.zones[i] = z
+			return
+		}
+	}
+
+	p.zones = append(p.zones, z)
+}
+
+// expire stops serving z
+func (p *Provider) expire(z *Zone) {
+	p.rw.Lock()
+	defer p.rw.Unlock()
+
+	for i, current := range p.zones {
+		if current == z {
+			p.zones = append(p.zones[:i:i], p.zones[i+1:]...)
+			log.Printf("[zone] secondary zone %s expired\n", z.Name)
+			return
+		}
+	}
+}
+
+// fetch transfers the zone from primary. If current is set and primary has
+// a newer serial, IXFR is used. It returns nil if current is up to date
+func (s *secondary) fetch(primary string, current *Zone) (*Zone, error) {
+	m := new(dns.Msg)
+
+	var soa *dns.SOA
+	if current != nil {
+		soa, _ = current.SOA(dns.Class(dns.ClassINET))
+	}
+
+	if soa != nil {
+		serial, err := s.serial(primary)
+		if err != nil {
+			return nil, err
+		}
+
+		if !serialGreater(serial, soa.Serial) {
+			return nil, nil
+		}
+
+		m.SetIxfr(s.Origin, soa.Serial, soa.Ns, soa.Mbox)
+	} else {
+		m.SetAxfr(s.Origin)
+	}
+
+	t := new(dns.Transfer)
+	if s.Key != nil {
+		t.TsigSecret = s.Key.sign(m)
+	}
+
+	envs, err := t.In(m, primary)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for env := range envs {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+
+		rrs = append(rrs, env.RR...)
+	}
+
+	return apply(s.Origin, current, soa, rrs)
+}
+
+// serial queries the serial of the zone from primary
+func (s *secondary) serial(primary string) (uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(s.Origin, dns.TypeSOA)
+
+	c := new(dns.Client)
+	if s.Key != nil {
+		c.TsigSecret = s.Key.sign(m)
+	}
+
+	resp, _, err := c.Exchange(m, primary)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("SOA query failed: %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	for _, rr := range resp.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+
+	return 0, errors.New("SOA query failed: no SOA record in answer")
+}
+
+// apply returns the zone resulting from the records of a zone transfer.
+// Incremental transfers are applied to current whose SOA record is soa. It
+// returns nil if current is up to date
+func apply(origin string, current *Zone, soa *dns.SOA, rrs []dns.RR) (*Zone, error) {
+	if len(rrs) == 0 {
+		return nil, errors.New("empty zone transfer")
+	}
+
+	first, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, errors.New("zone transfer does not start with a SOA record")
+	}
+
+	if len(rrs) == 1 {
+		if soa != nil && !serialGreater(first.Serial, soa.Serial) {
+			return nil, nil
+		}
+
+		return nil, errors.New("incomplete zone transfer")
+	}
+
+	// incremental transfers continue with the SOA record of our version
+	// (RFC 1995 section 4)
+	if next, ok := rrs[1].(*dns.SOA); ok && soa != nil && len(rrs) > 2 && next.Serial == soa.Serial && first.Serial != soa.Serial {
+		return applyIncremental(current, rrs)
+	}
+
+	z := NewZone(origin)
+	for _, rr := range rrs[:len(rrs)-1] {
+		if !z.Contains(dns.Name(rr.Header().Name)) {
+			continue
+		}
+
+		if z.tree.insert(rr, false) {
+			z.len++
+		}
+	}
+	z.tree.sort()
+
+	if current != nil {
+		z.journal = current.journal
+
+		if serialGreater(first.Serial, soa.Serial) {
+			z.journal.Add(Diff(current, z))
+		} else {
+			z.journal.Reset()
+		}
+	}
+
+	return z, nil
+}
+
+// applyIncremental applies the changes of an incremental zone transfer to
+// a copy of current
+func applyIncremental(current *Zone, rrs []dns.RR) (*Zone, error) {
+	// skip the leading and trailing SOA records
+	deltas, err := splitDeltas(rrs[1 : len(rrs)-1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed incremental zone transfer: %s", err)
+	}
+
+	z := current.clone()
+
+	for _, d := range deltas {
+		z.applyDelta(d)
+		z.journal.Add(d)
+	}
+
+	return z, nil
+}
+
+// clone returns a copy of z that can be modified without affecting z
+func (z *Zone) clone() *Zone {
+	c := NewZone(string(z.Name))
+
+	for _, rr := range z.Records() {
+		if c.tree.insert(rr, false) {
+			c.len++
+		}
+	}
+	c.tree.sort()
+
+	if z.journal != nil {
+		c.journal = z.journal
+	}
+
+	c.file = z.file
+	c.modTime = z.modTime
+
+	return c
+}
+
+// save writes the records of z to file in zone file format. The file is
+// replaced atomically
+func (z *Zone) save(file string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	fmt.Fprintf(w, "$ORIGIN %s\n", z.Name)
+
+	// the SOA record goes first
+	if soa, ok := z.SOA(dns.Class(dns.ClassINET)); ok {
+		fmt.Fprintln(w, soa.String())
+	}
+
+	for _, rr := range z.Records() {
+		if rr.Header().Rrtype == dns.TypeSOA && equal(rr.Header().Name, string(z.Name)) {
+			continue
+		}
+
+		fmt.Fprintln(w, rr.String())
+	}
+
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	z.file = file
+	z.modTime = fi.ModTime()
+
+	return nil
+}
+
+// notify handles NOTIFY messages (RFC 1996) of primaries for secondary
+// zones by refreshing the zone immediately. NOTIFY messages for other zones
+// are refused
+func (p *Provider) notify(session *dnswall.Session, req *request.Request) error {
+	s := p.secondary(string(req.Name()))
+	if s == nil {
+		log.Printf("[zone] refusing NOTIFY for %s from %s: not a secondary zone\n", req.Name(), req.ClientIP())
+		return session.Reject(dns.RcodeRefused)
+	}
+
+	if !s.isPrimary(req.ClientIP()) {
+		log.Printf("[zone] ignoring NOTIFY for %s from %s: not a primary\n", s.Origin, req.ClientIP())
+		return session.Reject(dns.RcodeRefused)
+	}
+
+	log.Printf("[zone] received NOTIFY for %s from %s\n", s.Origin, req.ClientIP())
+	s.trigger()
+
+	m := session.Prepare()
+	m.Authoritative = true
+
+	return session.ResolveWith(m)
+}
+
+// isPrimary returns true if ip is the address of a primary of s
+func (s *secondary) isPrimary(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	// primaries are validated to be ip:port by AddSecondary
+	for _, primary := range s.Primaries {
+		host, _, _ := net.SplitHostPort(primary)
+		if net.ParseIP(host).Equal(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPrimary returns an error if the address of primary is not an IP
+// address. Host names are rejected as NOTIFY messages are accepted by
+// source address
+func checkPrimary(primary string) error {
+	host, _, err := net.SplitHostPort(primary)
+	if err != nil {
+		return fmt.Errorf("primary %q: %s", primary, err)
+	}
+
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("primary %q: not an IP address", primary)
+	}
+
+	return nil
+}
@@ -0,0 +1,255 @@
+package zone
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/homebot/dnswall"
+	"github.com/homebot/dnswall/request"
+	"github.com/homebot/dnswall/server"
+	"github.com/miekg/dns"
+)
+
+// responseWriter records the response written to a UDP client
+type responseWriter struct {
+	remote net.IP
+	msg    *dns.Msg
+}
+
+func (w *responseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *responseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: w.remote, Port: 5353}
+}
+
+func (w *responseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *responseWriter) Write(buf []byte) (int, error) { return len(buf), nil }
+func (w *responseWriter) Close() error                  { return nil }
+func (w *responseWriter) TsigStatus() error             { return nil }
+func (w *responseWriter) TsigTimersOnly(bool)           {}
+func (w *responseWriter) Hijack()                       {}
+
+// serve answers req from the client at ip using p
+func serve(t *testing.T, p *Provider, ip string, req *dns.Msg) *dns.Msg {
+	w := &responseWriter{remote: net.ParseIP(ip)}
+
+	session := dnswall.NewSession([]dnswall.Middleware{p}, &request.Request{W: w, Req: req}, w)
+	if err := session.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if w.msg == nil {
+		t.Fatal("no response has been written")
+	}
+
+	return w.msg
+}
+
+// primaryStandIn serves p on a random local port over UDP and TCP. Requests
+// signed with key are validated and their responses signed
+func primaryStandIn(t *testing.T, p *Provider, key TsigKey) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		l.Close()
+		t.Fatal(err)
+	}
+
+	secrets := map[string]string{key.Name: key.Secret}
+	handler := server.New().Use(p)
+
+	tcp := &dns.Server{Listener: l, Handler: handler, TsigSecret: secrets}
+	udp := &dns.Server{PacketConn: pc, Handler: handler, TsigSecret: secrets}
+
+	go tcp.ActivateAndServe()
+	go udp.ActivateAndServe()
+
+	return l.Addr().String(), func() {
+		tcp.Shutdown()
+		udp.Shutdown()
+	}
+}
+
+// waitForSerial waits until p serves example.com. with the given serial
+func waitForSerial(t *testing.T, p *Provider, serial uint32) *Zone {
+	for i := 0; i < 100; i++ {
+		if z := p.zone("example.com."); z != nil {
+			if s, _ := z.Serial(); s == serial {
+				return z
+			}
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("example.com. has not been transferred with serial %d: %v", serial, p.Zones())
+	return nil
+}
+
+func TestSecondary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnswall-zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "primary.zone")
+	writeZone(t, file, 1, "www", "mail")
+
+	z, err := LoadZoneFile(file, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ParseTsigKey("hmac-sha512:xfr:c2VjcmV0c2VjcmV0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	primary := NewProvider(z).WithTransfers(TransferACL{Keys: []TsigKey{key}})
+
+	addr, stop := primaryStandIn(t, primary, key)
+	defer stop()
+
+	saved := filepath.Join(dir, "secondary.zone")
+
+	p := NewProvider()
+	if err := p.AddSecondary(Secondary{Origin: "example.com", Primaries: []string{addr}, File: saved, Key: &key}); err != nil {
+		t.Fatal(err)
+	}
+
+	if z := waitForSerial(t, p, 1); z.Len() != 5 {
+		t.Errorf("expected 5 records, got %d", z.Len())
+	}
+
+	writeZone(t, file, 2, "www", "ftp")
+	if err := primary.Reload("example.com."); err != nil {
+		t.Fatal(err)
+	}
+
+	notify := new(dns.Msg)
+	notify.SetNotify("example.com.")
+
+	// only primaries may trigger a refresh
+	if m := serve(t, p, "192.0.2.1", notify); m.Rcode != dns.RcodeRefused {
+		t.Errorf("expected NOTIFY from other hosts to be refused, got %s", dns.RcodeToString[m.Rcode])
+	}
+
+	if m := serve(t, p, "127.0.0.1", notify); m.Rcode != dns.RcodeSuccess || !m.Authoritative {
+		t.Errorf("unexpected response to NOTIFY of primary: %v", m)
+	}
+
+	z = waitForSerial(t, p, 2)
+	if _, ok := z.Lookup(dns.Class(dns.ClassINET), dns.Type(dns.TypeA), "ftp.example.com."); !ok {
+		t.Error("changes of the primary have not been transferred")
+	}
+
+	// zones are served from their file until the primaries are reachable
+	offline := NewProvider()
+	if err := offline.AddSecondary(Secondary{Origin: "example.com", Primaries: []string{"127.0.0.1:1"}, File: saved}); err != nil {
+		t.Fatal(err)
+	}
+
+	if z := offline.zone("example.com."); z == nil || z.Len() != 5 {
+		t.Errorf("secondary zone has not been loaded from %s", saved)
+	}
+}
+
+func TestSecondaryTransferRequiresKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnswall-zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "primary.zone")
+	writeZone(t, file, 1, "www")
+
+	z, err := LoadZoneFile(file, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ParseTsigKey("xfr:c2VjcmV0c2VjcmV0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, stop := primaryStandIn(t, NewProvider(z).WithTransfers(TransferACL{Keys: []TsigKey{key}}), key)
+	defer stop()
+
+	s := &secondary{Secondary: Secondary{Origin: "example.com.", Primaries: []string{addr}}}
+	if _, err := s.fetch(addr, nil); err == nil {
+		t.Error("expected unsigned transfer to be refused")
+	}
+
+	s.Key = &key
+	if _, err := s.fetch(addr, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNotifyRefusesOtherZones(t *testing.T) {
+	z, err := LoadZone("example.com.", strings.NewReader("@ 60 IN SOA ns admin 1 7200 600 360000 60\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notify := new(dns.Msg)
+
+	for _, name := range []string{"example.com.", "example.org."} {
+		notify.SetNotify(name)
+
+		if m := serve(t, NewProvider(z), "127.0.0.1", notify); m.Rcode != dns.RcodeRefused {
+			t.Errorf("expected NOTIFY for %s to be refused, got %s", name, dns.RcodeToString[m.Rcode])
+		}
+	}
+}
+
+func TestParseSecondary(t *testing.T) {
+	cases := []struct {
+		in        string
+		primaries []string
+		err       bool
+	}{
+		{"example.com=192.0.2.1", []string{"192.0.2.1:53"}, false},
+		{"example.com=192.0.2.1:5353,2001:db8::1", []string{"192.0.2.1:5353", "[2001:db8::1]:53"}, false},
+		{"example.com=[2001:db8::1]:5353", []string{"[2001:db8::1]:5353"}, false},
+		{"example.com=ns1.example.net", nil, true},
+		{"example.com=192.0.2.1,ns1.example.net:53", nil, true},
+		{"example.com=", nil, true},
+		{"=192.0.2.1", nil, true},
+	}
+
+	for _, c := range cases {
+		s, err := ParseSecondary(c.in)
+		if (err != nil) != c.err {
+			t.Errorf("ParseSecondary(%q): unexpected error %v", c.in, err)
+			continue
+		}
+
+		if strings.Join(s.Primaries, " ") != strings.Join(c.primaries, " ") {
+			t.Errorf("ParseSecondary(%q) = %v, want %v", c.in, s.Primaries, c.primaries)
+		}
+	}
+
+	if err := NewProvider().AddSecondary(Secondary{Origin: "example.com", Primaries: []string{"ns1.example.net:53"}}); err == nil {
+		t.Error("expected host name primary to be rejected")
+	}
+}
@@ -0,0 +1,246 @@
+package zone
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/homebot/dnswall"
+	"github.com/homebot/dnswall/request"
+	"github.com/miekg/dns"
+)
+
+// transferSize is the maximum number of bytes of records sent per message
+// of a zone transfer
+const transferSize = 32 * 1024
+
+// TransferACL restricts which clients may transfer zones
+type TransferACL struct {
+	// Networks holds the networks clients must connect from. Clients from
+	// any network are allowed if empty
+	Networks []*net.IPNet
+
+	// Keys holds the TSIG keys requests must be signed with. Unsigned
+	// requests are allowed if empty
+	Keys []TsigKey
+}
+
+// Allowed returns true if the client of req may transfer zones
+func (acl TransferACL) Allowed(req *request.Request) bool {
+	if len(acl.Networks) > 0 {
+		ip := net.ParseIP(req.ClientIP())
+		if ip == nil {
+			return false
+		}
+
+		found := false
+		for _, n := range acl.Networks {
+			if n.Contains(ip) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(acl.Keys) > 0 {
+		for _, key := range acl.Keys {
+			if key.signed(req) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// WithTransfers allows clients matching acl to transfer zones using AXFR
+// and IXFR. Zone transfers are refused by default
+func (p *Provider) WithTransfers(acl TransferACL) *Provider {
+	p.rw.Lock()
+	defer p.rw.Unlock()
+
+	p.transfers = &acl
+
+	return p
+}
+
+// transfer serves AXFR and IXFR requests (RFC 5936 and RFC 1995)
+func (p *Provider) transfer(session *dnswall.Session, req *request.Request) error {
+	zone := p.zoneFor(req.Name())
+	if zone == nil {
+		return session.Next()
+	}
+
+	if !equal(string(zone.Name), string(req.Name())) {
+		return session.Reject(dns.RcodeNotAuth)
+	}
+
+	p.rw.RLock()
+	acl := p.transfers
+	p.rw.RUnlock()
+
+	if acl != nil && badKey(req, acl.Keys) {
+		return session.Reject(dns.RcodeNotAuth)
+	}
+
+	if acl == nil || !acl.Allowed(req) {
+		log.Printf("[zone] refused transfer of %s to %s\n", zone.Name, session.RemoteAddr())
+		return session.Reject(dns.RcodeRefused)
+	}
+
+	_, tcp := session.RemoteAddr().(*net.TCPAddr)
+
+	var serial uint32
+
+	switch uint16(req.Type()) {
+	case dns.TypeAXFR:
+		// AXFR is only available over TCP (RFC 5936 section 4.2)
+		if !tcp {
+			return session.Reject(dns.RcodeRefused)
+		}
+
+	case dns.TypeIXFR:
+		found := false
+
+		for _, rr := range req.Req.Ns {
+			if s, ok := rr.(*dns.SOA); ok {
+				serial, found = s.Serial, true
+				break
+			}
+		}
+
+		if !found {
+			return session.Reject(dns.RcodeFormatError)
+		}
+	}
+
+	// the records are collected at once so they are not mixed up with
+	// dynamic updates
+	zone.rw.RLock()
+
+	soa, ok := zone.SOA(req.Class())
+
+	var rrs []dns.RR
+	switch {
+	case !ok:
+	case uint16(req.Type()) == dns.TypeAXFR:
+		rrs = axfr(zone, soa)
+	default:
+		rrs = ixfr(zone, soa, serial)
+	}
+
+	zone.rw.RUnlock()
+
+	if !ok {
+		return session.Reject(dns.RcodeServerFailure)
+	}
+
+	// send just the current SOA if an incremental transfer does not fit
+	// into a single UDP response so the client retries over TCP (RFC 1995
+	// section 2)
+	if uint16(req.Type()) == dns.TypeIXFR && !tcp {
+		m := session.Prepare()
+		m.Answer = rrs
+
+		size := dns.MinMsgSize
+		if opt := req.Req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+
+		if m.Len() > size {
+			rrs = []dns.RR{soa}
+		}
+	}
+
+	log.Printf("[zone] transferring %s (%s, %d records) to %s\n", zone.Name, dns.TypeToString[uint16(req.Type())], len(rrs), session.RemoteAddr())
+
+	return p.stream(session, req, rrs)
+}
+
+// stream sends rrs to the client split into messages of at most
+// transferSize bytes. If the request has been signed, each message is
+// signed as well (RFC 2845 section 4.4)
+func (p *Provider) stream(session *dnswall.Session, req *request.Request, rrs []dns.RR) error {
+	tsig := req.GetTsig()
+	signed := tsig != nil && session.TsigStatus() == nil
+
+	for i, first := 0, true; i < len(rrs) || first; first = false {
+		m := session.Prepare()
+		m.Authoritative = true
+
+		size := 0
+		for ; i < len(rrs); i++ {
+			l := dns.Len(rrs[i])
+			if size > 0 && size+l > transferSize {
+				break
+			}
+
+			// records of the zone must not be modified by packing
+			size += l
+			m.Answer = append(m.Answer, dns.Copy(rrs[i]))
+		}
+
+		if signed {
+			m.SetTsig(tsig.Header().Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+			session.TsigTimersOnly(!first)
+		}
+
+		if err := session.WriteMsg(m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// axfr returns the records of a full zone transfer: the SOA record, all
+// other records of the zone and the SOA record again
+func axfr(zone *Zone, soa *dns.SOA) []dns.RR {
+	rrs := make([]dns.RR, 0, zone.Len()+1)
+	rrs = append(rrs, soa)
+
+	for _, rr := range zone.Records() {
+		if rr.Header().Rrtype == dns.TypeSOA && equal(rr.Header().Name, string(zone.Name)) {
+			continue
+		}
+
+		rrs = append(rrs, rr)
+	}
+
+	return append(rrs, soa)
+}
+
+// ixfr returns the records of an incremental zone transfer for a client
+// at the given serial. It falls back to a full transfer if the journal does
+// not cover the changes since serial
+func ixfr(zone *Zone, soa *dns.SOA, serial uint32) []dns.RR {
+	// the client is up to date
+	if !serialGreater(soa.Serial, serial) {
+		return []dns.RR{soa}
+	}
+
+	if zone.journal == nil {
+		return axfr(zone, soa)
+	}
+
+	deltas, ok := zone.journal.Since(serial)
+	if !ok || deltas[len(deltas)-1].To.Serial != soa.Serial {
+		return axfr(zone, soa)
+	}
+
+	rrs := []dns.RR{soa}
+	for _, d := range deltas {
+		rrs = append(rrs, d.From)
+		rrs = append(rrs, d.Deleted...)
+		rrs = append(rrs, d.To)
+		rrs = append(rrs, d.Added...)
+	}
+
+	return append(rrs, soa)
+}
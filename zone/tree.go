@@ -0,0 +1,359 @@
+package zone
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// node is a node of the name tree that stores the records of a zone. Each
+// node holds the records of a single owner name indexed by type. Nodes
+// without records are empty non-terminals and are removed once they have
+// no children left. Children are kept sorted in canonical order (RFC 4034
+// section 6.1)
+type node struct {
+	label  string
+	name   string
+	parent *node
+
+	children map[string]*node
+	sorted   []string
+
+	rrsets map[uint16][]dns.RR
+}
+
+// newTree returns the root node of a new, empty name tree
+func newTree() *node {
+	return &node{name: "."}
+}
+
+// labels returns the canonical form of the labels of name starting at the
+// root. Comparing them as strings yields the canonical order
+func labels(name string) []string {
+	var l []string
+
+	start := 0
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '\\':
+			// skip the escaped character, the dot of "\." does not
+			// separate labels
+			i++
+		case '.':
+			if i > start {
+				l = append(l, canonicalLabel(name[start:i]))
+			}
+			start = i + 1
+		}
+	}
+
+	if start < len(name) {
+		l = append(l, canonicalLabel(name[start:]))
+	}
+
+	for i, j := 0, len(l)-1; i < j; i, j = i+1, j-1 {
+		l[i], l[j] = l[j], l[i]
+	}
+
+	return l
+}
+
+// canonicalLabel returns the label in presentation format l as raw octets
+// with uppercase US-ASCII letters converted to lowercase (RFC 4034 section
+// 6.1)
+func canonicalLabel(l string) string {
+	if !strings.ContainsAny(l, "\\ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+		return l
+	}
+
+	b := make([]byte, 0, len(l))
+
+	for i := 0; i < len(l); i++ {
+		c := l[i]
+
+		if c == '\\' && i+1 < len(l) {
+			if i+3 < len(l) && isDigit(l[i+1]) && isDigit(l[i+2]) && isDigit(l[i+3]) {
+				c = (l[i+1]-'0')*100 + (l[i+2]-'0')*10 + (l[i+3] - '0')
+				i += 3
+			} else {
+				c = l[i+1]
+				i++
+			}
+		}
+
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+
+		b = append(b, c)
+	}
+
+	return string(b)
+}
+
+// isDigit returns true if c is a decimal digit
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// find returns the deepest node on the path to name and whether it is the
+// node of name itself
+func (n *node) find(name string) (*node, bool) {
+	for _, l := range labels(name) {
+		child, ok := n.children[l]
+		if !ok {
+			return n, false
+		}
+
+		n = child
+	}
+
+	return n, true
+}
+
+// lookup returns the node of name
+func (n *node) lookup(name string) (*node, bool) {
+	match, ok := n.find(name)
+	if !ok {
+		return nil, false
+	}
+
+	return match, true
+}
+
+// insert adds rr to the tree and creates all nodes on the path to its
+// owner name. It returns false if rr is already part of the tree. If
+// ordered is false, new nodes are not put at their canonical position and
+// sort must be called once all records have been inserted. This avoids
+// moving the children of wide nodes on each insert while loading zones
+func (n *node) insert(rr dns.RR, ordered bool) bool {
+	name := dns.Fqdn(rr.Header().Name)
+	offsets := dns.Split(name)
+
+	for i, l := range labels(name) {
+		child, ok := n.children[l]
+		if !ok {
+			child = &node{
+				label:  l,
+				name:   name[offsets[len(offsets)-1-i]:],
+				parent: n,
+			}
+
+			n.addChild(child, ordered)
+		}
+
+		n = child
+	}
+
+	if n.rrsets == nil {
+		n.rrsets = make(map[uint16][]dns.RR)
+	}
+
+	t := rr.Header().Rrtype
+	for _, existing := range n.rrsets[t] {
+		if duplicate(existing, rr) {
+			return false
+		}
+	}
+
+	n.rrsets[t] = append(n.rrsets[t], rr)
+
+	return true
+}
+
+// remove removes rr from the tree and prunes nodes that are left without
+// records and children. It returns false if rr is not part of the tree
+func (n *node) remove(rr dns.RR) bool {
+	match, ok := n.lookup(rr.Header().Name)
+	if !ok {
+		return false
+	}
+
+	t := rr.Header().Rrtype
+	rrs := match.rrsets[t]
+
+	for i, existing := range rrs {
+		if !duplicate(existing, rr) {
+			continue
+		}
+
+		rrs = append(rrs[:i:i], rrs[i+1:]...)
+		if len(rrs) == 0 {
+			delete(match.rrsets, t)
+		} else {
+			match.rrsets[t] = rrs
+		}
+
+		match.prune()
+		return true
+	}
+
+	return false
+}
+
+// addChild adds child to the children of n. If ordered is set, it is
+// added at its canonical position
+func (n *node) addChild(child *node, ordered bool) {
+	if n.children == nil {
+		n.children = make(map[string]*node)
+	}
+
+	n.children[child.label] = child
+
+	if !ordered {
+		n.sorted = append(n.sorted, child.label)
+		return
+	}
+
+	idx := sort.SearchStrings(n.sorted, child.label)
+	n.sorted = append(n.sorted, "")
+	copy(n.sorted[idx+1:], n.sorted[idx:])
+	n.sorted[idx] = child.label
+}
+
+// sort puts the children of n and all its descendants into canonical
+// order
+func (n *node) sort() {
+	n.walk(func(c *node) bool {
+		sort.Strings(c.sorted)
+		return true
+	})
+}
+
+// prune removes n and its ancestors from the tree as long as they have
+// neither records nor children
+func (n *node) prune() {
+	for n.parent != nil && len(n.rrsets) == 0 && len(n.children) == 0 {
+		p := n.parent
+
+		delete(p.children, n.label)
+
+		idx := sort.SearchStrings(p.sorted, n.label)
+		p.sorted = append(p.sorted[:idx], p.sorted[idx+1:]...)
+
+		n = p
+	}
+}
+
+// walk calls fn for n and all its descendants in canonical order. Walking
+// stops as soon as fn returns false
+func (n *node) walk(fn func(*node) bool) bool {
+	if !fn(n) {
+		return false
+	}
+
+	for _, l := range n.sorted {
+		if !n.children[l].walk(fn) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// last returns the last descendant of n in canonical order
+func (n *node) last() *node {
+	for len(n.sorted) > 0 {
+		n = n.children[n.sorted[len(n.sorted)-1]]
+	}
+
+	return n
+}
+
+// predecessor returns the node with records that precedes name in
+// canonical order, i.e. the owner of the NSEC record covering name
+func (n *node) predecessor(name string) (*node, bool) {
+	l := labels(name)
+
+	// collect the path to name as far as it exists
+	path := []*node{n}
+	for _, label := range l {
+		child, ok := path[len(path)-1].children[label]
+		if !ok {
+			break
+		}
+
+		path = append(path, child)
+	}
+
+	// descendants of name sort after it, start looking at its parent
+	if len(path) == len(l)+1 {
+		path = path[:len(path)-1]
+	}
+
+	for depth := len(path) - 1; depth >= 0; depth-- {
+		current := path[depth]
+		label := l[depth]
+
+		// the last name below the closest smaller sibling precedes name
+		idx := sort.SearchStrings(current.sorted, label)
+		if idx > 0 {
+			return current.children[current.sorted[idx-1]].last(), true
+		}
+
+		// otherwise the parent itself does if it holds records
+		if len(current.rrsets) > 0 {
+			return current, true
+		}
+	}
+
+	return nil, false
+}
+
+// rrset returns copies of the records of n with the given class and type.
+// Records are copied as packing a message modifies them, so they must not
+// be shared between concurrent responses
+func (n *node) rrset(class dns.Class, rtype uint16) []dns.RR {
+	var rrs []dns.RR
+
+	for _, rr := range n.rrsets[rtype] {
+		if rr.Header().Class == uint16(class) {
+			rrs = append(rrs, dns.Copy(rr))
+		}
+	}
+
+	return rrs
+}
+
+// has returns true if n holds records with the given class and type
+func (n *node) has(class dns.Class, rtype uint16) bool {
+	for _, rr := range n.rrsets[rtype] {
+		if rr.Header().Class == uint16(class) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// records returns all records of n
+func (n *node) records() []dns.RR {
+	types := make([]int, 0, len(n.rrsets))
+	for t := range n.rrsets {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+
+	var rrs []dns.RR
+	for _, t := range types {
+		rrs = append(rrs, n.rrsets[uint16(t)]...)
+	}
+
+	return rrs
+}
+
+// duplicate returns true if a and b only differ in their TTL and the case
+// of their owner names (RFC 2181 section 5)
+func duplicate(a, b dns.RR) bool {
+	if a.Header().Rrtype != b.Header().Rrtype || a.Header().Class != b.Header().Class {
+		return false
+	}
+
+	ca, cb := dns.Copy(a), dns.Copy(b)
+	ca.Header().Ttl, cb.Header().Ttl = 0, 0
+	ca.Header().Name = strings.ToLower(dns.Fqdn(ca.Header().Name))
+	cb.Header().Name = strings.ToLower(dns.Fqdn(cb.Header().Name))
+
+	return ca.String() == cb.String()
+}
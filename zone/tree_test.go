@@ -0,0 +1,167 @@
+package zone
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newRR(t testing.TB, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rr
+}
+
+func TestTreeCanonicalOrder(t *testing.T) {
+	z := NewZone("example.")
+
+	// inserted in random order
+	for _, s := range []string{
+		"example. 60 IN SOA ns.example. admin.example. 1 7200 600 360000 60",
+		"a.example. 60 IN A 192.0.2.1",
+		"Z.a.example. 60 IN A 192.0.2.1",
+		"zABC.a.EXAMPLE. 60 IN A 192.0.2.1",
+		"*.z.example. 60 IN A 192.0.2.1",
+		"\\001.z.example. 60 IN A 192.0.2.1",
+		"z.example. 60 IN A 192.0.2.1",
+		"yljkjljk.a.example. 60 IN A 192.0.2.1",
+		"\\200.z.example. 60 IN A 192.0.2.1",
+	} {
+		if !z.Insert(newRR(t, s)) {
+			t.Fatalf("%q has been rejected", s)
+		}
+	}
+
+	if z.Insert(newRR(t, "A.example. 300 IN A 192.0.2.1")) {
+		t.Error("duplicate record with different case and TTL has been inserted")
+	}
+
+	var names []string
+	for _, rr := range z.Records() {
+		names = append(names, rr.Header().Name)
+	}
+
+	// RFC 4034 section 6.1
+	want := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example.", "\\001.z.example.", "*.z.example.", "\\200.z.example."}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("unexpected order:\n got: %v\nwant: %v", names, want)
+	}
+
+	previous := map[string]string{
+		"a.example.":   "example.",
+		"x.a.example.": "a.example.",
+		"b.example.":   "zABC.a.EXAMPLE.",
+		"zz.example.":  "\\200.z.example.",
+	}
+
+	for name, want := range previous {
+		if got, _ := z.Previous(dns.Name(name)); string(got) != want {
+			t.Errorf("Previous(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestTreePrunesEmptyNonTerminals(t *testing.T) {
+	z := NewZone("example.")
+
+	deep := newRR(t, "a.b.c.example. 60 IN A 192.0.2.1")
+	z.Insert(newRR(t, "example. 60 IN SOA ns.example. admin.example. 1 7200 600 360000 60"))
+	z.Insert(deep)
+
+	// empty non-terminals exist (RFC 4592 section 2.2.2)
+	if !z.Exists(dns.Class(dns.ClassINET), "b.c.example.") {
+		t.Error("expected empty non-terminal to exist")
+	}
+
+	if z.Remove(newRR(t, "a.b.c.example. 60 IN A 192.0.2.2")) {
+		t.Error("removed a record that is not part of the zone")
+	}
+
+	if !z.Remove(deep) {
+		t.Fatal("failed to remove record")
+	}
+
+	if z.Exists(dns.Class(dns.ClassINET), "c.example.") {
+		t.Error("expected empty non-terminals to be pruned")
+	}
+
+	if z.Len() != 1 {
+		t.Errorf("expected 1 record, got %d", z.Len())
+	}
+}
+
+func TestTreeReturnsCopies(t *testing.T) {
+	z := NewZone("example.")
+	z.Insert(newRR(t, "www.example. 60 IN A 192.0.2.1"))
+
+	rrs, ok := z.Lookup(dns.Class(dns.ClassINET), dns.Type(dns.TypeA), "WWW.example.")
+	if !ok || len(rrs) != 1 {
+		t.Fatalf("unexpected lookup result %v", rrs)
+	}
+
+	rrs[0].Header().Ttl = 1
+
+	rrs, _ = z.Lookup(dns.Class(dns.ClassINET), dns.Type(dns.TypeA), "www.example.")
+	if rrs[0].Header().Ttl != 60 {
+		t.Error("records of the zone have been modified through a lookup")
+	}
+}
+
+// bigZone returns a zone with n hosts spread across 100 subdomains
+func bigZone(b *testing.B, n int) *Zone {
+	var buf strings.Builder
+
+	buf.WriteString("$TTL 300\n@ IN SOA ns admin 1 7200 600 360000 60\n NS ns\nns A 10.0.0.1\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "host%d.dept%d A 10.%d.%d.%d\n", i, i%100, i%250, (i/250)%250, i%200)
+	}
+
+	z, err := LoadZone("example.com.", strings.NewReader(buf.String()))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return z
+}
+
+func BenchmarkLoadZone(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		bigZone(b, 200000)
+	}
+}
+
+func BenchmarkAnswer(b *testing.B) {
+	z := bigZone(b, 200000)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		host := i % 200000
+		name := dns.Name(fmt.Sprintf("host%d.dept%d.example.com.", host, host%100))
+
+		m := new(dns.Msg)
+		z.answer(m, dns.Class(dns.ClassINET), dns.Type(dns.TypeA), name)
+
+		if len(m.Answer) != 1 {
+			b.Fatalf("unexpected answer for %s: %v", name, m.Answer)
+		}
+	}
+}
+
+func BenchmarkAnswerNXDomain(b *testing.B) {
+	z := bigZone(b, 200000)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m := new(dns.Msg)
+		z.answer(m, dns.Class(dns.ClassINET), dns.Type(dns.TypeA), "missing.dept3.example.com.")
+
+		if m.Rcode != dns.RcodeNameError {
+			b.Fatalf("expected NXDOMAIN, got %s", dns.RcodeToString[m.Rcode])
+		}
+	}
+}
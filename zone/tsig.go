@@ -0,0 +1,121 @@
+package zone
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/homebot/dnswall/request"
+	"github.com/miekg/dns"
+)
+
+// DefaultTsigAlgorithm is used for TSIG keys configured without algorithm
+var DefaultTsigAlgorithm = dns.HmacSHA256
+
+// tsigAlgorithms maps the names of the supported TSIG algorithms to their
+// identifiers (RFC 8945 section 6)
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// TsigKey is a key used to sign messages with transaction signatures
+// (RFC 8945)
+type TsigKey struct {
+	// Name is the name of the key
+	Name string
+
+	// Algorithm is the HMAC algorithm of the key, e.g. dns.HmacSHA256
+	Algorithm string
+
+	// Secret is the base64 encoded secret of the key
+	Secret string
+}
+
+// ParseTsigKey parses a TSIG key in the format [algorithm:]name:secret.
+// The algorithm is one of hmac-md5, hmac-sha1, hmac-sha256 and hmac-sha512
+// and defaults to DefaultTsigAlgorithm
+func ParseTsigKey(s string) (TsigKey, error) {
+	parts := strings.Split(s, ":")
+
+	key := TsigKey{
+		Algorithm: DefaultTsigAlgorithm,
+	}
+
+	switch len(parts) {
+	case 2:
+		key.Name, key.Secret = parts[0], parts[1]
+	case 3:
+		alg, ok := tsigAlgorithms[strings.ToLower(strings.TrimSuffix(parts[0], "."))]
+		if !ok {
+			return TsigKey{}, fmt.Errorf("%q: unsupported algorithm %q", s, parts[0])
+		}
+
+		key.Algorithm, key.Name, key.Secret = alg, parts[1], parts[2]
+	default:
+		return TsigKey{}, fmt.Errorf("%q: expected [algorithm:]name:secret", s)
+	}
+
+	if key.Name == "" || key.Secret == "" {
+		return TsigKey{}, fmt.Errorf("%q: expected [algorithm:]name:secret", s)
+	}
+
+	if _, err := base64.StdEncoding.DecodeString(key.Secret); err != nil {
+		return TsigKey{}, fmt.Errorf("%q: invalid secret: %s", s, err)
+	}
+
+	key.Name = dns.Fqdn(key.Name)
+
+	return key, nil
+}
+
+// sign adds a transaction signature using k to m and returns the secrets
+// a client needs to sign m when it is sent
+func (k *TsigKey) sign(m *dns.Msg) map[string]string {
+	m.SetTsig(dns.Fqdn(k.Name), k.algorithm(), 300, time.Now().Unix())
+
+	return map[string]string{dns.Fqdn(k.Name): k.Secret}
+}
+
+// algorithm returns the algorithm of k or DefaultTsigAlgorithm if not set
+func (k *TsigKey) algorithm() string {
+	if k.Algorithm == "" {
+		return DefaultTsigAlgorithm
+	}
+
+	return k.Algorithm
+}
+
+// signed returns true if req carries a valid signature created with k
+func (k *TsigKey) signed(req *request.Request) bool {
+	tsig := req.GetTsig()
+	if tsig == nil || req.IsSignatureValid() != nil {
+		return false
+	}
+
+	return equal(tsig.Header().Name, k.Name) && equal(tsig.Algorithm, k.algorithm())
+}
+
+// badKey returns true if req has been signed using the name of one of keys
+// but another algorithm. Such requests are answered with NOTAUTH (BADKEY,
+// RFC 8945 section 5.2.1) as the server cannot know the key that has been
+// used
+func badKey(req *request.Request, keys []TsigKey) bool {
+	tsig := req.GetTsig()
+	if tsig == nil {
+		return false
+	}
+
+	for _, k := range keys {
+		if equal(tsig.Header().Name, k.Name) && !equal(tsig.Algorithm, k.algorithm()) {
+			log.Printf("[zone] rejecting request from %s signed with key %s using %s instead of %s\n", req.ClientIP(), k.Name, tsig.Algorithm, k.algorithm())
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,81 @@
+package zone
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseTsigKey(t *testing.T) {
+	cases := []struct {
+		in   string
+		want TsigKey
+		err  bool
+	}{
+		{"xfr:c2VjcmV0", TsigKey{Name: "xfr.", Algorithm: dns.HmacSHA256, Secret: "c2VjcmV0"}, false},
+		{"hmac-md5:xfr.:c2VjcmV0", TsigKey{Name: "xfr.", Algorithm: dns.HmacMD5, Secret: "c2VjcmV0"}, false},
+		{"HMAC-SHA512.:xfr:c2VjcmV0", TsigKey{Name: "xfr.", Algorithm: dns.HmacSHA512, Secret: "c2VjcmV0"}, false},
+		{"hmac-sha3:xfr:c2VjcmV0", TsigKey{}, true},
+		{"xfr:not base64", TsigKey{}, true},
+		{"xfr", TsigKey{}, true},
+		{":c2VjcmV0", TsigKey{}, true},
+		{"a:b:c:d", TsigKey{}, true},
+	}
+
+	for _, c := range cases {
+		key, err := ParseTsigKey(c.in)
+		if (err != nil) != c.err {
+			t.Errorf("ParseTsigKey(%q): unexpected error %v", c.in, err)
+			continue
+		}
+
+		if key != c.want {
+			t.Errorf("ParseTsigKey(%q) = %+v, want %+v", c.in, key, c.want)
+		}
+	}
+}
+
+func TestTsigAlgorithmMismatch(t *testing.T) {
+	z, err := LoadZone("example.com.", strings.NewReader("@ 60 IN SOA ns admin 1 7200 600 360000 60\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ParseTsigKey("hmac-sha512:admin:c2VjcmV0c2VjcmV0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProvider(z).
+		WithTransfers(TransferACL{Keys: []TsigKey{key}}).
+		WithUpdatePolicies(UpdatePolicy{Key: key.Name, Algorithm: key.Algorithm})
+
+	for _, c := range []struct {
+		algorithm string
+		rcode     int
+	}{
+		{dns.HmacSHA512, dns.RcodeSuccess},
+		{dns.HmacSHA256, dns.RcodeNotAuth},
+		{dns.HmacSHA1, dns.RcodeNotAuth},
+	} {
+		// AXFR is refused over UDP, an up-to-date IXFR is answered
+		xfr := new(dns.Msg)
+		xfr.SetIxfr("example.com.", 1, "ns.example.com.", "admin.example.com.")
+		xfr.SetTsig(key.Name, c.algorithm, 300, time.Now().Unix())
+
+		if m := serve(t, p, "127.0.0.1", xfr); m.Rcode != c.rcode {
+			t.Errorf("transfer signed with %s: expected %s, got %s", c.algorithm, dns.RcodeToString[c.rcode], dns.RcodeToString[m.Rcode])
+		}
+
+		update := new(dns.Msg)
+		update.SetUpdate("example.com.")
+		update.Insert([]dns.RR{newRR(t, "www.example.com. 300 A 192.0.2.1")})
+		update.SetTsig(key.Name, c.algorithm, 300, time.Now().Unix())
+
+		if m := serve(t, p, "127.0.0.1", update); m.Rcode != c.rcode {
+			t.Errorf("update signed with %s: expected %s, got %s", c.algorithm, dns.RcodeToString[c.rcode], dns.RcodeToString[m.Rcode])
+		}
+	}
+}
@@ -0,0 +1,588 @@
+package zone
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/homebot/dnswall"
+	"github.com/homebot/dnswall/request"
+	"github.com/miekg/dns"
+)
+
+// UpdatePolicy grants a TSIG key permission to modify zones using dynamic
+// updates (RFC 2136)
+type UpdatePolicy struct {
+	// Key is the name of the TSIG key updates must be signed with
+	Key string
+
+	// Algorithm is the algorithm of the key. Defaults to
+	// DefaultTsigAlgorithm
+	Algorithm string
+
+	// Names holds the names the key may modify. A leading "*." matches all
+	// names below the rest of the name. All names are allowed if empty
+	Names []string
+
+	// Types holds the types the key may modify. All types are allowed if
+	// empty
+	Types []uint16
+}
+
+// ParseUpdatePolicy parses an update policy in the format
+// key[:name[,name...][:type[,type...]]], e.g. "dhcp:*.lan.example.com:A,AAAA"
+func ParseUpdatePolicy(s string) (UpdatePolicy, error) {
+	parts := strings.Split(s, ":")
+	if parts[0] == "" || len(parts) > 3 {
+		return UpdatePolicy{}, fmt.Errorf("%q: expected key[:name[,name...][:type[,type...]]]", s)
+	}
+
+	policy := UpdatePolicy{
+		Key: dns.Fqdn(parts[0]),
+	}
+
+	if len(parts) > 1 && parts[1] != "" {
+		for _, name := range strings.Split(parts[1], ",") {
+			if _, ok := dns.IsDomainName(name); !ok {
+				return UpdatePolicy{}, fmt.Errorf("%q: invalid name %q", s, name)
+			}
+
+			policy.Names = append(policy.Names, dns.Fqdn(name))
+		}
+	}
+
+	if len(parts) > 2 && parts[2] != "" {
+		for _, t := range strings.Split(parts[2], ",") {
+			rtype, ok := dns.StringToType[strings.ToUpper(t)]
+			if !ok {
+				return UpdatePolicy{}, fmt.Errorf("%q: unknown type %q", s, t)
+			}
+
+			policy.Types = append(policy.Types, rtype)
+		}
+	}
+
+	return policy, nil
+}
+
+// allows returns true if the policy permits modifying records of the given
+// name and type
+func (policy UpdatePolicy) allows(name string, rtype uint16) bool {
+	// deleting all RRsets of a name (type ANY) is only allowed if the
+	// policy does not restrict types
+	if len(policy.Types) > 0 {
+		found := false
+		for _, t := range policy.Types {
+			if t == rtype {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if len(policy.Names) == 0 {
+		return true
+	}
+
+	for _, n := range policy.Names {
+		if strings.HasPrefix(n, "*.") {
+			parent := n[2:]
+			if dns.IsSubDomain(parent, name) && !equal(parent, name) {
+				return true
+			}
+
+			continue
+		}
+
+		if equal(n, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WithUpdatePolicies allows dynamic updates (RFC 2136) signed with the TSIG
+// keys of policies. Updates are refused by default. Changes are appended to
+// the journal file next to the file of the zone, if any
+func (p *Provider) WithUpdatePolicies(policies ...UpdatePolicy) *Provider {
+	p.rw.Lock()
+	defer p.rw.Unlock()
+
+	p.policies = append(p.policies, policies...)
+
+	return p
+}
+
+// update serves dynamic update requests (RFC 2136 section 3)
+func (p *Provider) update(session *dnswall.Session, req *request.Request) error {
+	// zone section (section 3.1)
+	if len(req.Req.Question) != 1 || req.Req.Question[0].Qtype != dns.TypeSOA {
+		return session.Reject(dns.RcodeFormatError)
+	}
+
+	// updates are only accepted for the origins of served zones (section
+	// 3.1.1)
+	zone := p.zone(string(req.Name()))
+	if zone == nil {
+		return session.Reject(dns.RcodeNotAuth)
+	}
+
+	// updates of secondary zones must be sent to the primaries
+	if p.secondary(string(zone.Name)) != nil {
+		return session.Reject(dns.RcodeRefused)
+	}
+
+	// authorization (section 3.3)
+	policies, rcode := p.keyPolicies(req)
+	if rcode != dns.RcodeSuccess {
+		return session.Reject(rcode)
+	}
+
+	if len(policies) == 0 {
+		log.Printf("[zone] refused update of %s from %s\n", zone.Name, req.ClientIP())
+		return session.Reject(dns.RcodeRefused)
+	}
+
+	// concurrent updates would overwrite each others changes
+	p.updateLock.Lock()
+	defer p.updateLock.Unlock()
+
+	// the zone may have been replaced while waiting for the lock
+	zone = p.zone(string(zone.Name))
+	if zone == nil {
+		return session.Reject(dns.RcodeServerFailure)
+	}
+
+	class := dns.Class(req.Req.Question[0].Qclass)
+
+	d, rcode := zone.update(class, req.Req, policies)
+	if rcode != dns.RcodeSuccess {
+		return session.Reject(rcode)
+	}
+
+	if d != nil {
+		go p.notifyChanged(zone)
+
+		log.Printf("[zone] updated %s (serial %d) by %s\n", zone.Name, d.To.Serial, req.ClientIP())
+	}
+
+	m := session.Prepare()
+
+	return session.ResolveWith(m)
+}
+
+// update applies the update msg permitted by policies to z in place and
+// records the changes in the journal file of z. Requests for z wait until
+// the update is complete. It returns the changes, if any, and the response
+// code
+func (z *Zone) update(class dns.Class, msg *dns.Msg, policies []UpdatePolicy) (*Delta, int) {
+	z.rw.Lock()
+	defer z.rw.Unlock()
+
+	if rcode := z.prerequisites(class, msg.Answer); rcode != dns.RcodeSuccess {
+		return nil, rcode
+	}
+
+	if rcode := z.prescan(class, msg.Ns); rcode != dns.RcodeSuccess {
+		return nil, rcode
+	}
+
+	for _, rr := range msg.Ns {
+		allowed := false
+		for _, policy := range policies {
+			if policy.allows(rr.Header().Name, rr.Header().Rrtype) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			log.Printf("[zone] refused update of %s in %s: not permitted for key %s\n", rr.Header().Name, z.Name, msg.IsTsig().Header().Name)
+			return nil, dns.RcodeRefused
+		}
+	}
+
+	d, changed := z.applyUpdate(class, msg.Ns)
+	if !changed {
+		return nil, dns.RcodeSuccess
+	}
+
+	if z.file != "" {
+		if err := appendJournal(journalFile(z.file), d); err != nil {
+			z.applyDelta(d.inverse())
+
+			log.Printf("[zone] failed to save update of %s: %s\n", z.Name, err)
+			return nil, dns.RcodeServerFailure
+		}
+	}
+
+	z.journal.Add(d)
+
+	return &d, dns.RcodeSuccess
+}
+
+// keyPolicies returns the update policies of the key the request has been
+// signed with. Requests signed with the name of a key but another algorithm
+// are answered with NOTAUTH
+func (p *Provider) keyPolicies(req *request.Request) ([]UpdatePolicy, int) {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+
+	keys := make([]TsigKey, len(p.policies))
+	for i, policy := range p.policies {
+		keys[i] = TsigKey{Name: policy.Key, Algorithm: policy.Algorithm}
+	}
+
+	if badKey(req, keys) {
+		return nil, dns.RcodeNotAuth
+	}
+
+	var policies []UpdatePolicy
+	for i, policy := range p.policies {
+		if keys[i].signed(req) {
+			policies = append(policies, policy)
+		}
+	}
+
+	return policies, dns.RcodeSuccess
+}
+
+// prerequisites checks the prerequisite section of an update (RFC 2136
+// section 3.2) and returns the response code
+func (z *Zone) prerequisites(class dns.Class, prereqs []dns.RR) int {
+	// value dependent prerequisites are compared per RRset
+	rrsets := make(map[string][]dns.RR)
+
+	for _, rr := range prereqs {
+		h := rr.Header()
+
+		if h.Ttl != 0 {
+			return dns.RcodeFormatError
+		}
+
+		if !z.Contains(dns.Name(h.Name)) {
+			return dns.RcodeNotZone
+		}
+
+		switch h.Class {
+		case dns.ClassANY:
+			if h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+
+			if h.Rrtype == dns.TypeANY {
+				if !z.inUse(class, h.Name) {
+					return dns.RcodeNameError
+				}
+			} else if _, ok := z.Lookup(class, dns.Type(h.Rrtype), dns.Name(h.Name)); !ok {
+				return dns.RcodeNXRrset
+			}
+
+		case dns.ClassNONE:
+			if h.Rdlength != 0 {
+				return dns.RcodeFormatError
+			}
+
+			if h.Rrtype == dns.TypeANY {
+				if z.inUse(class, h.Name) {
+					return dns.RcodeYXDomain
+				}
+			} else if _, ok := z.Lookup(class, dns.Type(h.Rrtype), dns.Name(h.Name)); ok {
+				return dns.RcodeYXRrset
+			}
+
+		case uint16(class):
+			key := strings.ToLower(dns.Fqdn(h.Name)) + "/" + dns.TypeToString[h.Rrtype]
+			rrsets[key] = append(rrsets[key], rr)
+
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	for _, rrs := range rrsets {
+		h := rrs[0].Header()
+		existing, _ := z.Lookup(class, dns.Type(h.Rrtype), dns.Name(h.Name))
+
+		if !sameRRset(existing, rrs) {
+			return dns.RcodeNXRrset
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// prescan checks the update section of an update (RFC 2136 section 3.4.1)
+// and returns the response code
+func (z *Zone) prescan(class dns.Class, updates []dns.RR) int {
+	for _, rr := range updates {
+		h := rr.Header()
+
+		if !z.Contains(dns.Name(h.Name)) {
+			return dns.RcodeNotZone
+		}
+
+		switch h.Class {
+		case uint16(class):
+			if isMetaType(h.Rrtype) || h.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+
+		case dns.ClassANY:
+			if h.Ttl != 0 || h.Rdlength != 0 || (isMetaType(h.Rrtype) && h.Rrtype != dns.TypeANY) {
+				return dns.RcodeFormatError
+			}
+
+		case dns.ClassNONE:
+			if h.Ttl != 0 || isMetaType(h.Rrtype) || h.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError
+			}
+
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// change collects the records added to and deleted from a zone by an
+// update. Records that are added and deleted again cancel out
+type change struct {
+	zone  *Zone
+	class dns.Class
+	delta Delta
+}
+
+// insert adds rr to the zone
+func (c *change) insert(rr dns.RR) {
+	if !c.zone.Insert(rr) {
+		return
+	}
+
+	if i := indexOf(c.delta.Deleted, rr); i >= 0 {
+		c.delta.Deleted = append(c.delta.Deleted[:i:i], c.delta.Deleted[i+1:]...)
+		return
+	}
+
+	c.delta.Added = append(c.delta.Added, rr)
+}
+
+// remove removes the record of the zone that equals rr apart from its TTL.
+// It returns false if there is none
+func (c *change) remove(rr dns.RR) bool {
+	h := rr.Header()
+
+	existing, _ := c.zone.Lookup(c.class, dns.Type(h.Rrtype), dns.Name(h.Name))
+	for _, e := range existing {
+		if !duplicate(e, rr) || !c.zone.Remove(e) {
+			continue
+		}
+
+		if i := indexOf(c.delta.Added, e); i >= 0 {
+			c.delta.Added = append(c.delta.Added[:i:i], c.delta.Added[i+1:]...)
+		} else {
+			c.delta.Deleted = append(c.delta.Deleted, e)
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// indexOf returns the index of rr in rrs including its TTL or -1
+func indexOf(rrs []dns.RR, rr dns.RR) int {
+	key := recordKey(rr)
+
+	for i, existing := range rrs {
+		if recordKey(existing) == key {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// applyUpdate applies the update section of an update (RFC 2136 section
+// 3.4.2) to z. The serial of the SOA record is increased unless the update
+// increased it already. It returns the changes or false if nothing changed
+func (z *Zone) applyUpdate(class dns.Class, updates []dns.RR) (Delta, bool) {
+	oldSOA, ok := z.SOA(class)
+	if !ok {
+		return Delta{}, false
+	}
+
+	c := &change{zone: z, class: class}
+	apex := string(z.Name)
+
+	// the SOA record is not part of the added and deleted records
+	soa := oldSOA
+
+	for _, rr := range updates {
+		h := rr.Header()
+		name := dns.Name(h.Name)
+		atApex := equal(h.Name, apex)
+
+		switch h.Class {
+		case uint16(class):
+			switch {
+			case h.Rrtype == dns.TypeSOA:
+				if !atApex || !serialGreater(rr.(*dns.SOA).Serial, soa.Serial) {
+					continue
+				}
+
+				soa = rr.(*dns.SOA)
+				continue
+
+			case h.Rrtype == dns.TypeCNAME:
+				// CNAME records cannot coexist with other data
+				if z.hasOtherThan(class, name, dns.TypeCNAME) {
+					continue
+				}
+
+				if cnames, ok := z.Lookup(class, dns.Type(dns.TypeCNAME), name); ok {
+					for _, cname := range cnames {
+						c.remove(cname)
+					}
+				}
+
+			default:
+				if _, ok := z.Lookup(class, dns.Type(dns.TypeCNAME), name); ok {
+					continue
+				}
+			}
+
+			// replace records that only differ in their TTL
+			c.remove(rr)
+			c.insert(rr)
+
+		case dns.ClassANY:
+			types := []uint16{h.Rrtype}
+
+			if h.Rrtype == dns.TypeANY {
+				types = nil
+
+				if n, ok := z.node(name); ok {
+					for t := range n.rrsets {
+						types = append(types, t)
+					}
+				}
+			}
+
+			for _, t := range types {
+				// the SOA and NS records of the apex cannot be deleted
+				if atApex && (t == dns.TypeSOA || t == dns.TypeNS) {
+					continue
+				}
+
+				rrs, _ := z.Lookup(class, dns.Type(t), name)
+				for _, existing := range rrs {
+					c.remove(existing)
+				}
+			}
+
+		case dns.ClassNONE:
+			if h.Rrtype == dns.TypeSOA {
+				continue
+			}
+
+			if atApex && h.Rrtype == dns.TypeNS && len(z.NS(class)) <= 1 {
+				continue
+			}
+
+			deleted := dns.Copy(rr)
+			deleted.Header().Class = uint16(class)
+
+			c.remove(deleted)
+		}
+	}
+
+	if len(c.delta.Added) == 0 && len(c.delta.Deleted) == 0 && soa == oldSOA {
+		return Delta{}, false
+	}
+
+	// increase the serial unless the update did (section 3.6)
+	if soa == oldSOA {
+		soa = dns.Copy(oldSOA).(*dns.SOA)
+		soa.Serial++
+	}
+
+	z.Remove(oldSOA)
+	z.Insert(soa)
+
+	c.delta.From, c.delta.To = oldSOA, soa
+
+	return c.delta, true
+}
+
+// inUse returns true if name owns records of the given class
+func (z *Zone) inUse(class dns.Class, name string) bool {
+	n, ok := z.node(dns.Name(name))
+	if !ok {
+		return false
+	}
+
+	for t := range n.rrsets {
+		if n.has(class, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasOtherThan returns true if name owns records of the given class with a
+// type other than rtype
+func (z *Zone) hasOtherThan(class dns.Class, name dns.Name, rtype uint16) bool {
+	n, ok := z.node(name)
+	if !ok {
+		return false
+	}
+
+	for t := range n.rrsets {
+		if t != rtype && n.has(class, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameRRset returns true if a and b hold the same records ignoring TTLs
+func sameRRset(a, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for _, rr := range b {
+		found := false
+		for _, existing := range a {
+			if duplicate(existing, rr) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isMetaType returns true for query types that cannot be stored in zones
+func isMetaType(t uint16) bool {
+	switch t {
+	case dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeANY, dns.TypeOPT, dns.TypeTSIG:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,241 @@
+package zone
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newUpdate returns an update of example.com. signed with key, if set
+func newUpdate(key string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetUpdate("example.com.")
+
+	if key != "" {
+		m.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+
+	return m
+}
+
+func TestUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnswall-zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "example.com.zone")
+	writeZone(t, file, 1, "old.hosts")
+
+	original, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := LoadZoneFile(file, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := ParseUpdatePolicy("dhcp:*.hosts.example.com:A,AAAA")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProvider(z).WithUpdatePolicies(policy)
+
+	// requests are answered while the zone is updated
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			q := new(dns.Msg)
+			q.SetQuestion("pc1.hosts.example.com.", dns.TypeA)
+			serve(t, p, "127.0.0.1", q)
+		}
+	}()
+
+	cases := []struct {
+		name   string
+		key    string
+		build  func(m *dns.Msg)
+		rcode  int
+		serial uint32
+	}{
+		{"unsigned", "", func(m *dns.Msg) {
+			m.Insert([]dns.RR{newRR(t, "pc1.hosts.example.com. 300 A 192.0.2.50")})
+		}, dns.RcodeRefused, 1},
+		{"unknown key", "other.", func(m *dns.Msg) {
+			m.Insert([]dns.RR{newRR(t, "pc1.hosts.example.com. 300 A 192.0.2.50")})
+		}, dns.RcodeRefused, 1},
+		{"name not permitted", "dhcp.", func(m *dns.Msg) {
+			m.Insert([]dns.RR{newRR(t, "pc1.example.com. 300 A 192.0.2.50")})
+		}, dns.RcodeRefused, 1},
+		{"type not permitted", "dhcp.", func(m *dns.Msg) {
+			m.Insert([]dns.RR{newRR(t, "pc1.hosts.example.com. 300 TXT pc1")})
+		}, dns.RcodeRefused, 1},
+		{"not in zone", "dhcp.", func(m *dns.Msg) {
+			m.Insert([]dns.RR{newRR(t, "pc1.example.org. 300 A 192.0.2.50")})
+		}, dns.RcodeNotZone, 1},
+		{"add", "dhcp.", func(m *dns.Msg) {
+			m.NameNotUsed([]dns.RR{newRR(t, "pc1.hosts.example.com. A 0.0.0.0")})
+			m.Insert([]dns.RR{newRR(t, "pc1.hosts.example.com. 300 A 192.0.2.50")})
+		}, dns.RcodeSuccess, 2},
+		{"name in use", "dhcp.", func(m *dns.Msg) {
+			m.NameNotUsed([]dns.RR{newRR(t, "pc1.hosts.example.com. A 0.0.0.0")})
+			m.Insert([]dns.RR{newRR(t, "pc1.hosts.example.com. 300 A 192.0.2.50")})
+		}, dns.RcodeYXDomain, 2},
+		{"existing record", "dhcp.", func(m *dns.Msg) {
+			m.Insert([]dns.RR{newRR(t, "pc1.hosts.example.com. 300 A 192.0.2.50")})
+		}, dns.RcodeSuccess, 2},
+		{"value mismatch", "dhcp.", func(m *dns.Msg) {
+			m.Used([]dns.RR{newRR(t, "pc1.hosts.example.com. 0 A 192.0.2.51")})
+			m.Insert([]dns.RR{newRR(t, "pc1.hosts.example.com. 300 A 192.0.2.52")})
+		}, dns.RcodeNXRrset, 2},
+		{"replace", "dhcp.", func(m *dns.Msg) {
+			m.Used([]dns.RR{newRR(t, "pc1.hosts.example.com. 0 A 192.0.2.50")})
+			m.RemoveRRset([]dns.RR{newRR(t, "pc1.hosts.example.com. A 0.0.0.0")})
+			m.Insert([]dns.RR{newRR(t, "pc1.hosts.example.com. 300 A 192.0.2.51")})
+			m.Remove([]dns.RR{newRR(t, "old.hosts.example.com. A 192.0.2.10")})
+		}, dns.RcodeSuccess, 3},
+	}
+
+	for _, c := range cases {
+		m := newUpdate(c.key)
+		c.build(m)
+
+		if resp := serve(t, p, "127.0.0.1", m); resp.Rcode != c.rcode {
+			t.Errorf("%s: expected %s, got %s", c.name, dns.RcodeToString[c.rcode], dns.RcodeToString[resp.Rcode])
+		}
+
+		if serial, _ := z.currentSOA(); serial.Serial != c.serial {
+			t.Errorf("%s: expected serial %d, got %d", c.name, c.serial, serial.Serial)
+		}
+	}
+
+	close(stop)
+	<-done
+
+	// the zone is updated in place
+	if p.zone("example.com.") != z {
+		t.Error("the zone has been replaced")
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("pc1.hosts.example.com.", dns.TypeA)
+	if m := serve(t, p, "127.0.0.1", q); len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.0.2.51" {
+		t.Errorf("unexpected answer %v", m.Answer)
+	}
+
+	deltas, ok := z.Journal().Since(2)
+	if !ok || len(deltas) != 1 {
+		t.Fatalf("expected one journal entry, got %v", deltas)
+	}
+
+	if d := deltas[0]; len(d.Deleted) != 2 || len(d.Added) != 1 || d.Added[0].(*dns.A).A.String() != "192.0.2.51" {
+		t.Errorf("unexpected changes: -%v +%v", d.Deleted, d.Added)
+	}
+
+	// the zone file is left alone, the changes are replayed from the
+	// journal file
+	if data, _ := ioutil.ReadFile(file); !bytes.Equal(data, original) {
+		t.Error("the zone file has been modified")
+	}
+
+	loaded, err := LoadZoneFile(file, "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if serial, _ := loaded.Serial(); serial != 3 || loaded.Len() != z.Len() {
+		t.Errorf("expected serial 3 and %d records, got serial %d and %d records", z.Len(), serial, loaded.Len())
+	}
+
+	if _, ok := loaded.Journal().Since(1); !ok {
+		t.Error("the changes have not been added to the journal of the loaded zone")
+	}
+
+	// changes that do not continue the edited zone file are skipped
+	writeZone(t, file, 10, "www")
+
+	loaded, err = LoadZoneFile(file, "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if serial, _ := loaded.Serial(); serial != 10 || loaded.Len() != 4 {
+		t.Errorf("expected serial 10 and 4 records, got serial %d and %d records", serial, loaded.Len())
+	}
+}
+
+func TestUpdateNotAuthoritative(t *testing.T) {
+	z, err := LoadZone("example.com.", bytes.NewBufferString("@ 60 IN SOA ns admin 1 7200 600 360000 60\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProvider(z).WithUpdatePolicies(UpdatePolicy{Key: "dhcp."})
+
+	for _, name := range []string{"example.org.", "www.example.com."} {
+		m := new(dns.Msg)
+		m.SetUpdate(name)
+		m.SetTsig("dhcp.", dns.HmacSHA256, 300, time.Now().Unix())
+
+		if resp := serve(t, p, "127.0.0.1", m); resp.Rcode != dns.RcodeNotAuth {
+			t.Errorf("expected update of %s to be answered with NOTAUTH, got %s", name, dns.RcodeToString[resp.Rcode])
+		}
+	}
+}
+
+func TestUpdateRevertedIfJournalFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnswall-zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "example.com.zone")
+	writeZone(t, file, 1, "www")
+
+	// the journal cannot be written
+	if err := os.Mkdir(journalFile(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	z, err := LoadZoneFile(file, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewProvider(z).WithUpdatePolicies(UpdatePolicy{Key: "dhcp."})
+
+	m := newUpdate("dhcp.")
+	m.RemoveName([]dns.RR{newRR(t, "www.example.com. A 0.0.0.0")})
+	m.Insert([]dns.RR{newRR(t, "ftp.example.com. 300 A 192.0.2.2")})
+
+	if resp := serve(t, p, "127.0.0.1", m); resp.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL, got %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	if serial, _ := z.Serial(); serial != 1 || z.Len() != 4 {
+		t.Errorf("expected serial 1 and 4 records, got serial %d and %d records", serial, z.Len())
+	}
+
+	if _, ok := z.Lookup(dns.Class(dns.ClassINET), dns.Type(dns.TypeA), "www.example.com."); !ok {
+		t.Error("the deleted record has not been restored")
+	}
+}
@@ -5,6 +5,9 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/miekg/dns"
 )
@@ -15,46 +18,358 @@ type Zone struct {
 	// e.g. example.com.
 	Name dns.Name
 
-	// Resources holds resources for the zone
-	Resources []dns.RR
+	// tree holds the records of the zone indexed by owner name and type.
+	// rw guards it while the zone is served as dynamic updates modify it
+	// in place
+	rw   sync.RWMutex
+	tree *node
+	len  int
+
+	// file is the zone file the zone has been loaded from and modTime its
+	// modification time at that point
+	file    string
+	modTime time.Time
+	loaded  time.Time
+
+	// journal records the changes of the zone for incremental transfers
+	journal *Journal
+}
+
+// NewZone returns a new, empty zone for origin
+func NewZone(origin string) *Zone {
+	return &Zone{
+		Name:    dns.Name(dns.Fqdn(origin)),
+		tree:    newTree(),
+		loaded:  time.Now(),
+		journal: NewJournal(DefaultJournalSize),
+	}
+}
+
+// Insert adds rr to the zone. It returns false if rr is already part of
+// the zone. Records differing only in their TTL are considered equal
+func (z *Zone) Insert(rr dns.RR) bool {
+	if z.tree == nil {
+		z.tree = newTree()
+	}
+
+	if !z.tree.insert(rr, true) {
+		return false
+	}
+
+	z.len++
+	return true
+}
+
+// Remove removes rr from the zone. It returns false if rr is not part of
+// the zone
+func (z *Zone) Remove(rr dns.RR) bool {
+	if z.tree == nil || !z.tree.remove(rr) {
+		return false
+	}
+
+	z.len--
+	return true
+}
+
+// File returns the file the zone has been loaded from
+func (z *Zone) File() string {
+	return z.file
+}
+
+// Journal returns the journal of changes of the zone
+func (z *Zone) Journal() *Journal {
+	return z.journal
+}
+
+// Serial returns the serial of the SOA record of the zone
+func (z *Zone) Serial() (uint32, bool) {
+	soa, ok := z.SOA(dns.Class(dns.ClassINET))
+	if !ok {
+		return 0, false
+	}
+
+	return soa.Serial, true
+}
+
+// Len returns the number of records in the zone
+func (z *Zone) Len() int {
+	return z.len
+}
+
+// Records returns all records of the zone in canonical order (RFC 4034
+// section 6.1)
+func (z *Zone) Records() []dns.RR {
+	rrs := make([]dns.RR, 0, z.len)
+
+	if z.tree != nil {
+		z.tree.walk(func(n *node) bool {
+			rrs = append(rrs, n.records()...)
+			return true
+		})
+	}
+
+	return rrs
+}
+
+// Previous returns the name with records that precedes name in canonical
+// order (RFC 4034 section 6.1). It is the owner of the NSEC record that
+// covers name if name does not exist
+func (z *Zone) Previous(name dns.Name) (dns.Name, bool) {
+	if z.tree == nil {
+		return "", false
+	}
+
+	n, ok := z.tree.predecessor(string(name))
+	if !ok {
+		return "", false
+	}
+
+	return dns.Name(n.name), true
 }
 
 // Lookup searches for a RR of the given class and type within the zone
-func (z Zone) Lookup(class dns.Class, rtype dns.Type, name dns.Name) ([]dns.RR, bool) {
-	var results []dns.RR
+func (z *Zone) Lookup(class dns.Class, rtype dns.Type, name dns.Name) ([]dns.RR, bool) {
+	n, ok := z.node(name)
+	if !ok {
+		return nil, false
+	}
+
+	results := n.rrset(class, uint16(rtype))
+
+	return results, len(results) > 0
+}
+
+// Exists returns true if name owns resource records of the given class or
+// is an empty non-terminal, i.e. a name without records that has
+// descendants with records (RFC 4592 section 2.2.2)
+func (z *Zone) Exists(class dns.Class, name dns.Name) bool {
+	n, ok := z.node(name)
+	if !ok {
+		return false
+	}
 
-	for _, rr := range z.Resources {
-		if rr.Header().Rrtype == uint16(rtype) && rr.Header().Class == uint16(class) && rr.Header().Name == name.String() {
-			results = append(results, rr)
+	if len(n.children) > 0 {
+		return true
+	}
+
+	for _, rrs := range n.rrsets {
+		for _, rr := range rrs {
+			if rr.Header().Class == uint16(class) {
+				return true
+			}
 		}
 	}
 
-	return results, len(results) > 0
+	return false
+}
+
+// node returns the node of name in the tree of the zone
+func (z *Zone) node(name dns.Name) (*node, bool) {
+	if z.tree == nil {
+		return nil, false
+	}
+
+	return z.tree.lookup(string(name))
+}
+
+// Contains returns true if name is the apex of the zone or below it
+func (z *Zone) Contains(name dns.Name) bool {
+	return dns.IsSubDomain(string(z.Name), string(name))
+}
+
+// closestEncloser returns the longest existing ancestor of name within
+// the zone (RFC 4592 section 3.3.1)
+func (z *Zone) closestEncloser(class dns.Class, name dns.Name) (dns.Name, bool) {
+	if z.tree == nil {
+		return "", false
+	}
+
+	for n, _ := z.tree.find(string(name)); n != nil; n = n.parent {
+		ancestor := dns.Name(n.name)
+
+		if !z.Contains(ancestor) {
+			break
+		}
+
+		if z.Exists(class, ancestor) {
+			return ancestor, true
+		}
+	}
+
+	return "", false
+}
+
+// wildcard returns the source of synthesis for name, i.e. the wildcard
+// domain name below the closest encloser of name (RFC 4592 section 3.3.1).
+// It must only be used for names that do not exist
+func (z *Zone) wildcard(class dns.Class, name dns.Name) (dns.Name, bool) {
+	ce, ok := z.closestEncloser(class, name)
+	if !ok {
+		return "", false
+	}
+
+	source := dns.Name("*." + dns.Fqdn(string(ce)))
+	if !z.Exists(class, source) {
+		return "", false
+	}
+
+	return source, true
+}
+
+// dname returns the DNAME record owned by an ancestor of name within the
+// zone. Names that own a DNAME record are not redirected themselves
+func (z *Zone) dname(class dns.Class, name dns.Name) (*dns.DNAME, bool) {
+	path, exact := z.path(name)
+	if exact {
+		path = path[:len(path)-1]
+	}
+
+	// start at the top so records occluded by a DNAME are never used
+	for _, n := range path {
+		if rrs := n.rrset(class, dns.TypeDNAME); len(rrs) > 0 {
+			return rrs[0].(*dns.DNAME), true
+		}
+	}
+
+	return nil, false
+}
+
+// cut returns the NS records of the zone cut at or above name. Zone cuts
+// delegate a sub-zone to other servers; all data below them is only used
+// as glue. DS records are owned by the parent side of a cut, so a cut at
+// name itself is ignored for DS queries
+func (z *Zone) cut(class dns.Class, rtype dns.Type, name dns.Name) ([]dns.RR, bool) {
+	path, exact := z.path(name)
+	if exact && rtype == dns.Type(dns.TypeDS) {
+		path = path[:len(path)-1]
+	}
+
+	// start at the top, records below a cut are not authoritative. NS
+	// records at the apex do not form a cut
+	for i, n := range path {
+		if i == 0 {
+			continue
+		}
+
+		if rrs := n.rrset(class, dns.TypeNS); len(rrs) > 0 {
+			return rrs, true
+		}
+	}
+
+	return nil, false
+}
+
+// path returns the nodes from the apex of the zone to name as far as they
+// exist and whether the last node is the one of name itself
+func (z *Zone) path(name dns.Name) ([]*node, bool) {
+	if z.tree == nil || !z.Contains(name) {
+		return nil, false
+	}
+
+	apex := dns.CountLabel(string(z.Name))
+
+	var path []*node
+	n := z.tree
+
+	if apex == 0 {
+		path = append(path, n)
+	}
+
+	for depth, l := range labels(string(name)) {
+		child, ok := n.children[l]
+		if !ok {
+			return path, false
+		}
+
+		n = child
+
+		if depth+1 >= apex {
+			path = append(path, n)
+		}
+	}
+
+	return path, true
+}
+
+// SOA returns the SOA record at the apex of the zone
+func (z *Zone) SOA(class dns.Class) (*dns.SOA, bool) {
+	rrs, ok := z.Lookup(class, dns.Type(dns.TypeSOA), z.Name)
+	if !ok {
+		return nil, false
+	}
+
+	return rrs[0].(*dns.SOA), true
+}
+
+// NS returns the NS records at the apex of the zone
+func (z *Zone) NS(class dns.Class) []dns.RR {
+	rrs, _ := z.Lookup(class, dns.Type(dns.TypeNS), z.Name)
+	return rrs
+}
+
+// Glue returns the A and AAAA records of the zone for the name server
+// targets of ns
+func (z *Zone) Glue(class dns.Class, ns []dns.RR) []dns.RR {
+	var glue []dns.RR
+
+	for _, rr := range ns {
+		n, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		for _, t := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			rrs, _ := z.Lookup(class, dns.Type(t), dns.Name(n.Ns))
+			glue = append(glue, rrs...)
+		}
+	}
+
+	return glue
+}
+
+// equal returns true if the domain names a and b are equal
+func equal(a, b string) bool {
+	return strings.EqualFold(dns.Fqdn(a), dns.Fqdn(b))
 }
 
 // LoadZone loads a zone from the given reader
 func LoadZone(origin string, r io.Reader) (*Zone, error) {
+	return loadZone(origin, "", r)
+}
+
+// loadZone loads a zone from r. file is used to resolve $INCLUDE
+// directives and in error messages
+func loadZone(origin, file string, r io.Reader) (*Zone, error) {
 	if _, ok := dns.IsDomainName(origin); !ok {
 		return nil, errors.New("invalid zone origin domain name")
 	}
 
-	z := &Zone{
-		Name: dns.Name(origin),
-	}
+	z := NewZone(origin)
 
-	for rr := range dns.ParseZone(r, origin, "") {
+	for rr := range dns.ParseZone(r, string(z.Name), file) {
 		if rr.Error != nil {
 			return nil, rr.Error
 		}
 
-		log.Println(rr.RR.String())
-		z.Resources = append(z.Resources, rr.RR)
+		if !z.Contains(dns.Name(rr.RR.Header().Name)) {
+			log.Printf("[zone] %s: ignoring out-of-zone record: %s\n", origin, rr.RR.String())
+			continue
+		}
+
+		if z.tree.insert(rr.RR, false) {
+			z.len++
+		}
 	}
 
+	z.tree.sort()
+
+	log.Printf("[zone] loaded %d records for %s\n", z.Len(), z.Name)
+
 	return z, nil
 }
 
-// LoadZoneFile loads a DNS zone from the given file
+// LoadZoneFile loads a DNS zone from the given file. Changes of dynamic
+// updates recorded in the journal file next to it are applied as well
 func LoadZoneFile(file string, origin string) (*Zone, error) {
 	r, err := os.Open(file)
 	if err != nil {
@@ -62,5 +377,22 @@ func LoadZoneFile(file string, origin string) (*Zone, error) {
 	}
 	defer r.Close()
 
-	return LoadZone(origin, r)
+	fi, err := r.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	z, err := loadZone(origin, file, r)
+	if err != nil {
+		return nil, err
+	}
+
+	z.file = file
+	z.modTime = fi.ModTime()
+
+	if err := z.replay(journalFile(file)); err != nil {
+		return nil, err
+	}
+
+	return z, nil
 }